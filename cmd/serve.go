@@ -4,9 +4,11 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/fishnix/tucson/internal/srv"
+	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -31,6 +33,34 @@ func init() {
 	serveCmd.Flags().String("listen", "0.0.0.0:8000", "address to listen on")
 	viperBindFlag("listen", serveCmd.Flags().Lookup("listen"))
 
+	serveCmd.Flags().Bool("h2c", false, "accept cleartext http/2 (h2c) connections, ie. from grpc clients without tls")
+	viperBindFlag("h2c", serveCmd.Flags().Lookup("h2c"))
+	viperBindEnv("h2c")
+
+	serveCmd.Flags().Duration("read-header-timeout", 10*time.Second, "how long clients have to send the request headers")
+	viperBindFlag("read-header-timeout", serveCmd.Flags().Lookup("read-header-timeout"))
+	viperBindEnv("read-header-timeout")
+
+	serveCmd.Flags().Duration("idle-timeout", 120*time.Second, "how long idle keep-alive client connections are kept open")
+	viperBindFlag("idle-timeout", serveCmd.Flags().Lookup("idle-timeout"))
+	viperBindEnv("idle-timeout")
+
+	serveCmd.Flags().StringSlice("trusted-proxies", []string{}, "addresses or cidr ranges of proxies whose forwarding headers are trusted")
+	viperBindFlag("trusted-proxies", serveCmd.Flags().Lookup("trusted-proxies"))
+	viperBindEnv("trusted-proxies")
+
+	serveCmd.Flags().String("egress-proxy", "", "default http, https or socks5 proxy url for reaching origins, proxy environment variables apply without it")
+	viperBindFlag("egress-proxy", serveCmd.Flags().Lookup("egress-proxy"))
+	viperBindEnv("egress-proxy")
+
+	serveCmd.Flags().StringSlice("egress-no-proxy", []string{}, "hosts, domains, ips or cidr ranges reached without the default egress proxy")
+	viperBindFlag("egress-no-proxy", serveCmd.Flags().Lookup("egress-no-proxy"))
+	viperBindEnv("egress-no-proxy")
+
+	serveCmd.Flags().String("error-pages", "", "directory with error page templates named <status>.html, <status>.json, error.html or error.json")
+	viperBindFlag("error-pages", serveCmd.Flags().Lookup("error-pages"))
+	viperBindEnv("error-pages")
+
 	serveCmd.Flags().String("default-origin", "default", "name of the default origin")
 	viperBindFlag("default-origin", serveCmd.Flags().Lookup("default-origin"))
 	viperBindEnv("default-origin")
@@ -39,6 +69,18 @@ func init() {
 	viperBindFlag("signing-key", serveCmd.Flags().Lookup("signing-key"))
 	viperBindEnv("signing-key")
 
+	serveCmd.Flags().Duration("session-idle-timeout", 60*time.Minute, "session idle timeout, 0 to disable")
+	viperBindFlag("session.idle-timeout", serveCmd.Flags().Lookup("session-idle-timeout"))
+	viperBindEnv("session.idle-timeout")
+
+	serveCmd.Flags().Duration("session-absolute-timeout", 12*time.Hour, "maximum session lifetime regardless of activity")
+	viperBindFlag("session.absolute-timeout", serveCmd.Flags().Lookup("session-absolute-timeout"))
+	viperBindEnv("session.absolute-timeout")
+
+	serveCmd.Flags().Int("session-max-per-user", 0, "maximum concurrent sessions per user, the oldest are evicted (0 for unlimited)")
+	viperBindFlag("session.max-per-user", serveCmd.Flags().Lookup("session-max-per-user"))
+	viperBindEnv("session.max-per-user")
+
 	serveCmd.Flags().String("oidc-issuer", "", "oidc issuer url")
 	viperBindFlag("oidc.issuer", serveCmd.Flags().Lookup("oidc-issuer"))
 	viperBindEnv("oidc.issuer")
@@ -96,6 +138,24 @@ func serve() error {
 		sk = viper.GetString("signing-key")
 	}
 
+	trusted, err := srv.ParseTrustedProxies(viper.GetStringSlice("trusted-proxies"))
+	if err != nil {
+		panic(err)
+	}
+
+	pages, err := srv.LoadErrorPages(viper.GetString("error-pages"))
+	if err != nil {
+		panic(err)
+	}
+
+	var egress *srv.EgressProxyConfig
+	if viper.GetString("egress-proxy") != "" {
+		egress = &srv.EgressProxyConfig{
+			URL:     viper.GetString("egress-proxy"),
+			NoProxy: viper.GetStringSlice("egress-no-proxy"),
+		}
+	}
+
 	provider, err := newOidcProvider(ctx)
 	if err != nil {
 		panic(err)
@@ -105,14 +165,40 @@ func serve() error {
 		srv.WithDebug(viper.GetBool("logging.debug")),
 		srv.WithLogger(logger.Desugar()),
 		srv.WithListen(viper.GetString("listen")),
+		srv.WithH2C(viper.GetBool("h2c")),
+		srv.WithTrustedProxies(trusted),
+		srv.WithErrorPages(pages),
+		srv.WithEgressProxy(egress),
+		srv.WithReadHeaderTimeout(viper.GetDuration("read-header-timeout")),
+		srv.WithIdleTimeout(viper.GetDuration("idle-timeout")),
 		srv.WithDefaultOrigin(do),
 		srv.WithOrigins(o),
 		srv.WithMatchers(m),
 		srv.WithSigningKey(sk),
+		srv.WithSession(srv.SessionConfig{
+			IdleTimeout:     viper.GetDuration("session.idle-timeout"),
+			AbsoluteTimeout: viper.GetDuration("session.absolute-timeout"),
+			MaxPerUser:      viper.GetInt("session.max-per-user"),
+		}),
 		srv.WithOidcProvider(provider),
 		srv.WithOauth2Config(newOauth2Config(provider)),
 	)
 
+	// split weights are applied without a restart when the config file changes
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		m := matchers{}
+		if err := viper.UnmarshalKey("matchers", &m); err != nil {
+			logger.Errorw("failed to reload matchers, keeping the split weights", "error", err)
+			return
+		}
+
+		server.UpdateSplitWeights(m)
+	})
+
+	if viper.ConfigFileUsed() != "" {
+		viper.WatchConfig()
+	}
+
 	logger.Infow("starting server", "address", viper.GetString("listen"))
 
 	if err := server.Run(ctx); err != nil {
@@ -0,0 +1,405 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	balanceRoundRobin     = "round_robin"
+	balanceLeastConn      = "least_conn"
+	balanceRandomTwo      = "random_two"
+	balanceConsistentHash = "consistent_hash"
+
+	// hashReplicas is the number of points each unit of weight gets on the hash ring
+	hashReplicas = 100
+)
+
+type balancerContextKey struct{}
+
+// Target is one of the backends of an origin
+type Target struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// LoadBalancerConfig selects how requests are spread over the targets of an origin
+type LoadBalancerConfig struct {
+	Policy string `mapstructure:"policy"`
+	HashBy string `mapstructure:"hash_by"`
+}
+
+// targets returns the targets of the origin, the url is a single target
+func (o *Origin) targets() []Target {
+	if len(o.Targets) > 0 {
+		return o.Targets
+	}
+
+	if o.BaseUrl == "" {
+		return nil
+	}
+
+	return []Target{{URL: o.BaseUrl}}
+}
+
+// checkTargets returns an error if a target or the load balancer of the origin is invalid
+func (o *Origin) checkTargets() error {
+	targets := []*target{}
+
+	for _, t := range o.targets() {
+		target, err := newTarget(t)
+		if err != nil {
+			return err
+		}
+
+		targets = append(targets, target)
+	}
+
+	_, err := newBalancer(o.LoadBalancer, targets)
+
+	return err
+}
+
+// target is a parsed origin target and its load balancing state
+type target struct {
+	name   string
+	url    *url.URL
+	weight int
+
+	// active is the number of requests in flight
+	active int64
+	// unhealthy is set by the active health checks
+	unhealthy int32
+	// breaker is the circuit breaker of the target, if the origin has one
+	breaker *breaker
+	// current is the smooth weighted round robin state, guarded by the balancer
+	current int
+	// socket is the path of the unix socket of the target, if it is one
+	socket string
+}
+
+func newTarget(t Target) (*target, error) {
+	if t.Weight < 0 {
+		return nil, fmt.Errorf("target %q weight must not be negative", t.URL) //nolint:goerr113
+	}
+
+	weight := t.Weight
+	if weight == 0 {
+		weight = 1
+	}
+
+	if isUnixURL(t.URL) {
+		u, socket, err := parseUnixURL(t.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		return &target{name: "unix:" + socket, url: u, weight: weight, socket: socket}, nil
+	}
+
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("target url %q must be absolute", t.URL) //nolint:goerr113
+	}
+
+	return &target{name: u.Host, url: u, weight: weight}, nil
+}
+
+// host returns the Host header for requests to the target
+func (t *target) host() string {
+	if t.socket != "" {
+		return unixRequestHost
+	}
+
+	return t.url.Host
+}
+
+// available returns true if the target can take requests
+func (t *target) available() bool {
+	return t.healthy() && t.breaker.ready()
+}
+
+// healthy returns true unless the target failed its health checks
+func (t *target) healthy() bool {
+	return atomic.LoadInt32(&t.unhealthy) == 0
+}
+
+// load returns the weighted number of requests in flight
+func (t *target) load() float64 {
+	return float64(atomic.LoadInt64(&t.active)) / float64(t.weight)
+}
+
+// withTarget returns a copy of the context with the target of the request
+func withTarget(ctx context.Context, t *target) context.Context {
+	return context.WithValue(ctx, balancerContextKey{}, t)
+}
+
+// targetFromContext returns the target selected for the request
+func targetFromContext(ctx context.Context) *target {
+	t, _ := ctx.Value(balancerContextKey{}).(*target)
+	return t
+}
+
+// balancer picks the target for a request, it returns nil if no target is available
+type balancer interface {
+	next(r *http.Request) *target
+}
+
+// newBalancer returns the balancer for the policy
+func newBalancer(cfg *LoadBalancerConfig, targets []*target) (balancer, error) {
+	policy := balanceRoundRobin
+	if cfg != nil && cfg.Policy != "" {
+		policy = strings.ToLower(cfg.Policy)
+	}
+
+	switch policy {
+	case balanceRoundRobin:
+		return &roundRobin{targets: targets}, nil
+	case balanceLeastConn:
+		return &leastConn{roundRobin: roundRobin{targets: targets}}, nil
+	case balanceRandomTwo:
+		return &randomTwo{targets: targets}, nil
+	case balanceConsistentHash:
+		key, err := hashKeyFunc(cfg.HashBy)
+		if err != nil {
+			return nil, err
+		}
+
+		return newConsistentHash(targets, key), nil
+	}
+
+	return nil, fmt.Errorf("unknown load balancing policy %q", policy) //nolint:goerr113
+}
+
+// roundRobin is a smooth weighted round robin, targets are picked in proportion to their
+// weight without bursts to the heaviest target
+type roundRobin struct {
+	mu      sync.Mutex
+	targets []*target
+}
+
+func (b *roundRobin) next(_ *http.Request) *target {
+	available := make([]*target, 0, len(b.targets))
+	for _, t := range b.targets {
+		if t.available() {
+			available = append(available, t)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return smoothWeighted(available)
+}
+
+// smoothWeighted picks the next target by smooth weighted round robin, the caller must hold
+// the balancer lock
+func smoothWeighted(targets []*target) *target {
+	var (
+		best  *target
+		total int
+	)
+
+	for _, t := range targets {
+		t.current += t.weight
+		total += t.weight
+
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+
+	if best != nil {
+		best.current -= total
+	}
+
+	return best
+}
+
+// leastConn picks the target with the fewest weighted requests in flight, ties are broken by
+// round robin
+type leastConn struct {
+	roundRobin
+}
+
+func (b *leastConn) next(r *http.Request) *target {
+	var (
+		least float64 = -1
+		ties  []*target
+	)
+
+	for _, t := range b.targets {
+		if !t.available() {
+			continue
+		}
+
+		switch l := t.load(); {
+		case least < 0 || l < least:
+			least = l
+			ties = append(ties[:0], t)
+		case l == least:
+			ties = append(ties, t)
+		}
+	}
+
+	if len(ties) == 1 {
+		return ties[0]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return smoothWeighted(ties)
+}
+
+// randomTwo picks two random targets (by weight) and uses the one with less load
+type randomTwo struct {
+	targets []*target
+}
+
+func (b *randomTwo) next(_ *http.Request) *target {
+	available := make([]*target, 0, len(b.targets))
+	total := 0
+
+	for _, t := range b.targets {
+		if t.available() {
+			available = append(available, t)
+			total += t.weight
+		}
+	}
+
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+
+	pick := func() *target {
+		n := rand.Intn(total) //nolint:gosec
+		for _, t := range available {
+			if n < t.weight {
+				return t
+			}
+
+			n -= t.weight
+		}
+
+		return available[len(available)-1]
+	}
+
+	a, b2 := pick(), pick()
+	if b2.load() < a.load() {
+		return b2
+	}
+
+	return a
+}
+
+// consistentHash maps a request key to a target on a hash ring, so the same key keeps going
+// to the same target while it is available
+type consistentHash struct {
+	fallback roundRobin
+	key      func(*http.Request) string
+	ring     []uint64
+	owners   map[uint64]*target
+}
+
+func newConsistentHash(targets []*target, key func(*http.Request) string) *consistentHash {
+	b := &consistentHash{
+		fallback: roundRobin{targets: targets},
+		key:      key,
+		owners:   map[uint64]*target{},
+	}
+
+	for _, t := range targets {
+		for i := 0; i < hashReplicas*t.weight; i++ {
+			h := hashKey(t.url.String() + "#" + strconv.Itoa(i))
+			if _, ok := b.owners[h]; ok {
+				continue
+			}
+
+			b.owners[h] = t
+			b.ring = append(b.ring, h)
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+
+	return b
+}
+
+func (b *consistentHash) next(r *http.Request) *target {
+	key := b.key(r)
+	if key == "" || len(b.ring) == 0 {
+		return b.fallback.next(r)
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+
+	// walk the ring to the first available target
+	for n := 0; n < len(b.ring); n++ {
+		t := b.owners[b.ring[(i+n)%len(b.ring)]]
+		if t.available() {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	return h.Sum64()
+}
+
+// hashKeyFunc returns the function extracting the hash key from the request, hash_by is one
+// of client_ip, header:<name> or cookie:<name>
+func hashKeyFunc(hashBy string) (func(*http.Request) string, error) {
+	kind, name := hashBy, ""
+	if i := strings.Index(hashBy, ":"); i >= 0 {
+		kind, name = hashBy[:i], hashBy[i+1:]
+	}
+
+	switch strings.ToLower(kind) {
+	case "", "client_ip":
+		return func(r *http.Request) string { return clientIP(r.Context()) }, nil
+	case "header":
+		if name == "" {
+			break
+		}
+
+		return func(r *http.Request) string { return r.Header.Get(name) }, nil
+	case "cookie":
+		if name == "" {
+			break
+		}
+
+		return func(r *http.Request) string {
+			c, err := r.Cookie(name)
+			if err != nil {
+				return ""
+			}
+
+			return c.Value
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid hash_by %q", hashBy) //nolint:goerr113
+}
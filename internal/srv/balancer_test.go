@@ -0,0 +1,173 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTargets(t *testing.T, targets ...Target) []*target {
+	t.Helper()
+
+	parsed := []*target{}
+
+	for _, tt := range targets {
+		target, err := newTarget(tt)
+		require.NoError(t, err)
+
+		parsed = append(parsed, target)
+	}
+
+	return parsed
+}
+
+func TestNewBalancer(t *testing.T) {
+	targets := newTestTargets(t, Target{URL: "http://a"})
+
+	var testCases = []struct {
+		name    string
+		cfg     *LoadBalancerConfig
+		wantErr bool
+	}{
+		{name: "default", cfg: nil},
+		{name: "round robin", cfg: &LoadBalancerConfig{Policy: "round_robin"}},
+		{name: "least conn", cfg: &LoadBalancerConfig{Policy: "least_conn"}},
+		{name: "random two", cfg: &LoadBalancerConfig{Policy: "random_two"}},
+		{name: "hash by client ip", cfg: &LoadBalancerConfig{Policy: "consistent_hash"}},
+		{name: "hash by header", cfg: &LoadBalancerConfig{Policy: "consistent_hash", HashBy: "header:X-User"}},
+		{name: "hash by cookie", cfg: &LoadBalancerConfig{Policy: "consistent_hash", HashBy: "cookie:session"}},
+		{name: "hash by header without name", cfg: &LoadBalancerConfig{Policy: "consistent_hash", HashBy: "header"}, wantErr: true},
+		{name: "unknown hash", cfg: &LoadBalancerConfig{Policy: "consistent_hash", HashBy: "path"}, wantErr: true},
+		{name: "unknown policy", cfg: &LoadBalancerConfig{Policy: "fastest"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := newBalancer(tc.cfg, targets)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, targets[0], b.next(httptest.NewRequest(http.MethodGet, "/", nil)))
+		})
+	}
+}
+
+func TestRoundRobinWeights(t *testing.T) {
+	targets := newTestTargets(t, Target{URL: "http://a", Weight: 3}, Target{URL: "http://b"})
+	b := &roundRobin{targets: targets}
+
+	picks := []string{}
+	for i := 0; i < 8; i++ {
+		picks = append(picks, b.next(nil).name)
+	}
+
+	// smooth weighted round robin spreads the picks of the heavier target
+	assert.Equal(t, []string{"a", "a", "b", "a", "a", "a", "b", "a"}, picks)
+}
+
+func TestLeastConn(t *testing.T) {
+	targets := newTestTargets(t, Target{URL: "http://a"}, Target{URL: "http://b", Weight: 2}, Target{URL: "http://c"})
+	b := &leastConn{roundRobin: roundRobin{targets: targets}}
+
+	targets[0].active = 2
+	targets[1].active = 2
+	targets[2].active = 1
+
+	// b has twice the weight so 2 requests in flight count as 1, the tie is broken by weight
+	picks := map[string]int{}
+	for i := 0; i < 3; i++ {
+		picks[b.next(nil).name]++
+	}
+
+	assert.Equal(t, map[string]int{"b": 2, "c": 1}, picks)
+}
+
+func TestRandomTwoPrefersLessLoad(t *testing.T) {
+	targets := newTestTargets(t, Target{URL: "http://a"}, Target{URL: "http://b"})
+	b := &randomTwo{targets: targets}
+
+	targets[0].active = 10
+
+	picks := map[string]int{}
+	for i := 0; i < 100; i++ {
+		picks[b.next(nil).name]++
+	}
+
+	// a is only picked when both choices are a
+	assert.Greater(t, picks["b"], picks["a"])
+}
+
+func TestConsistentHash(t *testing.T) {
+	targets := newTestTargets(t, Target{URL: "http://a"}, Target{URL: "http://b"}, Target{URL: "http://c"})
+
+	key, err := hashKeyFunc("header:X-User")
+	require.NoError(t, err)
+
+	b := newConsistentHash(targets, key)
+
+	seen := map[string]string{}
+
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", user)
+
+		first := b.next(r)
+		require.NotNil(t, first)
+
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, first, b.next(r), user)
+		}
+
+		seen[user] = first.name
+	}
+
+	// rebuilding the ring maps keys to the same targets
+	b = newConsistentHash(targets, key)
+
+	for user, name := range seen {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", user)
+
+		assert.Equal(t, name, b.next(r).name, user)
+	}
+}
+
+func TestProxyLoadBalancing(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+
+		return backend
+	}
+
+	a, b := newBackend("a"), newBackend("b")
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {Targets: []Target{{URL: a.URL}, {URL: b.URL}, {URL: "not a url"}}},
+	}, nil)
+
+	got := map[string]int{}
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(ts.URL + "/")
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		got[string(body)]++
+	}
+
+	// the invalid target is skipped
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, got)
+}
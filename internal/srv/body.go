@@ -0,0 +1,183 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+const (
+	defaultSpoolMaxMemory = 1 << 20
+	// defaultSpoolMaxRequestBody limits the bodies spooled for origins without a max_request_body
+	defaultSpoolMaxRequestBody = 100 << 20
+
+	spoolMemory = "memory"
+	spoolDisk   = "disk"
+)
+
+var (
+	errRequestBodyTooLarge = errors.New("request body too large")
+	errRequestBodyRead     = errors.New("failed to read request body")
+	errSpoolFailed         = errors.New("failed to spool request body")
+)
+
+// SpoolConfig enables reading request bodies before they are sent to the origin, bodies
+// larger than max_memory are written to a temporary file
+type SpoolConfig struct {
+	MaxMemory int64  `mapstructure:"max_memory"`
+	Dir       string `mapstructure:"dir"`
+}
+
+// maxRequestBody returns the request body limit of the origin, overridden by the matcher (if
+// any), 0 if there is no limit.  Spooling origins get a default limit so bodies can't fill the
+// disk unless the limit is removed explicitly.
+func maxRequestBody(o *Origin, m *Matcher) int64 {
+	limit := o.MaxRequestBody
+	if m != nil && m.MaxRequestBody != 0 {
+		limit = m.MaxRequestBody
+	}
+
+	if limit == 0 && o.Spool != nil {
+		limit = defaultSpoolMaxRequestBody
+	}
+
+	if limit < 0 {
+		return 0
+	}
+
+	return limit
+}
+
+// limitedBody fails reads once more than the limit has been read from the body
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	// one more byte than allowed is read to tell a body of exactly the limit from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		b.err = errRequestBodyTooLarge
+
+		return n, b.err
+	}
+
+	b.remaining -= int64(n)
+
+	return n, err
+}
+
+// limitBody limits the request body, it returns errRequestBodyTooLarge right away if the
+// length of the body is known and larger than the limit
+func limitBody(r *http.Request, limit int64) error {
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	if r.ContentLength > limit {
+		return errRequestBodyTooLarge
+	}
+
+	r.Body = &limitedBody{ReadCloser: r.Body, remaining: limit}
+
+	return nil
+}
+
+// spool reads the whole request body so slow clients don't hold on to origin connections
+// and the request can be retried, it returns where the body was stored and a function
+// removing it once the request is done
+func (s *Server) spool(r *http.Request, cfg *SpoolConfig) (string, func(), error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", func() {}, nil
+	}
+
+	maxMemory := cfg.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = defaultSpoolMaxMemory
+	}
+
+	body := r.Body
+	defer body.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(body, maxMemory+1))
+	if err != nil {
+		return "", func() {}, err
+	}
+
+	if int64(len(buf)) <= maxMemory {
+		setSpooledBody(r, int64(len(buf)), func() io.ReadCloser {
+			return io.NopCloser(bytes.NewReader(buf))
+		})
+
+		return spoolMemory, func() {}, nil
+	}
+
+	f, err := os.CreateTemp(cfg.Dir, "tucson-body-")
+	if err != nil {
+		return "", func() {}, fmt.Errorf("%w: %v", errSpoolFailed, err)
+	}
+
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(buf), body))
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+
+	setSpooledBody(r, n, func() io.ReadCloser {
+		return io.NopCloser(io.NewSectionReader(f, 0, n))
+	})
+
+	return spoolDisk, cleanup, nil
+}
+
+// setSpooledBody replaces the body of the request with the spooled body, which is sent with
+// its length and can be read again for retries
+func setSpooledBody(r *http.Request, n int64, open func() io.ReadCloser) {
+	r.ContentLength = n
+	r.TransferEncoding = nil
+	r.GetBody = func() (io.ReadCloser, error) {
+		return open(), nil
+	}
+
+	r.Body = http.NoBody
+	if n > 0 {
+		r.Body = open()
+	}
+}
+
+// rejectSpoolError answers a request whose body couldn't be spooled, failing to write the
+// spool file is our fault while failing to read the body is the client's
+func (p *proxy) rejectSpoolError(w http.ResponseWriter, r *http.Request, err error) {
+	var pathErr *fs.PathError
+
+	switch {
+	case errors.Is(err, errRequestBodyTooLarge), errors.Is(err, errRequestBodyTimeout), errors.Is(err, errSpoolFailed):
+	case errors.As(err, &pathErr):
+		err = fmt.Errorf("%w: %v", errSpoolFailed, err)
+	default:
+		err = fmt.Errorf("%w: %v", errRequestBodyRead, err)
+	}
+
+	p.errorHandler(w, r, err)
+}
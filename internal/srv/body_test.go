@@ -0,0 +1,307 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestEchoBackend returns a backend answering with the request body and its length
+func newTestEchoBackend(t *testing.T, hits *int32) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+// postBody posts the body, with an unknown length if chunked is set
+func postBody(t *testing.T, url, body string, chunked bool) (*http.Response, string) {
+	t.Helper()
+
+	var r io.Reader = strings.NewReader(body)
+	if chunked {
+		r = io.MultiReader(r)
+	}
+
+	resp, err := http.Post(url, "text/plain", r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(b)
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		origin     int64
+		matcher    int64
+		body       string
+		chunked    bool
+		wantStatus int
+		wantHits   int32
+	}{
+		{
+			name:       "no limit",
+			body:       "hello world",
+			wantStatus: http.StatusOK,
+			wantHits:   1,
+		},
+		{
+			name:       "within limit",
+			origin:     11,
+			body:       "hello world",
+			chunked:    true,
+			wantStatus: http.StatusOK,
+			wantHits:   1,
+		},
+		{
+			name:       "too large",
+			origin:     5,
+			body:       "hello world",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "too large chunked",
+			origin:     5,
+			body:       strings.Repeat("hello world", 100),
+			chunked:    true,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "matcher limit",
+			origin:     100,
+			matcher:    5,
+			body:       "hello world",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "matcher without limit",
+			origin:     5,
+			matcher:    -1,
+			body:       "hello world",
+			wantStatus: http.StatusOK,
+			wantHits:   1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits int32
+
+			backend := newTestEchoBackend(t, &hits)
+
+			s, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Auth: authOptional, MaxRequestBody: tc.origin},
+			}, []*Matcher{
+				{Path: "/upload/*", Origin: "default", MaxRequestBody: tc.matcher},
+			})
+
+			resp, body := postBody(t, ts.URL+"/upload/", tc.body, tc.chunked)
+
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+
+			// a chunked body is only found to be too large while it is sent to the backend
+			if !tc.chunked || tc.wantStatus == http.StatusOK {
+				assert.Equal(t, tc.wantHits, atomic.LoadInt32(&hits))
+			}
+
+			if tc.wantStatus == http.StatusOK {
+				assert.Equal(t, tc.body, body)
+			} else {
+				assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.proxyErrors.WithLabelValues("default", errorClassBodyTooLarge, "413")))
+			}
+		})
+	}
+}
+
+func TestSpool(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		limit      int64
+		body       string
+		wantStatus int
+		wantStore  string
+	}{
+		{
+			name:       "memory",
+			body:       "hello world",
+			wantStatus: http.StatusOK,
+			wantStore:  spoolMemory,
+		},
+		{
+			name:       "disk",
+			body:       strings.Repeat("hello world", 100),
+			wantStatus: http.StatusOK,
+			wantStore:  spoolDisk,
+		},
+		{
+			name:       "too large",
+			limit:      500,
+			body:       strings.Repeat("hello world", 100),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits int32
+
+			backend := newTestEchoBackend(t, &hits)
+			dir := t.TempDir()
+
+			s, ts := newTestTucson(t, map[string]*Origin{
+				"default": {
+					BaseUrl:        backend.URL,
+					Auth:           authOptional,
+					MaxRequestBody: tc.limit,
+					Spool:          &SpoolConfig{MaxMemory: 100, Dir: dir},
+				},
+			}, []*Matcher{})
+
+			resp, body := postBody(t, ts.URL, tc.body, true)
+
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+
+			if tc.wantStatus == http.StatusOK {
+				assert.Equal(t, tc.body, body)
+				// the spooled body is sent with its length
+				assert.Equal(t, strconv.Itoa(len(tc.body)), resp.Header.Get("X-Content-Length"))
+				assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.requestsSpooled.WithLabelValues("default", tc.wantStore)))
+			} else {
+				assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+			}
+
+			files, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, files)
+		})
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+	var hits int32
+
+	body := strings.Repeat("hello world", 100)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if string(b) != body {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {
+			BaseUrl: backend.URL,
+			Auth:    authOptional,
+			// the body is larger than the retry buffer, only the spooled body can be sent again
+			Retry: &RetryConfig{Backoff: 1, MaxBody: 10, NonIdempotent: true},
+			Spool: &SpoolConfig{MaxMemory: 100, Dir: t.TempDir()},
+		},
+	}, []*Matcher{})
+
+	resp, got := postBody(t, ts.URL, body, true)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", got)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		origin  *Origin
+		matcher *Matcher
+		want    int64
+	}{
+		{
+			name:   "no limit",
+			origin: &Origin{},
+			want:   0,
+		},
+		{
+			name:    "matcher overrides origin",
+			origin:  &Origin{MaxRequestBody: 100},
+			matcher: &Matcher{MaxRequestBody: 10},
+			want:    10,
+		},
+		{
+			name:   "spooling origin without a limit",
+			origin: &Origin{Spool: &SpoolConfig{}},
+			want:   defaultSpoolMaxRequestBody,
+		},
+		{
+			name:   "spooling origin with a limit",
+			origin: &Origin{MaxRequestBody: 10, Spool: &SpoolConfig{}},
+			want:   10,
+		},
+		{
+			name:    "spooling without a limit",
+			origin:  &Origin{Spool: &SpoolConfig{}},
+			matcher: &Matcher{MaxRequestBody: -1},
+			want:    0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, maxRequestBody(tc.origin, tc.matcher))
+		})
+	}
+}
+
+func TestSpoolError(t *testing.T) {
+	var hits int32
+
+	backend := newTestEchoBackend(t, &hits)
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {
+			BaseUrl: backend.URL,
+			Auth:    authOptional,
+			Spool:   &SpoolConfig{MaxMemory: 10, Dir: filepath.Join(t.TempDir(), "missing")},
+		},
+	}, []*Matcher{})
+
+	resp, body := postBody(t, ts.URL, strings.Repeat("hello world", 10), true)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Contains(t, body, errorMessages[errorClassSpool])
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.proxyErrors.WithLabelValues("default", errorClassSpool, "500")))
+}
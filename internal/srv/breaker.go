@@ -0,0 +1,263 @@
+package srv
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerConsecutiveFailures = 5
+	defaultBreakerMinRequests         = 20
+	defaultBreakerWindow              = 10 * time.Second
+	defaultBreakerOpenDuration        = 30 * time.Second
+	defaultBreakerHalfOpenRequests    = 1
+)
+
+// breakerState is the state of a circuit breaker, the values are exported as metrics
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+
+	return "closed"
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerConfig configures the circuit breakers of an origin and its targets
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int           `mapstructure:"consecutive_failures"`
+	FailureRate         float64       `mapstructure:"failure_rate"`
+	MinRequests         int           `mapstructure:"min_requests"`
+	Window              time.Duration `mapstructure:"window"`
+	OpenDuration        time.Duration `mapstructure:"open_duration"`
+	HalfOpenRequests    int           `mapstructure:"half_open_requests"`
+}
+
+// withDefaults returns a copy of the config with unset values replaced by the defaults
+func (c *CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	cfg := *c
+
+	if cfg.ConsecutiveFailures == 0 {
+		cfg.ConsecutiveFailures = defaultBreakerConsecutiveFailures
+	}
+
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = defaultBreakerMinRequests
+	}
+
+	if cfg.Window <= 0 {
+		cfg.Window = defaultBreakerWindow
+	}
+
+	if cfg.OpenDuration <= 0 {
+		cfg.OpenDuration = defaultBreakerOpenDuration
+	}
+
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+
+	return cfg
+}
+
+// breaker is a circuit breaker.  It opens after too many consecutive failures or too high a
+// failure rate within the window, rejects requests while open, and then lets a limited number
+// of probe requests through (half-open) to decide whether to close again.
+type breaker struct {
+	cfg      CircuitBreakerConfig
+	onChange func(from, to breakerState)
+	now      func() time.Time
+
+	mu          sync.Mutex
+	state       breakerState
+	changed     time.Time
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	probes      int
+}
+
+func newBreaker(cfg CircuitBreakerConfig, onChange func(from, to breakerState)) *breaker {
+	return &breaker{
+		cfg:      cfg,
+		onChange: onChange,
+		now:      time.Now,
+	}
+}
+
+// allow reserves a request, if the circuit is open it returns false and how long until
+// requests are tried again
+func (b *breaker) allow() (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.advance(now)
+
+	switch b.state {
+	case breakerOpen:
+		return false, b.changed.Add(b.cfg.OpenDuration).Sub(now)
+	case breakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return false, b.cfg.OpenDuration
+		}
+
+		b.probes++
+	}
+
+	return true, 0
+}
+
+// release gives back a request reserved by allow that was never sent, so a half-open circuit
+// doesn't wait for the outcome of a probe that won't come
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// ready returns true if allow would let a request through, without reserving it
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(b.now())
+
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return b.probes < b.cfg.HalfOpenRequests
+	}
+
+	return true
+}
+
+// record records the outcome of an allowed request
+func (b *breaker) record(success bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.advance(now)
+
+	switch b.state {
+	case breakerHalfOpen:
+		if success {
+			b.transition(breakerClosed, now)
+		} else {
+			b.transition(breakerOpen, now)
+		}
+
+		return
+	case breakerOpen:
+		// a request that started before the circuit opened
+		return
+	}
+
+	if now.Sub(b.windowStart) > b.cfg.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+
+	b.requests++
+
+	if success {
+		b.consecutive = 0
+		return
+	}
+
+	b.failures++
+	b.consecutive++
+
+	switch {
+	case b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures:
+		b.transition(breakerOpen, now)
+	case b.cfg.FailureRate > 0 && b.requests >= b.cfg.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= b.cfg.FailureRate:
+		b.transition(breakerOpen, now)
+	}
+}
+
+// advance moves an open circuit to half-open once the open duration has passed, probes that
+// never report back are given up on after another open duration
+func (b *breaker) advance(now time.Time) {
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.changed) >= b.cfg.OpenDuration {
+			b.transition(breakerHalfOpen, now)
+		}
+	case breakerHalfOpen:
+		if now.Sub(b.changed) >= b.cfg.OpenDuration {
+			b.changed, b.probes = now, 0
+		}
+	}
+}
+
+func (b *breaker) transition(to breakerState, now time.Time) {
+	from := b.state
+
+	b.state = to
+	b.changed = now
+	b.probes = 0
+	b.consecutive = 0
+	b.windowStart, b.requests, b.failures = now, 0, 0
+
+	if b.onChange != nil && from != to {
+		b.onChange(from, to)
+	}
+}
+
+// isBreakerFailure returns true if the response (or error) counts against the circuit
+func isBreakerFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// retryAfter formats the wait as a Retry-After value in whole seconds
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,271 @@
+package srv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBreaker(cfg CircuitBreakerConfig) (*breaker, *time.Time, *[]breakerState) {
+	now := time.Unix(0, 0)
+	changes := []breakerState{}
+
+	b := newBreaker(cfg.withDefaults(), func(from, to breakerState) {
+		changes = append(changes, to)
+	})
+	b.now = func() time.Time { return now }
+
+	return b, &now, &changes
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	b, now, changes := newTestBreaker(CircuitBreakerConfig{ConsecutiveFailures: 3, OpenDuration: 10 * time.Second})
+
+	for i := 0; i < 2; i++ {
+		ok, _ := b.allow()
+		require.True(t, ok)
+		b.record(false)
+	}
+
+	// a success resets the count
+	b.record(true)
+	b.record(false)
+	b.record(false)
+
+	ok, _ := b.allow()
+	assert.True(t, ok)
+
+	b.record(false)
+
+	ok, wait := b.allow()
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, wait)
+	assert.False(t, b.ready())
+
+	*now = now.Add(4 * time.Second)
+
+	_, wait = b.allow()
+	assert.Equal(t, 6*time.Second, wait)
+
+	// half-open lets a single probe through
+	*now = now.Add(6 * time.Second)
+
+	assert.True(t, b.ready())
+
+	ok, _ = b.allow()
+	assert.True(t, ok)
+
+	ok, _ = b.allow()
+	assert.False(t, ok)
+
+	// a failed probe opens the circuit again
+	b.record(false)
+
+	ok, _ = b.allow()
+	assert.False(t, ok)
+
+	// a successful probe closes it
+	*now = now.Add(10 * time.Second)
+
+	ok, _ = b.allow()
+	require.True(t, ok)
+	b.record(true)
+
+	ok, _ = b.allow()
+	assert.True(t, ok)
+
+	assert.Equal(t, []breakerState{breakerOpen, breakerHalfOpen, breakerOpen, breakerHalfOpen, breakerClosed}, *changes)
+}
+
+func TestBreakerFailureRate(t *testing.T) {
+	b, now, _ := newTestBreaker(CircuitBreakerConfig{
+		ConsecutiveFailures: -1,
+		FailureRate:         0.5,
+		MinRequests:         4,
+		Window:              time.Minute,
+	})
+
+	b.record(true)
+	b.record(false)
+	b.record(true)
+
+	// not enough requests yet
+	ok, _ := b.allow()
+	assert.True(t, ok)
+
+	// the window expired, start over
+	*now = now.Add(2 * time.Minute)
+
+	b.record(false)
+	b.record(true)
+	b.record(false)
+
+	ok, _ = b.allow()
+	assert.True(t, ok)
+
+	b.record(false)
+
+	ok, _ = b.allow()
+	assert.False(t, ok)
+}
+
+func TestBreakerStaleProbe(t *testing.T) {
+	b, now, _ := newTestBreaker(CircuitBreakerConfig{ConsecutiveFailures: 1, OpenDuration: time.Second})
+
+	b.record(false)
+
+	*now = now.Add(time.Second)
+
+	ok, _ := b.allow()
+	require.True(t, ok)
+
+	// the probe never reports back, another one is allowed after the open duration
+	ok, _ = b.allow()
+	assert.False(t, ok)
+
+	*now = now.Add(time.Second)
+
+	ok, _ = b.allow()
+	assert.True(t, ok)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, "1", retryAfter(0))
+	assert.Equal(t, "1", retryAfter(300*time.Millisecond))
+	assert.Equal(t, "3", retryAfter(2100*time.Millisecond))
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	var hits int32
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {
+			BaseUrl: backend.URL,
+			CircuitBreaker: &CircuitBreakerConfig{
+				ConsecutiveFailures: 2,
+				OpenDuration:        time.Minute,
+			},
+		},
+	}, nil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(ts.URL + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	}
+
+	resp, err := http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+// balancerFunc is a balancer that ignores the availability of the targets
+type balancerFunc func(r *http.Request) *target
+
+func (f balancerFunc) next(r *http.Request) *target {
+	return f(r)
+}
+
+func setBreakerState(b *breaker, state breakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state, b.changed, b.probes = state, b.now(), 0
+}
+
+func TestProxyCircuitBreakerRelease(t *testing.T) {
+	cfg := &CircuitBreakerConfig{ConsecutiveFailures: 1, OpenDuration: time.Minute}
+
+	t.Run("target rejects", func(t *testing.T) {
+		var hits int32
+
+		s, ts := newTestTucson(t, map[string]*Origin{
+			"default": {BaseUrl: newTestEchoBackend(t, &hits).URL, CircuitBreaker: cfg},
+		}, nil)
+
+		p := s.defaultOrigin.proxy
+		p.balancer = balancerFunc(func(*http.Request) *target { return p.targets[0] })
+		setBreakerState(p.breaker, breakerHalfOpen)
+		setBreakerState(p.targets[0].breaker, breakerOpen)
+
+		resp, err := http.Get(ts.URL + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.True(t, p.breaker.ready())
+		assert.Zero(t, atomic.LoadInt32(&hits))
+	})
+
+	t.Run("no target", func(t *testing.T) {
+		var hits int32
+
+		s, ts := newTestTucson(t, map[string]*Origin{
+			"default": {BaseUrl: newTestEchoBackend(t, &hits).URL, CircuitBreaker: cfg},
+		}, nil)
+
+		p := s.defaultOrigin.proxy
+		p.balancer = balancerFunc(func(*http.Request) *target { return nil })
+		setBreakerState(p.breaker, breakerHalfOpen)
+
+		resp, err := http.Get(ts.URL + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.True(t, p.breaker.ready())
+		assert.Zero(t, atomic.LoadInt32(&hits))
+	})
+
+	t.Run("client cancels", func(t *testing.T) {
+		received := make(chan struct{})
+
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(received)
+			<-r.Context().Done()
+		}))
+		defer backend.Close()
+
+		s, ts := newTestTucson(t, map[string]*Origin{
+			"default": {BaseUrl: backend.URL, CircuitBreaker: cfg},
+		}, nil)
+
+		p := s.defaultOrigin.proxy
+		setBreakerState(p.breaker, breakerHalfOpen)
+		setBreakerState(p.targets[0].breaker, breakerHalfOpen)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/", nil)
+		require.NoError(t, err)
+
+		go func() {
+			<-received
+			cancel()
+		}()
+
+		_, err = http.DefaultClient.Do(req)
+		require.Error(t, err)
+
+		assert.Eventually(t, func() bool {
+			return p.breaker.ready() && p.targets[0].breaker.ready()
+		}, time.Second, 10*time.Millisecond)
+	})
+}
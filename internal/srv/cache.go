@@ -0,0 +1,841 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCacheMaxSize      = 64 << 20
+	defaultCacheDiskMaxSize  = 1 << 30
+	defaultCacheMaxEntrySize = 1 << 20
+
+	// cacheRevalidateTimeout limits background revalidations of origins without a total timeout
+	cacheRevalidateTimeout = 30 * time.Second
+
+	cacheStatusHeader = "X-Cache"
+
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheStale       = "stale"
+	cacheRevalidated = "revalidated"
+	cacheBypass      = "bypass"
+)
+
+// cacheableStatus are the response codes that are stored
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// CacheConfig enables caching of the responses of an origin
+type CacheConfig struct {
+	MaxSize              int64         `mapstructure:"max_size"`
+	MaxEntrySize         int64         `mapstructure:"max_entry_size"`
+	Dir                  string        `mapstructure:"dir"`
+	DefaultTTL           time.Duration `mapstructure:"default_ttl"`
+	StaleWhileRevalidate time.Duration `mapstructure:"stale_while_revalidate"`
+	StaleIfError         time.Duration `mapstructure:"stale_if_error"`
+	ShareAuthenticated   bool          `mapstructure:"share_authenticated"`
+}
+
+// withDefaults returns a copy of the config with unset values replaced by the defaults
+func (c *CacheConfig) withDefaults() CacheConfig {
+	cfg := *c
+
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultCacheMaxSize
+		if cfg.Dir != "" {
+			cfg.MaxSize = defaultCacheDiskMaxSize
+		}
+	}
+
+	if cfg.MaxEntrySize <= 0 {
+		cfg.MaxEntrySize = defaultCacheMaxEntrySize
+	}
+
+	if cfg.MaxEntrySize > cfg.MaxSize {
+		cfg.MaxEntrySize = cfg.MaxSize
+	}
+
+	return cfg
+}
+
+// checkCache returns an error if the cache of the origin is invalid or its directory can't be
+// created
+func (o *Origin) checkCache() error {
+	if o.Cache == nil {
+		return nil
+	}
+
+	cfg := o.Cache
+
+	if cfg.MaxSize < 0 || cfg.MaxEntrySize < 0 {
+		return errors.New("cache sizes must not be negative") //nolint:goerr113
+	}
+
+	if cfg.DefaultTTL < 0 || cfg.StaleWhileRevalidate < 0 || cfg.StaleIfError < 0 {
+		return errors.New("cache durations must not be negative") //nolint:goerr113
+	}
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return fmt.Errorf("failed to create cache directory: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// cacheEntry is a stored response.  An entry without a status marks a response that varies,
+// it lists the request headers that select the entry of the response.
+type cacheEntry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte
+	Vary   []string
+
+	// Stored is when the response was received, it was InitialAge old at that point and is
+	// fresh until Expires
+	Stored               time.Time
+	InitialAge           time.Duration
+	Expires              time.Time
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// size returns the approximate memory used by the entry
+func (e *cacheEntry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+
+	for k, vv := range e.Header {
+		n += len(k)
+		for _, v := range vv {
+			n += len(v)
+		}
+	}
+
+	return int64(n)
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.Stored)
+}
+
+func (e *cacheEntry) validators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// usable returns true if the entry can still be served in some way, directly, while it is
+// revalidated or if the origin fails, or after a revalidation
+func (e *cacheEntry) usable(now time.Time) bool {
+	stale := e.StaleWhileRevalidate
+	if e.StaleIfError > stale {
+		stale = e.StaleIfError
+	}
+
+	return e.validators() || now.Before(e.Expires.Add(stale))
+}
+
+// cacheControl holds the directives of a Cache-Control header
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+
+			name, value := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+
+			cc[strings.ToLower(name)] = value
+		}
+	}
+
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// duration returns the value of a directive in seconds
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// cache stores the responses of an origin
+type cache struct {
+	cfg     CacheConfig
+	origin  string
+	store   cacheStore
+	logger  *zap.Logger
+	metrics *metrics
+
+	mu    sync.Mutex
+	calls map[string]*cacheCall
+}
+
+// cacheCall is a request to the origin that other requests for the same key wait for
+type cacheCall struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *cacheCall) release() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// newCache returns the cache of the origin, nil if it has none
+func (s *Server) newCache(o *Origin) (*cache, error) {
+	if o.Cache == nil {
+		return nil, nil
+	}
+
+	cfg := o.Cache.withDefaults()
+	logger := s.logger.With(zap.String("origin", o.name))
+
+	var store cacheStore = newMemoryStore(cfg.MaxSize)
+
+	if cfg.Dir != "" {
+		// each origin gets a directory of its own so origins sharing a directory don't evict
+		// each other's entries or anything else stored there
+		disk, err := newDiskStore(filepath.Join(cfg.Dir, "tucson-"+url.PathEscape(o.name)), cfg.MaxSize, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		store = disk
+	}
+
+	s.metrics.cacheSize.WithLabelValues(o.name).Set(float64(store.size()))
+
+	return &cache{
+		cfg:     cfg,
+		origin:  o.name,
+		store:   store,
+		logger:  logger,
+		metrics: s.metrics,
+		calls:   map[string]*cacheCall{},
+	}, nil
+}
+
+// identity returns who the request is made for, empty for anonymous requests.  Requests
+// without a session are told apart by their Authorization header or cookies, which the origin
+// may use for sessions of its own.  Responses to requests with an identity are only shared
+// with requests of the same identity unless share_authenticated is set.
+func (c *cache) identity(r *http.Request) string {
+	if c.cfg.ShareAuthenticated {
+		return ""
+	}
+
+	if token, _, err := jwtauth.FromContext(r.Context()); err == nil && token != nil {
+		return "user:" + token.Subject()
+	}
+
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		sum := sha256.Sum256([]byte(authz))
+		return "authorization:" + hex.EncodeToString(sum[:])
+	}
+
+	if cookies := r.Header.Values("Cookie"); len(cookies) > 0 {
+		sum := sha256.Sum256([]byte(strings.Join(cookies, "; ")))
+		return "cookie:" + hex.EncodeToString(sum[:])
+	}
+
+	return ""
+}
+
+// key returns the key of the request, ignoring the headers the response varies by
+func (c *cache) key(r *http.Request) string {
+	return c.origin + " " + r.URL.RequestURI() + " " + c.identity(r)
+}
+
+// varyKey returns the key of a response that varies by the given request headers
+func varyKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+
+	b.WriteString(key)
+
+	for _, h := range vary {
+		b.WriteString("\n" + h + ": " + strings.Join(r.Header.Values(h), ", "))
+	}
+
+	return b.String()
+}
+
+// lookup returns the stored response for the request
+func (c *cache) lookup(key string, r *http.Request) (*cacheEntry, bool) {
+	e, ok := c.store.get(key)
+	if ok && e.Status == 0 {
+		e, ok = c.store.get(varyKey(key, e.Vary, r))
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	if !e.usable(time.Now()) {
+		c.store.delete(e.Key)
+		return nil, false
+	}
+
+	return e, true
+}
+
+// save stores the response, responses that vary are stored under the values of the request
+// headers they vary by
+func (c *cache) save(key string, r *http.Request, e *cacheEntry) {
+	e.Key = key
+
+	if len(e.Vary) > 0 {
+		c.store.set(key, &cacheEntry{Key: key, Vary: e.Vary})
+		e.Key = varyKey(key, e.Vary, r)
+	}
+
+	c.store.set(e.Key, e)
+
+	c.metrics.cacheSize.WithLabelValues(c.origin).Set(float64(c.store.size()))
+}
+
+// join returns the call in flight for the key, or starts one if there is none
+func (c *cache) join(key string) (*cacheCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+
+	return call, true
+}
+
+// leave ends the call of the key
+func (c *cache) leave(key string, call *cacheCall) {
+	c.mu.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+
+	call.release()
+}
+
+// bypassCache returns true if the request must not be answered from the cache
+func bypassCache(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+
+	if r.Header.Get("Range") != "" || upgradeType(r.Header) != "" {
+		return true
+	}
+
+	return parseCacheControl(r.Header).has("no-store")
+}
+
+// freshFor returns true if the entry can be served without revalidation, clients can ask for
+// fresher responses with max-age or no-cache
+func freshFor(r *http.Request, e *cacheEntry, now time.Time) bool {
+	cc := parseCacheControl(r.Header)
+	if cc.has("no-cache") || r.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+
+	if maxAge, ok := cc.duration("max-age"); ok && e.age(now) > maxAge {
+		return false
+	}
+
+	return now.Before(e.Expires)
+}
+
+// serve answers the request from the cache or with next, storing the response if it can be
+// cached.  Concurrent misses for the same response wait for the first one.
+func (c *cache) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if bypassCache(r) {
+		c.metrics.cacheRequests.WithLabelValues(c.origin, cacheBypass).Inc()
+		next(w, r)
+
+		return
+	}
+
+	key := c.key(r)
+	now := time.Now()
+
+	if e, ok := c.lookup(key, r); ok {
+		switch {
+		case freshFor(r, e, now):
+			c.write(w, r, e, cacheHit)
+			return
+		case !parseCacheControl(r.Header).has("no-cache") && now.Before(e.Expires.Add(e.StaleWhileRevalidate)):
+			c.write(w, r, e, cacheStale)
+			c.revalidateInBackground(r, key, e, next)
+
+			return
+		}
+
+		c.fetch(w, r, key, e, next, nil)
+
+		return
+	}
+
+	// only GET responses are stored, HEAD requests are answered from them
+	if r.Method == http.MethodHead {
+		c.metrics.cacheRequests.WithLabelValues(c.origin, cacheMiss).Inc()
+		next(w, r)
+
+		return
+	}
+
+	call, leader := c.join(key)
+	if leader {
+		defer c.leave(key, call)
+		c.fetch(w, r, key, nil, next, call.release)
+
+		return
+	}
+
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if e, ok := c.lookup(key, r); ok && freshFor(r, e, time.Now()) {
+		c.write(w, r, e, cacheHit)
+		return
+	}
+
+	c.fetch(w, r, key, nil, next, nil)
+}
+
+// fetch gets the response from the origin and stores it if it can be cached.  With a stale
+// entry the request is made conditional, a 304 refreshes the entry and it is served instead of
+// an error within stale-if-error.  uncacheable is called as soon as it is clear the response
+// won't be stored.  Without a response writer the response only updates the cache.
+func (c *cache) fetch(w http.ResponseWriter, r *http.Request, key string, stale *cacheEntry, next http.HandlerFunc, uncacheable func()) {
+	if uncacheable == nil {
+		uncacheable = func() {}
+	}
+
+	req := r
+	if stale != nil && stale.validators() {
+		req = conditionalRequest(r, stale)
+	}
+
+	rec := &cacheRecorder{w: w, header: http.Header{}, limit: c.cfg.MaxEntrySize, uncacheable: uncacheable}
+	rec.decide = func(code int, h http.Header) bool {
+		if stale != nil {
+			switch {
+			case code == http.StatusNotModified:
+				return true
+			case code >= http.StatusInternalServerError && time.Now().Before(stale.Expires.Add(stale.StaleIfError)):
+				return true
+			}
+		}
+
+		rec.store = c.storable(r, code, h)
+		h.Set(cacheStatusHeader, strings.ToUpper(cacheMiss))
+
+		return false
+	}
+
+	next(rec, req)
+
+	switch {
+	case stale != nil && rec.status == http.StatusNotModified:
+		e := c.refresh(r, stale, rec.header)
+		c.save(key, r, e)
+		c.write(w, r, e, cacheRevalidated)
+	case stale != nil && rec.held && rec.status >= http.StatusInternalServerError:
+		c.logger.Debug("serving stale response, the origin failed", zap.Int("status", rec.status), zap.String("req.url", r.URL.String()))
+		c.write(w, r, stale, cacheStale)
+	default:
+		if w != nil {
+			c.metrics.cacheRequests.WithLabelValues(c.origin, cacheMiss).Inc()
+		}
+
+		if rec.store {
+			c.save(key, r, c.newEntry(r, rec.status, rec.header.Clone(), rec.body.Bytes()))
+		}
+	}
+}
+
+// revalidateInBackground refreshes the stale entry without delaying the request, only one
+// revalidation per key runs at a time
+func (c *cache) revalidateInBackground(r *http.Request, key string, stale *cacheEntry, next http.HandlerFunc) {
+	call, leader := c.join(key)
+	if !leader {
+		return
+	}
+
+	// the copy is made before the request is served so they don't share any state
+	ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, cacheRevalidateTimeout)
+
+	req := r.Clone(ctx)
+	req.Method = http.MethodGet
+
+	go func() {
+		defer cancel()
+		defer c.leave(key, call)
+
+		defer func() {
+			if err := recover(); err != nil && err != http.ErrAbortHandler { //nolint:errorlint,goerr113
+				c.logger.Error("cache revalidation panicked", zap.Any("error", err))
+			}
+		}()
+
+		c.fetch(nil, req, key, stale, next, nil)
+	}()
+}
+
+// conditionalRequest returns a copy of the request that asks the origin whether the entry
+// has changed
+func conditionalRequest(r *http.Request, e *cacheEntry) *http.Request {
+	req := r.Clone(r.Context())
+
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		req.Header.Del(h)
+	}
+
+	if etag := e.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+
+	return req
+}
+
+// storable returns true if the response to the request can be stored
+func (c *cache) storable(r *http.Request, code int, h http.Header) bool {
+	if r.Method != http.MethodGet || !cacheableStatus[code] {
+		return false
+	}
+
+	if parseCacheControl(r.Header).has("no-store") {
+		return false
+	}
+
+	cc := parseCacheControl(h)
+
+	switch {
+	case cc.has("no-store"):
+		return false
+	case cc.has("private") && c.identity(r) == "":
+		// private responses are only stored for the user they were sent to
+		return false
+	case h.Get("Set-Cookie") != "":
+		return false
+	case headerHasToken(h, "Vary", "*"):
+		return false
+	}
+
+	if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && cl > c.cfg.MaxEntrySize {
+		return false
+	}
+
+	// responses that are never fresh are still useful to revalidate or to serve stale
+	lifetime, swr, sie := c.freshness(r, h)
+
+	return lifetime > 0 || swr > 0 || sie > 0 || h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// freshness returns how long a response is fresh and how long it may be served stale, the
+// origin's directives take precedence over the configured defaults
+func (c *cache) freshness(r *http.Request, h http.Header) (lifetime, swr, sie time.Duration) {
+	cc := parseCacheControl(h)
+
+	var ok bool
+
+	// s-maxage only applies to responses shared between users
+	if c.identity(r) == "" {
+		lifetime, ok = cc.duration("s-maxage")
+	}
+
+	if !ok {
+		lifetime, ok = cc.duration("max-age")
+	}
+
+	if !ok {
+		if expires := h.Get("Expires"); expires != "" {
+			ok = true
+
+			date, err := http.ParseTime(h.Get("Date"))
+			if err != nil {
+				date = time.Now()
+			}
+
+			if t, err := http.ParseTime(expires); err == nil {
+				lifetime = t.Sub(date)
+			}
+		}
+	}
+
+	if !ok {
+		lifetime = c.cfg.DefaultTTL
+	}
+
+	if cc.has("no-cache") || lifetime < 0 {
+		lifetime = 0
+	}
+
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		return lifetime, 0, 0
+	}
+
+	if swr, ok = cc.duration("stale-while-revalidate"); !ok {
+		swr = c.cfg.StaleWhileRevalidate
+	}
+
+	if sie, ok = cc.duration("stale-if-error"); !ok {
+		sie = c.cfg.StaleIfError
+	}
+
+	return lifetime, swr, sie
+}
+
+// newEntry creates the entry of a response received now
+func (c *cache) newEntry(r *http.Request, code int, h http.Header, body []byte) *cacheEntry {
+	now := time.Now()
+
+	h.Del(cacheStatusHeader)
+
+	var initialAge time.Duration
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		initialAge = time.Duration(age) * time.Second
+	}
+
+	h.Del("Age")
+
+	lifetime, swr, sie := c.freshness(r, h)
+
+	vary := []string{}
+
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	sort.Strings(vary)
+
+	return &cacheEntry{
+		Status:               code,
+		Header:               h,
+		Body:                 body,
+		Vary:                 vary,
+		Stored:               now,
+		InitialAge:           initialAge,
+		Expires:              now.Add(lifetime - initialAge),
+		StaleWhileRevalidate: swr,
+		StaleIfError:         sie,
+	}
+}
+
+// refresh returns a copy of the entry updated with the headers of a 304 response, its freshness
+// is computed like that of a new response
+func (c *cache) refresh(r *http.Request, e *cacheEntry, h http.Header) *cacheEntry {
+	header := e.Header.Clone()
+
+	for k, vv := range h {
+		switch k {
+		case "Content-Length", "Content-Type", "Content-Encoding", cacheStatusHeader:
+		default:
+			header[k] = vv
+		}
+	}
+
+	return c.newEntry(r, e.Status, header, e.Body)
+}
+
+// write serves the entry, answering conditional requests that match it with a 304
+func (c *cache) write(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string) {
+	// background revalidations have nobody to answer
+	if w == nil {
+		return
+	}
+
+	c.metrics.cacheRequests.WithLabelValues(c.origin, status).Inc()
+
+	h := w.Header()
+	for k, vv := range e.Header {
+		h[k] = append([]string(nil), vv...)
+	}
+
+	h.Set("Age", strconv.Itoa(int(e.age(time.Now()).Seconds())))
+	h.Set(cacheStatusHeader, strings.ToUpper(status))
+
+	if e.Status == http.StatusOK && notModified(r, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+
+		return
+	}
+
+	w.WriteHeader(e.Status)
+
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.Body)
+	}
+}
+
+// notModified returns true if the conditional request matches the entry
+func notModified(r *http.Request, e *cacheEntry) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+
+	return err == nil && !lm.After(ims)
+}
+
+// cacheRecorder passes the response of the origin on to the client and keeps a copy of it to
+// store.  The response can be held back from the client once its status is known, ie. a 304
+// to a revalidation.
+type cacheRecorder struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+	held   bool
+
+	// decide is called when the response headers are written, it returns true to hold the
+	// response back and sets store if it can be cached
+	decide      func(code int, h http.Header) bool
+	uncacheable func()
+	store       bool
+	limit       int64
+	body        bytes.Buffer
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	// trailers are set after the headers were written
+	if rec.status != 0 && !rec.held {
+		return rec.w.Header()
+	}
+
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	// informational responses aren't passed on
+	if rec.status != 0 || code < http.StatusOK {
+		return
+	}
+
+	rec.status = code
+	rec.held = rec.decide(code, rec.header) || rec.w == nil
+
+	if !rec.store {
+		rec.uncacheable()
+	}
+
+	if rec.held {
+		return
+	}
+
+	h := rec.w.Header()
+	for k, vv := range rec.header {
+		h[k] = vv
+	}
+
+	rec.w.WriteHeader(code)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	if rec.store {
+		if int64(rec.body.Len()+len(b)) > rec.limit {
+			rec.store = false
+			rec.body = bytes.Buffer{}
+			rec.uncacheable()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+
+	if rec.held {
+		return len(b), nil
+	}
+
+	return rec.w.Write(b)
+}
+
+func (rec *cacheRecorder) Flush() {
+	if rec.held {
+		return
+	}
+
+	if f, ok := rec.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,467 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type cacheTestResponse struct {
+	status int
+	body   string
+	header http.Header
+}
+
+func getCached(t *testing.T, url string, header http.Header) cacheTestResponse {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return cacheTestResponse{status: resp.StatusCode, body: string(body), header: resp.Header}
+}
+
+func TestCache(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		cfg       CacheConfig
+		header    http.Header
+		requests  []http.Header
+		wantCache []string
+		wantHits  int32
+	}{
+		{
+			name:      "max-age",
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}},
+			wantCache: []string{"MISS", "HIT", "HIT"},
+			wantHits:  1,
+		},
+		{
+			name:      "s-maxage",
+			header:    http.Header{"Cache-Control": []string{"max-age=0, s-maxage=60"}},
+			wantCache: []string{"MISS", "HIT"},
+			wantHits:  1,
+		},
+		{
+			name:      "expires",
+			header:    http.Header{"Expires": []string{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}},
+			wantCache: []string{"MISS", "HIT"},
+			wantHits:  1,
+		},
+		{
+			name:      "default ttl",
+			cfg:       CacheConfig{DefaultTTL: time.Minute},
+			wantCache: []string{"MISS", "HIT"},
+			wantHits:  1,
+		},
+		{
+			name:      "no freshness",
+			wantCache: []string{"MISS", "MISS"},
+			wantHits:  2,
+		},
+		{
+			name:      "no-store",
+			header:    http.Header{"Cache-Control": []string{"no-store, max-age=60"}},
+			wantCache: []string{"MISS", "MISS"},
+			wantHits:  2,
+		},
+		{
+			name:      "private",
+			header:    http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			wantCache: []string{"MISS", "MISS"},
+			wantHits:  2,
+		},
+		{
+			name:      "set-cookie",
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}, "Set-Cookie": []string{"a=b"}},
+			wantCache: []string{"MISS", "MISS"},
+			wantHits:  2,
+		},
+		{
+			name:      "client no-cache",
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}},
+			requests:  []http.Header{{}, {"Cache-Control": []string{"no-cache"}}},
+			wantCache: []string{"MISS", "MISS"},
+			wantHits:  2,
+		},
+		{
+			name:   "vary",
+			header: http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"Accept-Language"}},
+			requests: []http.Header{
+				{"Accept-Language": []string{"en"}},
+				{"Accept-Language": []string{"de"}},
+				{"Accept-Language": []string{"en"}},
+			},
+			wantCache: []string{"MISS", "MISS", "HIT"},
+			wantHits:  2,
+		},
+		{
+			name:   "authenticated users",
+			header: http.Header{"Cache-Control": []string{"max-age=60"}},
+			requests: []http.Header{
+				{"Authorization": []string{"Bearer a"}},
+				{"Authorization": []string{"Bearer b"}},
+				{"Authorization": []string{"Bearer a"}},
+				{},
+			},
+			wantCache: []string{"MISS", "MISS", "HIT", "MISS"},
+			wantHits:  3,
+		},
+		{
+			name:   "private for the authenticated user",
+			header: http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			requests: []http.Header{
+				{"Authorization": []string{"Bearer a"}},
+				{"Authorization": []string{"Bearer a"}},
+			},
+			wantCache: []string{"MISS", "HIT"},
+			wantHits:  1,
+		},
+		{
+			name:   "origin session cookies",
+			header: http.Header{"Cache-Control": []string{"max-age=60"}},
+			requests: []http.Header{
+				{"Cookie": []string{"session=a"}},
+				{"Cookie": []string{"session=b"}},
+				{"Cookie": []string{"session=a"}},
+				{},
+			},
+			wantCache: []string{"MISS", "MISS", "HIT", "MISS"},
+			wantHits:  3,
+		},
+		{
+			name:   "shared cookies",
+			cfg:    CacheConfig{ShareAuthenticated: true},
+			header: http.Header{"Cache-Control": []string{"max-age=60"}},
+			requests: []http.Header{
+				{"Cookie": []string{"session=a"}},
+				{"Cookie": []string{"session=b"}},
+			},
+			wantCache: []string{"MISS", "HIT"},
+			wantHits:  1,
+		},
+		{
+			name:   "shared authenticated users",
+			cfg:    CacheConfig{ShareAuthenticated: true},
+			header: http.Header{"Cache-Control": []string{"max-age=60"}},
+			requests: []http.Header{
+				{"Authorization": []string{"Bearer a"}},
+				{"Authorization": []string{"Bearer b"}},
+			},
+			wantCache: []string{"MISS", "HIT"},
+			wantHits:  1,
+		},
+		{
+			name:      "too large",
+			cfg:       CacheConfig{MaxEntrySize: 4},
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}},
+			wantCache: []string{"MISS", "MISS"},
+			wantHits:  2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits int32
+
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&hits, 1)
+
+				for k, v := range tc.header {
+					w.Header()[k] = v
+				}
+
+				_, _ = io.WriteString(w, "response "+strconv.Itoa(int(n)))
+			}))
+			defer backend.Close()
+
+			cfg := tc.cfg
+
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Cache: &cfg},
+			}, nil)
+
+			requests := tc.requests
+			if requests == nil {
+				requests = make([]http.Header, len(tc.wantCache))
+			}
+
+			for i, h := range requests {
+				resp := getCached(t, ts.URL+"/docs", h)
+
+				assert.Equal(t, http.StatusOK, resp.status)
+				assert.Equal(t, tc.wantCache[i], resp.header.Get(cacheStatusHeader), "request %d", i)
+			}
+
+			assert.Equal(t, tc.wantHits, atomic.LoadInt32(&hits))
+		})
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var (
+		hits        int32
+		conditional int32
+		status      int32 = http.StatusOK
+	)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		w.Header().Set("ETag", `"v1"`)
+
+		if code := int(atomic.LoadInt32(&status)); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		_, _ = io.WriteString(w, "docs")
+	}))
+	defer backend.Close()
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Cache: &CacheConfig{}},
+	}, nil)
+
+	resp := getCached(t, ts.URL+"/docs", nil)
+	assert.Equal(t, "MISS", resp.header.Get(cacheStatusHeader))
+
+	resp = getCached(t, ts.URL+"/docs", nil)
+	assert.Equal(t, "REVALIDATED", resp.header.Get(cacheStatusHeader))
+	assert.Equal(t, "docs", resp.body)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conditional))
+
+	// the client's own conditional request is answered from the cache
+	resp = getCached(t, ts.URL+"/docs", http.Header{"If-None-Match": []string{`"v1"`}})
+	assert.Equal(t, http.StatusNotModified, resp.status)
+
+	// the stale response is served while the origin fails
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+
+	resp = getCached(t, ts.URL+"/docs", nil)
+	assert.Equal(t, http.StatusOK, resp.status)
+	assert.Equal(t, "STALE", resp.header.Get(cacheStatusHeader))
+	assert.Equal(t, "docs", resp.body)
+
+	assert.Equal(t, int32(4), atomic.LoadInt32(&hits))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.cacheRequests.WithLabelValues("default", cacheStale)))
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var hits int32
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = io.WriteString(w, "response "+strconv.Itoa(int(n)))
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Cache: &CacheConfig{}},
+	}, nil)
+
+	resp := getCached(t, ts.URL+"/docs", nil)
+	assert.Equal(t, "response 1", resp.body)
+
+	resp = getCached(t, ts.URL+"/docs", nil)
+	assert.Equal(t, "STALE", resp.header.Get(cacheStatusHeader))
+	assert.Equal(t, "response 1", resp.body)
+
+	// the entry is refreshed in the background
+	require.Eventually(t, func() bool {
+		return getCached(t, ts.URL+"/docs", nil).body == "response 2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var hits int32
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			close(started)
+		}
+
+		<-release
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "docs")
+	}))
+	defer backend.Close()
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Cache: &CacheConfig{}},
+	}, nil)
+
+	var wg sync.WaitGroup
+
+	bodies := make(chan string, 5)
+
+	get := func() {
+		defer wg.Done()
+		bodies <- getCached(t, ts.URL+"/docs", nil).body
+	}
+
+	wg.Add(1)
+	go get()
+
+	<-started
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go get()
+	}
+
+	// give the other requests time to join the first one
+	time.Sleep(100 * time.Millisecond)
+
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		assert.Equal(t, "docs", body)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	assert.Equal(t, 4.0, testutil.ToFloat64(s.metrics.cacheRequests.WithLabelValues("default", cacheHit)))
+}
+
+func TestCacheStores(t *testing.T) {
+	entry := func(key, body string) *cacheEntry {
+		return &cacheEntry{Key: key, Status: http.StatusOK, Header: http.Header{}, Body: []byte(body)}
+	}
+
+	// the limit is just too small for all three entries
+	limit := func(store cacheStore) int64 {
+		store.set("a", entry("a", "aaaa"))
+		store.set("b", entry("b", "bbbb"))
+		store.set("c", entry("c", "cccccccc"))
+
+		return store.size() - 1
+	}
+
+	probe, err := newDiskStore(t.TempDir(), 1<<20, zap.NewNop())
+	require.NoError(t, err)
+
+	diskLimit := limit(probe)
+	dir := t.TempDir()
+
+	disk, err := newDiskStore(dir, diskLimit, zap.NewNop())
+	require.NoError(t, err)
+
+	for name, store := range map[string]cacheStore{"memory": newMemoryStore(limit(newMemoryStore(1 << 20))), "disk": disk} {
+		store := store
+
+		t.Run(name, func(t *testing.T) {
+			store.set("a", entry("a", "aaaa"))
+			store.set("b", entry("b", "bbbb"))
+
+			e, ok := store.get("a")
+			require.True(t, ok)
+			assert.Equal(t, "aaaa", string(e.Body))
+
+			// b is the least recently used entry
+			store.set("c", entry("c", "cccccccc"))
+
+			_, ok = store.get("b")
+			assert.False(t, ok)
+
+			_, ok = store.get("a")
+			assert.True(t, ok)
+
+			store.delete("a")
+
+			_, ok = store.get("a")
+			assert.False(t, ok)
+		})
+	}
+
+	// the disk store finds its entries again
+	reopened, err := newDiskStore(dir, diskLimit, zap.NewNop())
+	require.NoError(t, err)
+
+	e, ok := reopened.get("c")
+	require.True(t, ok)
+	assert.Equal(t, "cccccccc", string(e.Body))
+}
+
+func TestDiskStoreForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	foreign := []string{"notes.txt", ".keep", strings.Repeat("A", 64)}
+	for _, name := range foreign {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("not a cache entry"), 0o600))
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, diskTempPrefix+"1"), []byte("partial"), 0o600))
+
+	store, err := newDiskStore(dir, 1, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), store.size())
+
+	// evictions only remove entries
+	store.set("a", &cacheEntry{Key: "a", Status: http.StatusOK, Body: []byte("aaaa")})
+	store.set("b", &cacheEntry{Key: "b", Status: http.StatusOK, Body: []byte("bbbb")})
+
+	for _, name := range foreign {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+
+	assert.NoFileExists(t, filepath.Join(dir, diskTempPrefix+"1"))
+}
+
+func TestCacheDirPerOrigin(t *testing.T) {
+	dir := t.TempDir()
+
+	s := New(WithOrigins(map[string]*Origin{}))
+
+	for _, name := range []string{"docs", "api"} {
+		c, err := s.newCache(&Origin{name: name, Cache: &CacheConfig{Dir: dir}})
+		require.NoError(t, err)
+
+		c.store.set("a", &cacheEntry{Key: "a", Status: http.StatusOK, Body: []byte(name)})
+	}
+
+	for _, name := range []string{"docs", "api"} {
+		files, err := os.ReadDir(filepath.Join(dir, "tucson-"+name))
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	}
+}
@@ -0,0 +1,291 @@
+package srv
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// cacheStore stores cache entries by key, evicting the least recently used entries when it
+// grows larger than its limit
+type cacheStore interface {
+	get(key string) (*cacheEntry, bool)
+	set(key string, e *cacheEntry)
+	delete(key string)
+	// size returns the size of the stored entries in bytes
+	size() int64
+}
+
+// lru tracks the size and use of stored entries
+type lru struct {
+	maxSize int64
+	total   int64
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	size int64
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{maxSize: maxSize, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// touch marks the key as used
+func (l *lru) touch(key string) {
+	if el, ok := l.items[key]; ok {
+		l.ll.MoveToFront(el)
+	}
+}
+
+// add adds or replaces the key and returns the keys to evict
+func (l *lru) add(key string, size int64) []string {
+	l.remove(key)
+
+	l.items[key] = l.ll.PushFront(&lruItem{key: key, size: size})
+	l.total += size
+
+	evicted := []string{}
+
+	for l.total > l.maxSize && l.ll.Len() > 1 {
+		item := l.ll.Back().Value.(*lruItem)
+		l.remove(item.key)
+		evicted = append(evicted, item.key)
+	}
+
+	return evicted
+}
+
+func (l *lru) remove(key string) {
+	if el, ok := l.items[key]; ok {
+		l.total -= el.Value.(*lruItem).size
+		l.ll.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+// memoryStore keeps the entries in memory
+type memoryStore struct {
+	mu      sync.Mutex
+	lru     *lru
+	entries map[string]*cacheEntry
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{lru: newLRU(maxSize), entries: map[string]*cacheEntry{}}
+}
+
+func (m *memoryStore) get(key string) (*cacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if ok {
+		m.lru.touch(key)
+	}
+
+	return e, ok
+}
+
+func (m *memoryStore) set(key string, e *cacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = e
+
+	for _, k := range m.lru.add(key, e.size()) {
+		delete(m.entries, k)
+	}
+}
+
+func (m *memoryStore) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lru.remove(key)
+	delete(m.entries, key)
+}
+
+func (m *memoryStore) size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lru.total
+}
+
+// diskTempPrefix is the prefix of entries that are still being written
+const diskTempPrefix = ".tmp-"
+
+// diskStore keeps the entries in files named by the hash of their key, the index of the
+// files is kept in memory and rebuilt from the directory on start.  Files that aren't named
+// like entries are left alone.
+type diskStore struct {
+	dir    string
+	logger *zap.Logger
+
+	mu  sync.Mutex
+	lru *lru
+}
+
+// newDiskStore opens the cache directory, creating it if needed
+func newDiskStore(dir string, maxSize int64, logger *zap.Logger) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	d := &diskStore{dir: dir, logger: logger, lru: newLRU(maxSize)}
+
+	files := []fs.FileInfo{}
+
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir():
+			if path != dir {
+				return filepath.SkipDir
+			}
+		case strings.HasPrefix(info.Name(), diskTempPrefix):
+			// left over from an interrupted write
+			_ = os.Remove(path)
+		case isDiskStoreName(info.Name()):
+			files = append(files, info)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	// the oldest files are added first so they are evicted first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	for _, f := range files {
+		for _, name := range d.lru.add(f.Name(), f.Size()) {
+			d.remove(name)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *diskStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isDiskStoreName returns true if the file is named like an entry
+func isDiskStoreName(name string) bool {
+	if len(name) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+
+	return err == nil && strings.ToLower(name) == name
+}
+
+func (d *diskStore) remove(name string) {
+	if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !os.IsNotExist(err) {
+		d.logger.Warn("failed to remove cache file", zap.String("file", name), zap.Error(err))
+	}
+}
+
+func (d *diskStore) get(key string) (*cacheEntry, bool) {
+	name := d.name(key)
+
+	d.mu.Lock()
+	_, ok := d.lru.items[name]
+	d.lru.touch(name)
+	d.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(d.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	e := &cacheEntry{}
+	if err := gob.NewDecoder(f).Decode(e); err != nil || e.Key != key {
+		return nil, false
+	}
+
+	return e, true
+}
+
+func (d *diskStore) set(key string, e *cacheEntry) {
+	name := d.name(key)
+
+	// entries are written to a temporary file first so readers never see a partial entry
+	f, err := os.CreateTemp(d.dir, diskTempPrefix)
+	if err != nil {
+		d.logger.Warn("failed to create cache file", zap.Error(err))
+		return
+	}
+
+	if err := gob.NewEncoder(f).Encode(e); err != nil {
+		d.logger.Warn("failed to write cache file", zap.Error(err))
+		f.Close()
+		os.Remove(f.Name())
+
+		return
+	}
+
+	info, err := f.Stat()
+	f.Close()
+
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := os.Rename(f.Name(), filepath.Join(d.dir, name)); err != nil {
+		d.logger.Warn("failed to write cache file", zap.Error(err))
+		os.Remove(f.Name())
+
+		return
+	}
+
+	for _, evicted := range d.lru.add(name, info.Size()) {
+		d.remove(evicted)
+	}
+}
+
+func (d *diskStore) delete(key string) {
+	name := d.name(key)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.lru.items[name]; ok {
+		d.lru.remove(name)
+		d.remove(name)
+	}
+}
+
+func (d *diskStore) size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.lru.total
+}
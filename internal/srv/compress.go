@@ -0,0 +1,531 @@
+package srv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+	encodingZstd   = "zstd"
+
+	defaultCompressionMinSize = 1024
+
+	// upstreamAcceptEncoding asks origins for every encoding that can be decoded
+	upstreamAcceptEncoding = "zstd, br, gzip"
+
+	// zstdWindowSize keeps the memory of the pooled encoders small, clients only have to
+	// support windows up to 8MB
+	zstdWindowSize = 1 << 20
+	// zstdMaxWindow limits the memory used to decode responses of origins
+	zstdMaxWindow = 8 << 20
+)
+
+var (
+	defaultCompressionEncodings = []string{encodingZstd, encodingBrotli, encodingGzip}
+
+	defaultCompressionTypes = []string{
+		"text/html", "text/css", "text/plain", "text/javascript", "text/xml", "text/csv", "text/markdown",
+		"application/json", "application/*+json", "application/javascript", "application/xml", "application/*+xml",
+		"application/wasm", "image/svg+xml",
+	}
+)
+
+// CompressionConfig enables compression of the responses of an origin
+type CompressionConfig struct {
+	Encodings []string `mapstructure:"encodings"`
+	Types     []string `mapstructure:"types"`
+	MinSize   int      `mapstructure:"min_size"`
+	Upstream  bool     `mapstructure:"upstream"`
+}
+
+// compression compresses the responses of an origin for the clients that accept it
+type compression struct {
+	origin    string
+	encodings []string
+	types     []string
+	minSize   int
+	upstream  bool
+	metrics   *metrics
+}
+
+// newCompression returns the compression of the origin, nil if it has none
+func (s *Server) newCompression(o *Origin) (*compression, error) {
+	if o.Compression == nil {
+		return nil, nil
+	}
+
+	c, err := o.Compression.build(o.name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.metrics = s.metrics
+
+	return c, nil
+}
+
+// checkCompression returns an error if the compression of the origin is invalid
+func (o *Origin) checkCompression() error {
+	if o.Compression == nil {
+		return nil
+	}
+
+	_, err := o.Compression.build(o.name)
+
+	return err
+}
+
+// build returns the compression for the config with the defaults filled in
+func (cfg *CompressionConfig) build(origin string) (*compression, error) {
+	c := &compression{
+		origin:    origin,
+		encodings: defaultCompressionEncodings,
+		types:     defaultCompressionTypes,
+		minSize:   cfg.MinSize,
+		upstream:  cfg.Upstream,
+	}
+
+	if len(cfg.Encodings) > 0 {
+		c.encodings = []string{}
+
+		for _, e := range cfg.Encodings {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if _, ok := encoderPools[e]; !ok {
+				return nil, fmt.Errorf("unsupported encoding %q", e) //nolint:goerr113
+			}
+
+			c.encodings = append(c.encodings, e)
+		}
+	}
+
+	if len(cfg.Types) > 0 {
+		c.types = cfg.Types
+	}
+
+	for _, t := range c.types {
+		if _, err := path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("invalid type pattern %q: %w", t, err)
+		}
+	}
+
+	if c.minSize <= 0 {
+		c.minSize = defaultCompressionMinSize
+	}
+
+	return c, nil
+}
+
+// compressible returns true if responses of the content type are compressed
+func (c *compression) compressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" {
+		return false
+	}
+
+	for _, t := range c.types {
+		if ok, _ := path.Match(t, mediaType); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptEncoding holds the quality of each encoding accepted by a client
+type acceptEncoding map[string]float64
+
+func parseAcceptEncoding(h http.Header) acceptEncoding {
+	ae := acceptEncoding{}
+
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			params := strings.Split(part, ";")
+
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name == "" {
+				continue
+			}
+
+			q := 1.0
+
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				if strings.HasPrefix(p, "q=") {
+					if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+						q = f
+					}
+				}
+			}
+
+			ae[name] = q
+		}
+	}
+
+	return ae
+}
+
+// accepts returns the quality of the encoding, 0 if it isn't accepted
+func (ae acceptEncoding) accepts(encoding string) float64 {
+	if q, ok := ae[encoding]; ok {
+		return q
+	}
+
+	return ae["*"]
+}
+
+// negotiate returns the encoding the client accepts with the highest quality, ties go to the
+// earlier encoding
+func (c *compression) negotiate(ae acceptEncoding) string {
+	best, bestQ := "", 0.0
+
+	for _, e := range c.encodings {
+		if q := ae.accepts(e); q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+
+	return best
+}
+
+// serve compresses the response of next if the client accepts it.  Origins can be asked for
+// compressed responses, they are decoded for clients that don't accept their encoding.
+func (c *compression) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	// partial responses of an encoded body can't be encoded or decoded on their own
+	if r.Header.Get("Range") != "" || upgradeType(r.Header) != "" {
+		next(w, r)
+		return
+	}
+
+	ae := parseAcceptEncoding(r.Header)
+
+	cw := &compressWriter{
+		w:        w,
+		c:        c,
+		accept:   ae,
+		encoding: c.negotiate(ae),
+		head:     r.Method == http.MethodHead,
+	}
+
+	if c.upstream {
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+	}
+
+	defer cw.close()
+
+	next(cw, r)
+}
+
+// encoder compresses a response, encoders are pooled and reset for each response
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	encodingGzip: {New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	}},
+	encodingBrotli: {New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+	}},
+	encodingZstd: {New: func() interface{} {
+		e, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+		return e
+	}},
+}
+
+// newDecoder returns a reader decoding the body, nil if the encoding isn't supported
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewReader(r)
+	case encodingBrotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case encodingZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.IOReadCloser(), nil
+	}
+
+	return nil, nil
+}
+
+func decodable(encoding string) bool {
+	switch encoding {
+	case encodingGzip, encodingBrotli, encodingZstd:
+		return true
+	}
+
+	return false
+}
+
+// compressWriter encodes the response for the client.  The headers are held back until it
+// is known whether the response is compressed, responses of unknown length are buffered up
+// to the minimum size for that.  Encoded responses of the origin the client doesn't accept
+// are decoded in the background, only the background goroutine writes to the client then.
+type compressWriter struct {
+	w        http.ResponseWriter
+	c        *compression
+	accept   acceptEncoding
+	encoding string
+	head     bool
+
+	status  int
+	pending bool
+	buf     bytes.Buffer
+
+	out     io.Writer
+	enc     encoder
+	pw      *io.PipeWriter
+	decoded chan struct{}
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.w.Header()
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		cw.w.WriteHeader(code)
+		return
+	}
+
+	if cw.status != 0 {
+		return
+	}
+
+	cw.status = code
+
+	h := cw.w.Header()
+
+	upstream := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	if upstream == "identity" {
+		upstream = ""
+	}
+
+	compressible := cw.c.compressible(h.Get("Content-Type"))
+	if compressible || upstream != "" {
+		addVary(h, "Accept-Encoding")
+	}
+
+	bodyless := cw.head || code == http.StatusNoContent || code == http.StatusNotModified
+	partial := code == http.StatusPartialContent || h.Get("Content-Range") != ""
+
+	decode := cw.c.upstream && upstream != "" && cw.accept.accepts(upstream) == 0 && decodable(upstream) && !partial
+
+	encode := cw.encoding != "" && (upstream == "" || decode) && compressible && !bodyless && !partial &&
+		code < http.StatusMultipleChoices && !parseCacheControl(h).has("no-transform")
+
+	if decode {
+		h.Del("Content-Encoding")
+		h.Del("Content-Length")
+		weakenETag(h)
+	}
+
+	switch {
+	case decode && bodyless:
+		cw.start(false, "")
+	case decode:
+		// responses the origin encoded are worth compressing, their size isn't checked
+		cw.start(encode, upstream)
+	case !encode:
+		cw.start(false, "")
+	default:
+		if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+			cw.start(cl >= cw.c.minSize, "")
+			return
+		}
+
+		cw.pending = true
+	}
+}
+
+// start writes the headers and sets up the encoding of the body, and its decoding if the
+// origin encoded it
+func (cw *compressWriter) start(encode bool, decode string) {
+	cw.pending = false
+
+	h := cw.w.Header()
+	cw.out = cw.w
+
+	if encode {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		weakenETag(h)
+
+		cw.enc = encoderPools[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.w)
+		cw.out = cw.enc
+
+		cw.c.metrics.compressionResponses.WithLabelValues(cw.c.origin, cw.encoding, "compress").Inc()
+	}
+
+	cw.w.WriteHeader(cw.status)
+
+	if decode == "" {
+		return
+	}
+
+	cw.c.metrics.compressionResponses.WithLabelValues(cw.c.origin, decode, "decompress").Inc()
+
+	pr, pw := io.Pipe()
+	sink := cw.out
+
+	cw.pw = pw
+	cw.out = pw
+	cw.decoded = make(chan struct{})
+
+	go func() {
+		defer close(cw.decoded)
+
+		// writes of the origin response fail if its body can't be decoded
+		pr.CloseWithError(cw.copyDecoded(sink, pr, decode))
+	}()
+}
+
+// copyDecoded decodes the body and writes it to the sink, flushing after every write so
+// streamed responses aren't delayed
+func (cw *compressWriter) copyDecoded(sink io.Writer, r io.Reader, encoding string) error {
+	dec, err := newDecoder(encoding, r)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	buf := make([]byte, copyBufferSize)
+
+	for {
+		n, err := dec.Read(buf)
+		if n > 0 {
+			if _, werr := sink.Write(buf[:n]); werr != nil {
+				return werr
+			}
+
+			cw.flush()
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.pending {
+		cw.buf.Write(b)
+
+		if cw.buf.Len() >= cw.c.minSize {
+			cw.start(true, "")
+			return len(b), cw.writePending()
+		}
+
+		return len(b), nil
+	}
+
+	return cw.out.Write(b)
+}
+
+func (cw *compressWriter) writePending() error {
+	_, err := cw.out.Write(cw.buf.Bytes())
+	cw.buf = bytes.Buffer{}
+
+	return err
+}
+
+// Flush sends what has been written so far, a response that is still held back is
+// compressed if any of it was written
+func (cw *compressWriter) Flush() {
+	if cw.pending {
+		if cw.buf.Len() == 0 {
+			return
+		}
+
+		cw.start(true, "")
+
+		if err := cw.writePending(); err != nil {
+			return
+		}
+	}
+
+	// decoded responses are flushed by the decoding goroutine
+	if cw.pw != nil {
+		return
+	}
+
+	cw.flush()
+}
+
+func (cw *compressWriter) flush() {
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the response, a response smaller than the minimum size is written as it is
+func (cw *compressWriter) close() {
+	if cw.pending {
+		cw.start(false, "")
+		_ = cw.writePending()
+	}
+
+	if cw.pw != nil {
+		cw.pw.Close()
+		<-cw.decoded
+	}
+
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+
+		// the encoder mustn't hold on to the response writer in the pool
+		cw.enc.Reset(io.Discard)
+		encoderPools[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// addVary adds the header to the Vary header of the response
+func addVary(h http.Header, header string) {
+	if headerHasToken(h, "Vary", header) || headerHasToken(h, "Vary", "*") {
+		return
+	}
+
+	h.Add("Vary", header)
+}
+
+// weakenETag makes a strong ETag weak, the encoded body is no longer byte for byte the
+// same as the one it was computed for
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
@@ -0,0 +1,463 @@
+package srv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compressTestClient doesn't ask for or decode compressed responses by itself
+var compressTestClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+type compressTestResponse struct {
+	status int
+	body   string
+	header http.Header
+}
+
+func getCompressed(t *testing.T, url string, header http.Header) compressTestResponse {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := compressTestClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	dec, err := newDecoder(resp.Header.Get("Content-Encoding"), resp.Body)
+	require.NoError(t, err)
+
+	var body io.Reader = resp.Body
+	if dec != nil {
+		defer dec.Close()
+		body = dec
+	}
+
+	b, err := io.ReadAll(body)
+	require.NoError(t, err)
+
+	return compressTestResponse{status: resp.StatusCode, body: string(b), header: resp.Header}
+}
+
+func encodeTestBody(t *testing.T, encoding, body string) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+
+	var w io.WriteCloser
+
+	switch encoding {
+	case encodingGzip:
+		w = gzip.NewWriter(buf)
+	case encodingBrotli:
+		w = brotli.NewWriter(buf)
+	case encodingZstd:
+		e, err := zstd.NewWriter(buf)
+		require.NoError(t, err)
+
+		w = e
+	}
+
+	_, err := io.WriteString(w, body)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("hello world ", 200)
+
+	var testCases = []struct {
+		name         string
+		cfg          CompressionConfig
+		header       http.Header
+		body         string
+		streamed     bool
+		request      http.Header
+		wantEncoding string
+		wantVary     bool
+		wantETag     string
+	}{
+		{
+			name:         "gzip",
+			request:      http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantEncoding: encodingGzip,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:         "zstd preferred",
+			request:      http.Header{"Accept-Encoding": []string{"gzip, deflate, br, zstd"}},
+			wantEncoding: encodingZstd,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:         "quality",
+			request:      http.Header{"Accept-Encoding": []string{"gzip;q=1.0, zstd;q=0.5, br;q=0.8"}},
+			wantEncoding: encodingGzip,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:         "configured encodings",
+			cfg:          CompressionConfig{Encodings: []string{"br"}},
+			request:      http.Header{"Accept-Encoding": []string{"gzip, br, zstd"}},
+			wantEncoding: encodingBrotli,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:         "wildcard",
+			request:      http.Header{"Accept-Encoding": []string{"*, zstd;q=0, br;q=0"}},
+			wantEncoding: encodingGzip,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:     "refused",
+			request:  http.Header{"Accept-Encoding": []string{"gzip;q=0"}},
+			wantVary: true,
+			wantETag: `"v1"`,
+		},
+		{
+			name:     "not accepted",
+			wantVary: true,
+			wantETag: `"v1"`,
+		},
+		{
+			name:     "small",
+			body:     "hello",
+			request:  http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantVary: true,
+			wantETag: `"v1"`,
+		},
+		{
+			name:         "large streamed",
+			streamed:     true,
+			request:      http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantEncoding: encodingGzip,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:         "min size",
+			cfg:          CompressionConfig{MinSize: 4},
+			body:         "hello",
+			request:      http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantEncoding: encodingGzip,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:     "type not allowed",
+			header:   http.Header{"Content-Type": []string{"image/png"}},
+			request:  http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantETag: `"v1"`,
+		},
+		{
+			name:         "type pattern",
+			header:       http.Header{"Content-Type": []string{"application/vnd.api+json; charset=utf-8"}},
+			request:      http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantEncoding: encodingGzip,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:         "configured types",
+			cfg:          CompressionConfig{Types: []string{"image/*"}},
+			header:       http.Header{"Content-Type": []string{"image/png"}},
+			request:      http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantEncoding: encodingGzip,
+			wantVary:     true,
+			wantETag:     `W/"v1"`,
+		},
+		{
+			name:     "no-transform",
+			header:   http.Header{"Cache-Control": []string{"no-transform"}},
+			request:  http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantVary: true,
+			wantETag: `"v1"`,
+		},
+		{
+			name:     "range",
+			request:  http.Header{"Accept-Encoding": []string{"gzip"}, "Range": []string{"bytes=0-"}},
+			wantETag: `"v1"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := tc.body
+			if body == "" {
+				body = large
+			}
+
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("ETag", `"v1"`)
+
+				for k, v := range tc.header {
+					w.Header()[k] = v
+				}
+
+				if !tc.streamed {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				}
+
+				// the body is written in two parts so streamed responses have no length
+				half := len(body) / 2
+				_, _ = io.WriteString(w, body[:half])
+				w.(http.Flusher).Flush()
+				_, _ = io.WriteString(w, body[half:])
+			}))
+			defer backend.Close()
+
+			cfg := tc.cfg
+
+			s, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Auth: authOptional, Compression: &cfg},
+			}, []*Matcher{})
+
+			resp := getCompressed(t, ts.URL, tc.request)
+
+			assert.Equal(t, http.StatusOK, resp.status)
+			assert.Equal(t, body, resp.body)
+			assert.Equal(t, tc.wantEncoding, resp.header.Get("Content-Encoding"))
+			assert.Equal(t, tc.wantVary, headerHasToken(resp.header, "Vary", "Accept-Encoding"))
+			assert.Equal(t, tc.wantETag, resp.header.Get("ETag"))
+
+			if tc.wantEncoding != "" {
+				assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.compressionResponses.WithLabelValues("default", tc.wantEncoding, "compress")))
+			}
+		})
+	}
+}
+
+func TestCompressionEncodedResponses(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+
+	var testCases = []struct {
+		name         string
+		cfg          CompressionConfig
+		encoding     string
+		request      http.Header
+		wantUpstream string
+		wantEncoding string
+		wantDecoded  bool
+	}{
+		{
+			name:         "passed through",
+			encoding:     encodingGzip,
+			request:      http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantUpstream: "gzip",
+			wantEncoding: encodingGzip,
+		},
+		{
+			name:         "not decoded without upstream",
+			encoding:     encodingGzip,
+			request:      http.Header{"Accept-Encoding": []string{"zstd"}},
+			wantUpstream: "zstd",
+			wantEncoding: encodingGzip,
+		},
+		{
+			name:         "upstream accepted by the client",
+			cfg:          CompressionConfig{Upstream: true},
+			encoding:     encodingBrotli,
+			request:      http.Header{"Accept-Encoding": []string{"br"}},
+			wantUpstream: upstreamAcceptEncoding,
+			wantEncoding: encodingBrotli,
+		},
+		{
+			name:         "upstream decoded",
+			cfg:          CompressionConfig{Upstream: true},
+			encoding:     encodingGzip,
+			wantUpstream: upstreamAcceptEncoding,
+			wantDecoded:  true,
+		},
+		{
+			name:         "upstream decoded and encoded",
+			cfg:          CompressionConfig{Upstream: true},
+			encoding:     encodingZstd,
+			request:      http.Header{"Accept-Encoding": []string{"gzip"}},
+			wantUpstream: upstreamAcceptEncoding,
+			wantEncoding: encodingGzip,
+			wantDecoded:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var upstream string
+
+			encoded := encodeTestBody(t, tc.encoding, body)
+
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r.Header.Get("Accept-Encoding")
+
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Encoding", tc.encoding)
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = w.Write(encoded)
+			}))
+			defer backend.Close()
+
+			cfg := tc.cfg
+
+			s, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Auth: authOptional, Compression: &cfg},
+			}, []*Matcher{})
+
+			resp := getCompressed(t, ts.URL, tc.request)
+
+			assert.Equal(t, tc.wantUpstream, upstream)
+			assert.Equal(t, body, resp.body)
+			assert.Equal(t, tc.wantEncoding, resp.header.Get("Content-Encoding"))
+			assert.True(t, headerHasToken(resp.header, "Vary", "Accept-Encoding"))
+
+			decoded := testutil.ToFloat64(s.metrics.compressionResponses.WithLabelValues("default", tc.encoding, "decompress"))
+
+			if tc.wantDecoded {
+				assert.Equal(t, 1.0, decoded)
+				assert.Equal(t, `W/"v1"`, resp.header.Get("ETag"))
+			} else {
+				assert.Equal(t, 0.0, decoded)
+				assert.Equal(t, `"v1"`, resp.header.Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestCompressionUnknownLength(t *testing.T) {
+	c, err := New().newCompression(&Origin{Compression: &CompressionConfig{MinSize: 10}})
+	require.NoError(t, err)
+
+	var testCases = []struct {
+		name         string
+		writes       []string
+		flush        bool
+		wantEncoding string
+	}{
+		{name: "small", writes: []string{"hello"}},
+		{name: "small flushed", writes: []string{"hello"}, flush: true, wantEncoding: encodingGzip},
+		{name: "empty flushed", flush: true},
+		{name: "large", writes: []string{"hello", "world", "!"}, wantEncoding: encodingGzip},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			c.serve(rec, req, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+
+				for _, s := range tc.writes {
+					_, _ = io.WriteString(w, s)
+				}
+
+				if tc.flush {
+					w.(http.Flusher).Flush()
+				}
+			})
+
+			assert.Equal(t, tc.wantEncoding, rec.Header().Get("Content-Encoding"))
+
+			body := rec.Body.Bytes()
+			if tc.wantEncoding != "" {
+				dec, err := newDecoder(tc.wantEncoding, rec.Body)
+				require.NoError(t, err)
+
+				body, err = io.ReadAll(dec)
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, strings.Join(tc.writes, ""), string(body))
+		})
+	}
+}
+
+func TestCompressionPartialContent(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Range", "bytes 0-"+strconv.Itoa(len(body)-1)+"/"+strconv.Itoa(len(body)*2))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = io.WriteString(w, body)
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Auth: authOptional, Compression: &CompressionConfig{}},
+	}, []*Matcher{})
+
+	resp := getCompressed(t, ts.URL, http.Header{"Accept-Encoding": []string{"gzip"}})
+
+	assert.Equal(t, http.StatusPartialContent, resp.status)
+	assert.Equal(t, body, resp.body)
+	assert.Empty(t, resp.header.Get("Content-Encoding"))
+}
+
+func TestCompressionWithCache(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+
+	var hits int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, body)
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Auth: authOptional, Compression: &CompressionConfig{}, Cache: &CacheConfig{}},
+	}, []*Matcher{})
+
+	// the cached response is compressed for each client on its own
+	for _, encoding := range []string{encodingGzip, "", encodingBrotli} {
+		resp := getCompressed(t, ts.URL, http.Header{"Accept-Encoding": []string{encoding}})
+
+		assert.Equal(t, body, resp.body)
+		assert.Equal(t, encoding, resp.header.Get("Content-Encoding"))
+	}
+
+	assert.Equal(t, 1, hits)
+}
+
+func TestCompressionConfig(t *testing.T) {
+	s := New()
+
+	_, err := s.newCompression(&Origin{Compression: &CompressionConfig{Encodings: []string{"deflate"}}})
+	assert.Error(t, err)
+
+	_, err = s.newCompression(&Origin{Compression: &CompressionConfig{Types: []string{"text/["}}})
+	assert.Error(t, err)
+
+	c, err := s.newCompression(&Origin{Compression: &CompressionConfig{Encodings: []string{" GZIP "}}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{encodingGzip}, c.encodings)
+	assert.Equal(t, defaultCompressionMinSize, c.minSize)
+}
@@ -0,0 +1,198 @@
+package srv
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCSRFCookieName = "csrf_token"
+	defaultCSRFHeaderName = "X-CSRF-Token"
+	csrfTokenLength       = 32
+	csrfCookieTTL         = 12 * time.Hour
+)
+
+// CSRF configures cross-site request forgery protection for an origin
+type CSRF struct {
+	Enabled        bool     `mapstructure:"enabled"`
+	TrustedOrigins []string `mapstructure:"trusted_origins"`
+	DoubleSubmit   bool     `mapstructure:"double_submit"`
+	CookieName     string   `mapstructure:"cookie_name"`
+	HeaderName     string   `mapstructure:"header_name"`
+}
+
+func (c *CSRF) cookieName() string {
+	if c.CookieName != "" {
+		return c.CookieName
+	}
+
+	return defaultCSRFCookieName
+}
+
+func (c *CSRF) headerName() string {
+	if c.HeaderName != "" {
+		return c.HeaderName
+	}
+
+	return defaultCSRFHeaderName
+}
+
+// trusted returns true if the given origin (scheme://host) is in the list of trusted origins
+func (c *CSRF) trusted(origin string) bool {
+	for _, t := range c.TrustedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(t, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// csrfProtect rejects cross-site state changing requests to cookie authenticated origins.  Unsafe
+// methods must come from the same site (or a trusted origin) according to the Sec-Fetch-Site,
+// Origin and Referer headers and, if double submit is enabled, must echo the token cookie in a header.
+func (s *Server) csrfProtect(o *Origin) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			cfg := o.CSRF
+
+			if cfg.DoubleSubmit {
+				if _, err := r.Cookie(cfg.cookieName()); err != nil {
+					if err := setCSRFCookie(w, cfg.cookieName()); err != nil {
+						s.logger.Error("failed to generate csrf token", zap.Error(err))
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+				}
+			}
+
+			if isSafeMethod(r.Method) || hasBearerToken(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if reason := checkCSRF(cfg, r); reason != "" {
+				s.logger.Debug("rejecting cross-site request",
+					zap.String("origin", o.name),
+					zap.String("reason", reason),
+					zap.String("req.url", r.URL.String()),
+					zap.String("http.method", r.Method),
+				)
+
+				s.metrics.csrfRejected.WithLabelValues(o.name, reason).Inc()
+				w.WriteHeader(http.StatusForbidden)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// checkCSRF validates an unsafe request and returns the reason for rejecting it, or an empty
+// string if the request is allowed
+func checkCSRF(cfg *CSRF, r *http.Request) string {
+	source := requestSource(r)
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		if source == "" || !cfg.trusted(source) {
+			return "sec-fetch-site"
+		}
+	}
+
+	if source != "" {
+		u, err := url.Parse(source)
+		if err != nil || u.Host == "" {
+			return "origin"
+		}
+
+		if !strings.EqualFold(u.Host, r.Host) && !cfg.trusted(source) {
+			return "origin"
+		}
+	} else if r.Header.Get("Origin") == "null" {
+		return "origin"
+	}
+
+	if cfg.DoubleSubmit {
+		cookie, err := r.Cookie(cfg.cookieName())
+		if err != nil || cookie.Value == "" {
+			return "token"
+		}
+
+		header := r.Header.Get(cfg.headerName())
+		if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			return "token"
+		}
+	}
+
+	return ""
+}
+
+// requestSource returns the scheme://host the request was sent from, based on the Origin
+// header with a fallback to the Referer.  An empty string is returned if neither is usable.
+func requestSource(r *http.Request) string {
+	if o := r.Header.Get("Origin"); o != "" && o != "null" {
+		return strings.TrimSuffix(o, "/")
+	}
+
+	ref := r.Header.Get("Referer")
+	if ref == "" {
+		return ""
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// setCSRFCookie issues a new random double submit token.  The cookie is readable by
+// scripts so that they can echo it in the request header.
+func setCSRFCookie(w http.ResponseWriter, name string) error {
+	b := make([]byte, csrfTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Expires:  time.Now().Add(csrfCookieTTL),
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+// isSafeMethod returns true for methods that shouldn't change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+// hasBearerToken returns true if the request carries a bearer token, which browsers
+// never attach automatically
+func hasBearerToken(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+
+	return len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ")
+}
@@ -0,0 +1,132 @@
+package srv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *CSRF
+		method  string
+		headers map[string]string
+		cookie  string
+		want    int
+	}{
+		{
+			name:   "safe method",
+			cfg:    &CSRF{Enabled: true},
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Origin":         "https://evil.example.com",
+				"Sec-Fetch-Site": "cross-site",
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:   "same origin post",
+			cfg:    &CSRF{Enabled: true},
+			method: http.MethodPost,
+			headers: map[string]string{
+				"Origin":         "https://tucson.example.com",
+				"Sec-Fetch-Site": "same-origin",
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:   "cross site post",
+			cfg:    &CSRF{Enabled: true},
+			method: http.MethodPost,
+			headers: map[string]string{
+				"Origin":         "https://evil.example.com",
+				"Sec-Fetch-Site": "cross-site",
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name:   "cross site referer",
+			cfg:    &CSRF{Enabled: true},
+			method: http.MethodDelete,
+			headers: map[string]string{
+				"Referer": "https://evil.example.com/some/page",
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name:   "trusted origin",
+			cfg:    &CSRF{Enabled: true, TrustedOrigins: []string{"https://app.example.com"}},
+			method: http.MethodPut,
+			headers: map[string]string{
+				"Origin":         "https://app.example.com",
+				"Sec-Fetch-Site": "same-site",
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:   "bearer token exempt",
+			cfg:    &CSRF{Enabled: true},
+			method: http.MethodPost,
+			headers: map[string]string{
+				"Authorization":  "Bearer abc123",
+				"Origin":         "https://evil.example.com",
+				"Sec-Fetch-Site": "cross-site",
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:   "double submit match",
+			cfg:    &CSRF{Enabled: true, DoubleSubmit: true},
+			method: http.MethodPost,
+			headers: map[string]string{
+				"X-CSRF-Token": "s3cr3t",
+			},
+			cookie: "s3cr3t",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "double submit mismatch",
+			cfg:    &CSRF{Enabled: true, DoubleSubmit: true},
+			method: http.MethodPost,
+			headers: map[string]string{
+				"X-CSRF-Token": "guess",
+			},
+			cookie: "s3cr3t",
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "double submit missing cookie",
+			cfg:    &CSRF{Enabled: true, DoubleSubmit: true},
+			method: http.MethodPatch,
+			want:   http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			o := &Origin{CSRF: tt.cfg, name: "test"}
+
+			h := s.csrfProtect(o)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(tt.method, "https://tucson.example.com/foo", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: defaultCSRFCookieName, Value: tt.cookie})
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
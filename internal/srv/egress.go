@@ -0,0 +1,282 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+	netproxy "golang.org/x/net/proxy"
+)
+
+var errEgressProxy = errors.New("egress proxy refused the connection")
+
+// EgressProxyConfig configures the proxy used to reach the targets of an origin, the proxy
+// url can be http, https or socks5
+type EgressProxyConfig struct {
+	URL      string   `mapstructure:"url"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	NoProxy  []string `mapstructure:"no_proxy"`
+	Disabled bool     `mapstructure:"disabled"`
+}
+
+// egressProxy is a parsed egress proxy configuration, without a url the origin is reached
+// directly
+type egressProxy struct {
+	url     *url.URL
+	noProxy []string
+}
+
+// egressProxy returns the egress proxy of the origin, falling back to the global default.
+// Without either it returns nil and the proxy environment variables apply.
+func (o *Origin) egressProxy(global *EgressProxyConfig) (*egressProxy, error) {
+	cfg := o.EgressProxy
+	if cfg == nil {
+		cfg = global
+	}
+
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if cfg.Disabled || cfg.URL == "" {
+		return &egressProxy{}, nil
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress proxy url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported egress proxy scheme %q", u.Scheme) //nolint:goerr113
+	}
+
+	if cfg.Username != "" {
+		u.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+
+	noProxy := []string{}
+
+	for _, n := range cfg.NoProxy {
+		if n = strings.ToLower(strings.TrimSpace(n)); n != "" {
+			noProxy = append(noProxy, n)
+		}
+	}
+
+	return &egressProxy{url: u, noProxy: noProxy}, nil
+}
+
+// proxyFunc returns the Proxy func of the transport, the proxy of the environment is used if
+// none is configured.  Unix sockets never go through a proxy.
+func (e *egressProxy) proxyFunc() func(*http.Request) (*url.URL, error) {
+	switch {
+	case e == nil:
+		env := httpproxy.FromEnvironment().ProxyFunc()
+
+		return func(req *http.Request) (*url.URL, error) {
+			if _, ok := unixSocket(req.URL.Host); ok {
+				return nil, nil
+			}
+
+			return env(req.URL)
+		}
+	case e.url == nil:
+		return nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if !e.use(req.URL.Host) {
+			return nil, nil
+		}
+
+		return e.url, nil
+	}
+}
+
+// use returns true if requests to the address go through the proxy.  Unix sockets are
+// always local and no_proxy entries can be a host, a domain and its subdomains (with or
+// without a leading dot), an ip, a cidr range, or * for every address.
+func (e *egressProxy) use(addr string) bool {
+	if e == nil || e.url == nil {
+		return false
+	}
+
+	if _, ok := unixSocket(addr); ok {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, n := range e.noProxy {
+		if n == "*" {
+			return false
+		}
+
+		if _, network, err := net.ParseCIDR(n); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return false
+			}
+
+			continue
+		}
+
+		// an entry with a port only matches that port
+		if h, p, err := net.SplitHostPort(n); err == nil {
+			if p != port {
+				continue
+			}
+
+			n = h
+		}
+
+		if ip != nil {
+			if nip := net.ParseIP(n); nip != nil && nip.Equal(ip) {
+				return false
+			}
+
+			continue
+		}
+
+		domain := strings.TrimPrefix(n, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dialer returns a dial func connecting through the proxy, for transports without proxy
+// support.  The proxy environment variables don't apply to it.
+func (e *egressProxy) dialer(forward *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	direct := dialContext(forward)
+
+	if e == nil || e.url == nil {
+		return direct
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !e.use(addr) {
+			return direct(ctx, network, addr)
+		}
+
+		if e.url.Scheme == "socks5" {
+			return e.dialSOCKS5(ctx, forward, network, addr)
+		}
+
+		return e.dialConnect(ctx, forward, addr)
+	}
+}
+
+func (e *egressProxy) dialSOCKS5(ctx context.Context, forward *net.Dialer, network, addr string) (net.Conn, error) {
+	var auth *netproxy.Auth
+
+	if e.url.User != nil {
+		password, _ := e.url.User.Password()
+		auth = &netproxy.Auth{User: e.url.User.Username(), Password: password}
+	}
+
+	d, err := netproxy.SOCKS5("tcp", e.url.Host, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.(netproxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// dialConnect opens a tunnel to the address with an http CONNECT request to the proxy
+func (e *egressProxy) dialConnect(ctx context.Context, forward *net.Dialer, addr string) (net.Conn, error) {
+	proxyAddr := e.url.Host
+	if e.url.Port() == "" {
+		port := "80"
+		if e.url.Scheme == "https" {
+			port = "443"
+		}
+
+		proxyAddr = net.JoinHostPort(e.url.Hostname(), port)
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: e.url.Hostname()}) //nolint:gosec
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if e.url.User != nil {
+		password, _ := e.url.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(e.url.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	// the connection is closed when the context ends before the proxy answers
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+
+	// the body of a CONNECT response is the tunnel, it isn't read or closed
+	resp, err := http.ReadResponse(br, req) //nolint:bodyclose
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", errEgressProxy, resp.Status)
+	}
+
+	// the proxy doesn't send anything after its response until the tunnel is used
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%w: unexpected data after the CONNECT response", errEgressProxy)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,397 @@
+package srv
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// testEgressHost is only resolved by the test proxies, so a request to it proves it went
+// through a proxy
+const testEgressHost = "backend.egress.test"
+
+// resolveTestEgress maps the test host to localhost
+func resolveTestEgress(addr string) string {
+	return strings.Replace(addr, testEgressHost, "127.0.0.1", 1)
+}
+
+func splice(a, b net.Conn) {
+	go func() {
+		_, _ = io.Copy(a, b)
+		a.Close()
+	}()
+
+	_, _ = io.Copy(b, a)
+	b.Close()
+}
+
+// newTestConnectProxy starts an http proxy that tunnels CONNECT requests and forwards
+// absolute-form requests, it requires basic auth if a user is given
+func newTestConnectProxy(t *testing.T, user, password string) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var requests int32
+
+	forward := &httputil.ReverseProxy{Director: func(r *http.Request) {
+		r.URL.Host = resolveTestEgress(r.URL.Host)
+		r.Header.Del("Proxy-Authorization")
+	}}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if user != "" {
+			want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+			if r.Header.Get("Proxy-Authorization") != want {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+
+		if r.Method != http.MethodConnect {
+			forward.ServeHTTP(w, r)
+			return
+		}
+
+		backend, err := net.Dial("tcp", resolveTestEgress(r.Host))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			backend.Close()
+			return
+		}
+
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		splice(conn, backend)
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, &requests
+}
+
+// newTestSOCKS5Proxy starts a socks5 proxy supporting CONNECT, it requires username and
+// password auth if a user is given
+func newTestSOCKS5Proxy(t *testing.T, user, password string) (string, *int32) {
+	t.Helper()
+
+	var requests int32
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+
+		buf := make([]byte, 262)
+
+		// greeting: version, methods
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+
+		if user == "" {
+			_, _ = conn.Write([]byte{5, 0})
+		} else {
+			_, _ = conn.Write([]byte{5, 2})
+
+			// username and password: version, user, password
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+
+			u := make([]byte, buf[1])
+			if _, err := io.ReadFull(conn, u); err != nil {
+				return
+			}
+
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return
+			}
+
+			p := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, p); err != nil {
+				return
+			}
+
+			if string(u) != user || string(p) != password {
+				_, _ = conn.Write([]byte{1, 1})
+				return
+			}
+
+			_, _ = conn.Write([]byte{1, 0})
+		}
+
+		// request: version, command, reserved, address type, address, port
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+
+		var host string
+
+		switch buf[3] {
+		case 1:
+			if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+				return
+			}
+
+			host = net.IP(buf[:4]).String()
+		case 3:
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return
+			}
+
+			name := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, name); err != nil {
+				return
+			}
+
+			host = string(name)
+		default:
+			return
+		}
+
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+
+		atomic.AddInt32(&requests, 1)
+
+		addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+
+		backend, err := net.Dial("tcp", resolveTestEgress(addr))
+		if err != nil {
+			_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+
+		_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+		splice(conn, backend)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), &requests
+}
+
+func TestEgressProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	})
+
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	h2cBackend := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cBackend.Close()
+
+	httpProxy, httpRequests := newTestConnectProxy(t, "user", "secret")
+	socksProxy, socksRequests := newTestSOCKS5Proxy(t, "user", "secret")
+
+	egressURL := func(ts *httptest.Server, scheme string) string {
+		_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+		return scheme + "://" + net.JoinHostPort(testEgressHost, port)
+	}
+
+	var testCases = []struct {
+		name      string
+		url       string
+		insecure  bool
+		protocol  string
+		egress    *EgressProxyConfig
+		global    *EgressProxyConfig
+		wantCode  int
+		wantHTTP  int32
+		wantSOCKS int32
+	}{
+		{
+			name:     "http proxy",
+			url:      egressURL(backend, "http"),
+			egress:   &EgressProxyConfig{URL: httpProxy.URL, Username: "user", Password: "secret"},
+			wantCode: http.StatusOK,
+			wantHTTP: 1,
+		},
+		{
+			name:     "http proxy connect",
+			url:      egressURL(tlsBackend, "https"),
+			insecure: true,
+			egress:   &EgressProxyConfig{URL: httpProxy.URL, Username: "user", Password: "secret"},
+			wantCode: http.StatusOK,
+			wantHTTP: 1,
+		},
+		{
+			name:     "http proxy credentials in url",
+			url:      egressURL(tlsBackend, "https"),
+			insecure: true,
+			egress:   &EgressProxyConfig{URL: strings.Replace(httpProxy.URL, "http://", "http://user:secret@", 1)},
+			wantCode: http.StatusOK,
+			wantHTTP: 1,
+		},
+		{
+			name:     "http proxy wrong credentials",
+			url:      egressURL(tlsBackend, "https"),
+			insecure: true,
+			egress:   &EgressProxyConfig{URL: httpProxy.URL, Username: "user", Password: "wrong"},
+			wantCode: http.StatusBadGateway,
+			wantHTTP: 1,
+		},
+		{
+			name:      "socks5 proxy",
+			url:       egressURL(backend, "http"),
+			egress:    &EgressProxyConfig{URL: "socks5://" + socksProxy, Username: "user", Password: "secret"},
+			wantCode:  http.StatusOK,
+			wantSOCKS: 1,
+		},
+		{
+			name:     "h2c through http proxy",
+			url:      egressURL(h2cBackend, "http"),
+			protocol: protocolH2C,
+			egress:   &EgressProxyConfig{URL: httpProxy.URL, Username: "user", Password: "secret"},
+			wantCode: http.StatusOK,
+			wantHTTP: 1,
+		},
+		{
+			name:      "h2c through socks5 proxy",
+			url:       egressURL(h2cBackend, "http"),
+			protocol:  protocolH2C,
+			egress:    &EgressProxyConfig{URL: "socks5://" + socksProxy, Username: "user", Password: "secret"},
+			wantCode:  http.StatusOK,
+			wantSOCKS: 1,
+		},
+		{
+			name:     "global proxy",
+			url:      egressURL(backend, "http"),
+			global:   &EgressProxyConfig{URL: httpProxy.URL, Username: "user", Password: "secret"},
+			wantCode: http.StatusOK,
+			wantHTTP: 1,
+		},
+		{
+			name:     "no proxy",
+			url:      backend.URL,
+			global:   &EgressProxyConfig{URL: httpProxy.URL, NoProxy: []string{"10.0.0.0/8", "127.0.0.0/8"}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "disabled for the origin",
+			url:      backend.URL,
+			egress:   &EgressProxyConfig{Disabled: true},
+			global:   &EgressProxyConfig{URL: httpProxy.URL},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "unsupported scheme",
+			url:      backend.URL,
+			egress:   &EgressProxyConfig{URL: "ftp://proxy.internal"},
+			wantCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(httpRequests, 0)
+			atomic.StoreInt32(socksRequests, 0)
+
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: tc.url, Insecure: tc.insecure, Protocol: tc.protocol, EgressProxy: tc.egress},
+			}, nil, WithEgressProxy(tc.global))
+
+			resp, err := http.Get(ts.URL + "/")
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.wantCode, resp.StatusCode)
+			assert.Equal(t, tc.wantHTTP, atomic.LoadInt32(httpRequests))
+			assert.Equal(t, tc.wantSOCKS, atomic.LoadInt32(socksRequests))
+		})
+	}
+}
+
+func TestEgressNoProxy(t *testing.T) {
+	httpProxyURL := url.URL{Scheme: "http", Host: "proxy.internal:3128"}
+
+	e := &egressProxy{
+		url:     &httpProxyURL,
+		noProxy: []string{"internal.example.com", ".corp", "10.0.0.0/8", "192.168.1.10", "api.example.com:8443"},
+	}
+
+	var testCases = []struct {
+		addr string
+		want bool
+	}{
+		{addr: "internal.example.com:443", want: false},
+		{addr: "app.internal.example.com:443", want: false},
+		{addr: "example.com:443", want: true},
+		{addr: "db.corp:5432", want: false},
+		{addr: "corp:80", want: false},
+		{addr: "10.1.2.3:80", want: false},
+		{addr: "11.1.2.3:80", want: true},
+		{addr: "192.168.1.10:80", want: false},
+		{addr: "192.168.1.11:80", want: true},
+		{addr: "api.example.com:8443", want: false},
+		{addr: "api.example.com:443", want: true},
+		{addr: "2f72756e2f6170702e736f636b.unix.localhost:80", want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			assert.Equal(t, tc.want, e.use(tc.addr))
+		})
+	}
+
+	assert.False(t, (&egressProxy{url: &httpProxyURL, noProxy: []string{"*"}}).use("example.com:443"))
+}
+
+func TestEgressEnvironmentProxy(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("NO_PROXY", "")
+
+	proxy := (*egressProxy)(nil).proxyFunc()
+
+	u, err := proxy(httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	require.NoError(t, err)
+	require.NotNil(t, u)
+	assert.Equal(t, "proxy.example.com:3128", u.Host)
+
+	target, _, err := parseUnixURL("unix:///run/app.sock")
+	require.NoError(t, err)
+
+	u, err = proxy(httptest.NewRequest(http.MethodGet, target.String(), nil))
+	require.NoError(t, err)
+	assert.Nil(t, u)
+}
@@ -0,0 +1,308 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	texttemplate "text/template"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// statusClientClosedRequest is the (nginx) status for requests the client gave up on
+const statusClientClosedRequest = 499
+
+// error classes of failed proxy requests, used in logs and metrics
+const (
+	errorClassClientClosed      = "client_closed"
+	errorClassTimeout           = "timeout"
+	errorClassCircuitOpen       = "circuit_open"
+	errorClassNoTarget          = "no_target"
+	errorClassConnectionRefused = "connection_refused"
+	errorClassDNS               = "dns"
+	errorClassTLS               = "tls"
+	errorClassInvalidOrigin     = "invalid_origin"
+	errorClassBodyTooLarge      = "body_too_large"
+	errorClassBodyTimeout       = "body_timeout"
+	errorClassBadRequest        = "bad_request"
+	errorClassSpool             = "spool"
+	errorClassUpstream          = "upstream"
+)
+
+var errInvalidOrigin = errors.New("origin url is invalid")
+
+// errorMessages are the messages shown on error pages for each class
+var errorMessages = map[string]string{
+	errorClassClientClosed:      "client closed the request",
+	errorClassTimeout:           "the backend took too long to respond",
+	errorClassCircuitOpen:       "the backend is temporarily unavailable",
+	errorClassNoTarget:          "no backend is available",
+	errorClassConnectionRefused: "the backend refused the connection",
+	errorClassDNS:               "the backend could not be resolved",
+	errorClassTLS:               "a secure connection to the backend could not be established",
+	errorClassInvalidOrigin:     "the backend is misconfigured",
+	errorClassBodyTooLarge:      "the request body is too large",
+	errorClassBodyTimeout:       "the request body took too long to send",
+	errorClassBadRequest:        "the request body could not be read",
+	errorClassSpool:             "the request body could not be stored",
+	errorClassUpstream:          "the backend returned an invalid response",
+}
+
+// classifyError returns the status code and class of a failed proxy request
+func classifyError(r *http.Request, err error) (int, string) {
+	var (
+		dnsErr        *net.DNSError
+		netErr        net.Error
+		recordErr     tls.RecordHeaderError
+		unknownCA     x509.UnknownAuthorityError
+		certErr       x509.CertificateInvalidError
+		hostErr       x509.HostnameError
+		constraintErr x509.ConstraintViolationError
+	)
+
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable, errorClassCircuitOpen
+	case errors.Is(err, errNoTargetAvailable):
+		return http.StatusServiceUnavailable, errorClassNoTarget
+	case errors.Is(err, errInvalidOrigin), errors.Is(err, errInvalidOriginTLS):
+		return http.StatusBadGateway, errorClassInvalidOrigin
+	case errors.Is(err, errRequestBodyTooLarge):
+		return http.StatusRequestEntityTooLarge, errorClassBodyTooLarge
+	case errors.Is(err, errRequestBodyTimeout):
+		return http.StatusRequestTimeout, errorClassBodyTimeout
+	case errors.Is(err, errSpoolFailed):
+		return http.StatusInternalServerError, errorClassSpool
+	case errors.Is(r.Context().Err(), context.Canceled), errors.Is(err, context.Canceled):
+		return statusClientClosedRequest, errorClassClientClosed
+	case errors.Is(err, errRequestBodyRead):
+		return http.StatusBadRequest, errorClassBadRequest
+	case errors.Is(err, errResponseHeaderTimeout), errors.Is(err, errStreamIdleTimeout),
+		errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, errorClassTimeout
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway, errorClassDNS
+	case errors.As(err, &recordErr), errors.As(err, &unknownCA), errors.As(err, &certErr), errors.As(err, &hostErr),
+		errors.As(err, &constraintErr), errors.Is(err, errPinMismatch), isTLSAlert(err):
+		return http.StatusBadGateway, errorClassTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusServiceUnavailable, errorClassConnectionRefused
+	}
+
+	return http.StatusBadGateway, errorClassUpstream
+}
+
+// isTLSAlert returns true if the origin aborted the tls handshake with an alert, ie. because
+// it didn't accept the client certificate
+func isTLSAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
+
+// grpcCode maps the status of a failed proxy request to a grpc status code
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusGatewayTimeout:
+		return grpcCodeDeadlineExceeded
+	case statusClientClosedRequest:
+		return grpcCodeCanceled
+	case http.StatusRequestEntityTooLarge:
+		return grpcCodeResourceExhausted
+	}
+
+	return grpcCodeUnavailable
+}
+
+// requestID returns the id of the request set by the RequestID middleware
+func requestID(ctx context.Context) string {
+	return middleware.GetReqID(ctx)
+}
+
+// headerWritten returns true if the response has already started, an error can no longer
+// change its status
+func headerWritten(w http.ResponseWriter) bool {
+	ww, ok := w.(middleware.WrapResponseWriter)
+	return ok && ww.Status() != 0
+}
+
+// errorPage is the data available to error page templates
+type errorPage struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Class      string `json:"class"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id,omitempty"`
+	Origin     string `json:"origin,omitempty"`
+}
+
+// ErrorPages renders error responses from templates named <status>.html and <status>.json
+// (or error.html and error.json for any status), with built-in pages as the fallback
+type ErrorPages struct {
+	html map[string]*htmltemplate.Template
+	json map[string]*texttemplate.Template
+}
+
+// templateFuncs are available in error page templates, json encodes a value
+var templateFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// LoadErrorPages loads the error page templates from the directory
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	pages := &ErrorPages{
+		html: map[string]*htmltemplate.Template{},
+		json: map[string]*texttemplate.Template{},
+	}
+
+	if dir == "" {
+		return pages, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		ext := filepath.Ext(f)
+		name := strings.TrimSuffix(filepath.Base(f), ext)
+
+		if ext != ".html" && ext != ".json" {
+			continue
+		}
+
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		switch ext {
+		case ".html":
+			t, err := htmltemplate.New(name).Funcs(templateFuncs).Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+
+			pages.html[name] = t
+		case ".json":
+			t, err := texttemplate.New(name).Funcs(templateFuncs).Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+
+			pages.json[name] = t
+		}
+	}
+
+	return pages, nil
+}
+
+// wantsJSON returns true if the client prefers json over html
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// write writes the error page for the request
+func (e *ErrorPages) write(w http.ResponseWriter, r *http.Request, page errorPage) {
+	status := strconv.Itoa(page.Status)
+
+	var (
+		body        bytes.Buffer
+		contentType string
+		err         error
+	)
+
+	switch {
+	case wantsJSON(r):
+		contentType = "application/json"
+
+		if t := e.lookupJSON(status); t != nil {
+			err = t.Execute(&body, page)
+		} else {
+			err = json.NewEncoder(&body).Encode(page)
+		}
+	case strings.Contains(r.Header.Get("Accept"), "text/html"):
+		contentType = "text/html; charset=utf-8"
+
+		t := e.lookupHTML(status)
+		if t == nil {
+			t = defaultErrorPage
+		}
+
+		err = t.Execute(&body, page)
+	default:
+		contentType = "text/plain; charset=utf-8"
+		_, err = io.WriteString(&body, page.Message+"\n")
+	}
+
+	if err != nil {
+		body.Reset()
+
+		contentType = "text/plain; charset=utf-8"
+		_, _ = io.WriteString(&body, page.Message+"\n")
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", "no-store")
+
+	if page.RequestID != "" {
+		h.Set("X-Request-Id", page.RequestID)
+	}
+
+	w.WriteHeader(page.Status)
+
+	// the client may already be gone, there is nobody left to tell about it
+	_, _ = w.Write(body.Bytes())
+}
+
+func (e *ErrorPages) lookupHTML(status string) *htmltemplate.Template {
+	if e == nil {
+		return nil
+	}
+
+	if t, ok := e.html[status]; ok {
+		return t
+	}
+
+	return e.html["error"]
+}
+
+func (e *ErrorPages) lookupJSON(status string) *texttemplate.Template {
+	if e == nil {
+		return nil
+	}
+
+	if t, ok := e.json[status]; ok {
+		return t
+	}
+
+	return e.json["error"]
+}
+
+var defaultErrorPage = htmltemplate.Must(htmltemplate.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{ .Status }} {{ .StatusText }}</title></head>
+<body>
+<h1>{{ .Status }} {{ .StatusText }}</h1>
+<p>{{ .Message }}</p>
+{{ if .RequestID }}<p><small>request id {{ .RequestID }}</small></p>{{ end }}
+</body>
+</html>
+`))
@@ -0,0 +1,265 @@
+package srv
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var testCases = []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		wantStatus int
+		wantClass  string
+	}{
+		{
+			name:       "circuit open",
+			err:        errCircuitOpen,
+			wantStatus: http.StatusServiceUnavailable,
+			wantClass:  errorClassCircuitOpen,
+		},
+		{
+			name:       "no target",
+			err:        errNoTargetAvailable,
+			wantStatus: http.StatusServiceUnavailable,
+			wantClass:  errorClassNoTarget,
+		},
+		{
+			name:       "body too large",
+			err:        fmt.Errorf("write body: %w", errRequestBodyTooLarge),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantClass:  errorClassBodyTooLarge,
+		},
+		{
+			name:       "spool failed",
+			err:        fmt.Errorf("%w: no space left on device", errSpoolFailed),
+			wantStatus: http.StatusInternalServerError,
+			wantClass:  errorClassSpool,
+		},
+		{
+			name:       "request body read",
+			err:        fmt.Errorf("%w: unexpected EOF", errRequestBodyRead),
+			wantStatus: http.StatusBadRequest,
+			wantClass:  errorClassBadRequest,
+		},
+		{
+			name:       "client closed",
+			ctx:        canceled,
+			err:        context.Canceled,
+			wantStatus: statusClientClosedRequest,
+			wantClass:  errorClassClientClosed,
+		},
+		{
+			name:       "response header timeout",
+			err:        errResponseHeaderTimeout,
+			wantStatus: http.StatusGatewayTimeout,
+			wantClass:  errorClassTimeout,
+		},
+		{
+			name:       "total timeout",
+			err:        fmt.Errorf("round trip: %w", context.DeadlineExceeded),
+			wantStatus: http.StatusGatewayTimeout,
+			wantClass:  errorClassTimeout,
+		},
+		{
+			name:       "dial timeout",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}},
+			wantStatus: http.StatusGatewayTimeout,
+			wantClass:  errorClassTimeout,
+		},
+		{
+			name:       "dns",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Name: "backend", Err: "no such host"}},
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorClassDNS,
+		},
+		{
+			name:       "connection refused",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			wantStatus: http.StatusServiceUnavailable,
+			wantClass:  errorClassConnectionRefused,
+		},
+		{
+			name:       "tls",
+			err:        x509.UnknownAuthorityError{},
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorClassTLS,
+		},
+		{
+			name:       "tls hostname",
+			err:        fmt.Errorf("wrapped: %w", x509.HostnameError{Host: "127.0.0.1"}),
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorClassTLS,
+		},
+		{
+			name:       "tls pin",
+			err:        errPinMismatch,
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorClassTLS,
+		},
+		{
+			name:       "tls alert",
+			err:        &net.OpError{Op: "remote error", Err: errors.New("tls: certificate required")},
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorClassTLS,
+		},
+		{
+			name:       "tls text without a tls error",
+			err:        errors.New("backend said tls: nope"),
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorClassUpstream,
+		},
+		{
+			name:       "other",
+			err:        errors.New("malformed HTTP response"),
+			wantStatus: http.StatusBadGateway,
+			wantClass:  errorClassUpstream,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+			status, class := classifyError(r, tc.err)
+			assert.Equal(t, tc.wantStatus, status)
+			assert.Equal(t, tc.wantClass, class)
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "503.html"), []byte(`<p>{{ .Status }} {{ .Message }} {{ .RequestID }}</p>`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "error.json"), []byte(`{"code":{{ .Status }},"id":{{ json .RequestID }}}`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte(`ignored`), 0o600))
+
+	pages, err := LoadErrorPages(dir)
+	require.NoError(t, err)
+
+	page := errorPage{Status: http.StatusServiceUnavailable, Message: "down", RequestID: "abc"}
+
+	var testCases = []struct {
+		name            string
+		accept          string
+		status          int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "status template",
+			accept:          "text/html,application/json",
+			status:          http.StatusServiceUnavailable,
+			wantContentType: "text/html; charset=utf-8",
+			wantBody:        "<p>503 down abc</p>",
+		},
+		{
+			name:            "fallback json template",
+			accept:          "application/json",
+			status:          http.StatusServiceUnavailable,
+			wantContentType: "application/json",
+			wantBody:        `{"code":503,"id":"abc"}`,
+		},
+		{
+			name:            "plain text",
+			status:          http.StatusServiceUnavailable,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "down\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tc.accept)
+
+			w := httptest.NewRecorder()
+			pages.write(w, r, page)
+
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.wantContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			assert.Equal(t, "abc", w.Header().Get("X-Request-Id"))
+			assert.Equal(t, tc.wantBody, w.Body.String())
+		})
+	}
+
+	// the client went away
+	assert.NotPanics(t, func() {
+		pages.write(failingResponseWriter{httptest.NewRecorder()}, httptest.NewRequest(http.MethodGet, "/", nil), page)
+	})
+
+	_, err = LoadErrorPages(t.TempDir() + "/missing")
+	assert.NoError(t, err)
+}
+
+// failingResponseWriter fails every write, like the connection of a client that went away
+type failingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (failingResponseWriter) Write([]byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+func TestProxyErrorResponse(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+	}, nil)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("X-Request-Id"))
+
+	page := errorPage{}
+	require.NoError(t, json.Unmarshal(body, &page))
+	assert.Equal(t, errorClassConnectionRefused, page.Class)
+	assert.Equal(t, resp.Header.Get("X-Request-Id"), page.RequestID)
+	assert.Equal(t, "default", page.Origin)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.proxyErrors.WithLabelValues("default", errorClassConnectionRefused, "503")))
+}
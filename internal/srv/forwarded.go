@@ -0,0 +1,247 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type forwardedContextKey int
+
+const (
+	clientIPKey forwardedContextKey = iota
+	trustedPeerKey
+)
+
+// forwardingHeaders are only kept on requests from trusted proxies
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// ParseTrustedProxies parses a list of ip addresses and cidr ranges
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", p) //nolint:goerr113
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// isTrustedProxy returns true if the address is one of the trusted proxies
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// realIP determines the client ip of the request.  Forwarding headers are only believed if the
+// request comes from a trusted proxy, in which case the client is the right-most address in
+// X-Forwarded-For that isn't a trusted proxy.  Unlike chi's RealIP the RemoteAddr is left alone
+// so that it can be appended to X-Forwarded-For.
+func (s *Server) realIP(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		peer := remoteIP(r.RemoteAddr)
+		client := peer
+		trusted := peer != nil && s.isTrustedProxy(peer)
+
+		if trusted {
+			client = s.forwardedClientIP(r, peer)
+		}
+
+		ctx := context.WithValue(r.Context(), trustedPeerKey, trusted)
+		if client != nil {
+			ctx = context.WithValue(ctx, clientIPKey, client.String())
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// forwardedClientIP walks X-Forwarded-For from the right, skipping trusted proxies
+func (s *Server) forwardedClientIP(r *http.Request, peer net.IP) net.IP {
+	hops := []string{}
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		if !s.isTrustedProxy(ip) {
+			return ip
+		}
+
+		peer = ip
+	}
+
+	if ip := net.ParseIP(r.Header.Get("X-Real-Ip")); ip != nil && len(hops) == 0 {
+		return ip
+	}
+
+	return peer
+}
+
+// clientIP returns the client ip determined by realIP
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// fromTrustedProxy returns true if the request came from a trusted proxy
+func fromTrustedProxy(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedPeerKey).(bool)
+	return trusted
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return net.ParseIP(host)
+}
+
+// setForwardedHeaders sets the X-Forwarded-* (and optionally Forwarded) headers on the request
+// to the backend.  Headers from trusted proxies are kept, everything else is replaced.  The
+// immediate peer is appended to X-Forwarded-For by the reverse proxy.
+func (p *proxy) setForwardedHeaders(req *http.Request) {
+	trusted := fromTrustedProxy(req.Context())
+	if !trusted {
+		for _, h := range forwardingHeaders {
+			req.Header.Del(h)
+		}
+	}
+
+	// tucson only serves plain http, behind a trusted proxy the request may have arrived over https
+	proto := "http"
+	if trusted {
+		if v := forwardedProto(req.Header); v != "" {
+			proto = v
+		}
+	}
+
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if ip := clientIP(req.Context()); ip != "" {
+		req.Header.Set("X-Real-Ip", ip)
+	}
+
+	if !p.origin.Forwarded {
+		return
+	}
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s",
+		forwardedNode(remoteIP(req.RemoteAddr)),
+		forwardedValue(req.Host),
+		proto,
+	)
+
+	if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+
+	req.Header.Set("Forwarded", element)
+}
+
+// forwardedProto returns the protocol the proxy in front of tucson received the request with,
+// from the last Forwarded element with a proto or else X-Forwarded-Proto
+func forwardedProto(h http.Header) string {
+	proto := ""
+
+	for _, v := range h.Values("Forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "proto") {
+					proto = strings.Trim(kv[1], `"`)
+				}
+			}
+		}
+	}
+
+	if proto == "" {
+		if values := strings.Split(h.Get("X-Forwarded-Proto"), ","); len(values) > 0 {
+			proto = values[len(values)-1]
+		}
+	}
+
+	// anything else would have to be quoted in the Forwarded header
+	switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+	case "http", "https":
+		return proto
+	}
+
+	return ""
+}
+
+// forwardedNode formats an ip for the for= parameter of the Forwarded header, ipv6
+// addresses must be bracketed and quoted (RFC 7239 section 6)
+func forwardedNode(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.To4() == nil:
+		return `"[` + ip.String() + `]"`
+	}
+
+	return ip.String()
+}
+
+// forwardedValue quotes a value for the Forwarded header if it isn't a token
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, ":[]\" ,;=") {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+
+	return v
+}
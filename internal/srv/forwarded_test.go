@@ -0,0 +1,238 @@
+package srv
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		proxies []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			proxies: []string{},
+			want:    []string{},
+		},
+		{
+			name:    "addresses and ranges",
+			proxies: []string{"10.0.0.1", " 192.168.0.0/16", "::1", ""},
+			want:    []string{"10.0.0.1/32", "192.168.0.0/16", "::1/128"},
+		},
+		{
+			name:    "invalid address",
+			proxies: []string{"10.0.0"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid range",
+			proxies: []string{"10.0.0.0/33"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nets, err := ParseTrustedProxies(tc.proxies)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			got := []string{}
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	s := New(WithTrustedProxies(trusted))
+
+	var testCases = []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "untrusted peer ignores headers",
+			remoteAddr: "203.0.113.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted chain skips trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.1, 10.0.0.2"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted peer with x-real-ip",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Real-Ip": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.1:1234",
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+
+			h := s.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", forwardedNode(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, `"[2001:db8::1]"`, forwardedNode(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, "unknown", forwardedNode(nil))
+}
+
+func TestForwardedProto(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{name: "none", header: http.Header{}},
+		{name: "x-forwarded-proto", header: http.Header{"X-Forwarded-Proto": {"HTTPS"}}, want: "https"},
+		{name: "last x-forwarded-proto", header: http.Header{"X-Forwarded-Proto": {"https, http"}}, want: "http"},
+		{
+			name: "forwarded wins",
+			header: http.Header{
+				"Forwarded":         {`for=192.0.2.1;proto=http, for=198.51.100.1;Proto="https"`},
+				"X-Forwarded-Proto": {"http"},
+			},
+			want: "https",
+		},
+		{name: "unknown proto", header: http.Header{"X-Forwarded-Proto": {"https;host=evil"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, forwardedProto(tc.header))
+		})
+	}
+}
+
+func TestProxyForwardingHeaders(t *testing.T) {
+	var got http.Header
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	loopback, err := ParseTrustedProxies([]string{"127.0.0.1"})
+	require.NoError(t, err)
+
+	var testCases = []struct {
+		name    string
+		trusted bool
+		want    map[string]string
+	}{
+		{
+			name: "untrusted client",
+			want: map[string]string{
+				"X-Forwarded-For":   "127.0.0.1",
+				"X-Forwarded-Proto": "http",
+				"X-Real-Ip":         "127.0.0.1",
+				"Forwarded":         "for=127.0.0.1;host=\"{host}\";proto=http",
+			},
+		},
+		{
+			name:    "trusted proxy",
+			trusted: true,
+			want: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1, 127.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "example.com",
+				"X-Real-Ip":         "198.51.100.1",
+				"Forwarded":         "for=198.51.100.1;proto=https, for=127.0.0.1;host=\"{host}\";proto=https",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := []Option{}
+			if tc.trusted {
+				opts = append(opts, WithTrustedProxies(loopback))
+			}
+
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Forwarded: true},
+			}, nil, opts...)
+
+			host := strings.TrimPrefix(ts.URL, "http://")
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Forwarded-For", "198.51.100.1")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "example.com")
+			req.Header.Set("Forwarded", "for=198.51.100.1;proto=https")
+			req.Header.Set("Connection", "X-Hop")
+			req.Header.Set("X-Hop", "1")
+			req.Header.Set("Keep-Alive", "timeout=5")
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			if _, ok := tc.want["X-Forwarded-Host"]; !ok {
+				tc.want["X-Forwarded-Host"] = host
+			}
+
+			for k, v := range tc.want {
+				assert.Equal(t, strings.ReplaceAll(v, "{host}", host), strings.Join(got.Values(k), ", "), k)
+			}
+
+			assert.Empty(t, got.Get("X-Hop"))
+			assert.Empty(t, got.Get("Keep-Alive"))
+		})
+	}
+}
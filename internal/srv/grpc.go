@@ -0,0 +1,47 @@
+package srv
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes returned by tucson, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcCodeCanceled          = 1
+	grpcCodeDeadlineExceeded  = 4
+	grpcCodePermissionDenied  = 7
+	grpcCodeResourceExhausted = 8
+	grpcCodeUnavailable       = 14
+	grpcCodeUnauthenticated   = 16
+)
+
+// isGRPCRequest returns true if the request is a gRPC call, application/grpc optionally
+// followed by +<codec> or parameters.  gRPC-Web calls are plain http requests.
+func isGRPCRequest(r *http.Request) bool {
+	ct := strings.ToLower(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(ct, "application/grpc") {
+		return false
+	}
+
+	rest := ct[len("application/grpc"):]
+
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// writeGRPCError writes a trailers-only gRPC response with the given status.  gRPC clients
+// only look at the grpc-status, the http status is always 200.
+func writeGRPCError(w http.ResponseWriter, code int, msg string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", grpcEncodeMessage(msg))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEncodeMessage percent encodes the message as required for the grpc-message header
+func grpcEncodeMessage(msg string) string {
+	return strings.ReplaceAll(url.PathEscape(msg), "+", "%2B")
+}
@@ -0,0 +1,88 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestIsGRPCRequest(t *testing.T) {
+	var testCases = []struct {
+		contentType string
+		want        bool
+	}{
+		{contentType: "application/grpc", want: true},
+		{contentType: "application/grpc+proto", want: true},
+		{contentType: "application/grpc;charset=utf-8", want: true},
+		{contentType: "Application/GRPC", want: true},
+		{contentType: "application/grpc-web"},
+		{contentType: "application/grpc-web+proto"},
+		{contentType: "application/grpc-web-text"},
+		{contentType: "application/grpcx"},
+		{contentType: "application/json"},
+		{contentType: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.contentType, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Content-Type", tc.contentType)
+
+			assert.Equal(t, tc.want, isGRPCRequest(r))
+		})
+	}
+}
+
+func TestProxyH2CTrailers(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("X-Proto", r.Proto)
+		_, _ = io.WriteString(w, "message")
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Protocol: "grpc"},
+	}, []*Matcher{
+		{Path: "/helloworld.Greeter/*", Origin: "default"},
+	})
+
+	resp, err := http.Post(ts.URL+"/helloworld.Greeter/SayHello", "application/grpc", strings.NewReader("request"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Proto"))
+	assert.Equal(t, "message", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestProxyGRPCUnavailable(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Protocol: "grpc"},
+	}, []*Matcher{
+		{Path: "/helloworld.Greeter/*", Origin: "default"},
+	})
+
+	resp, err := http.Post(ts.URL+"/helloworld.Greeter/SayHello", "application/grpc", strings.NewReader("request"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "14", resp.Header.Get("Grpc-Status"))
+	assert.Equal(t, "the%20backend%20refused%20the%20connection", resp.Header.Get("Grpc-Message"))
+}
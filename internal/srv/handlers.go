@@ -1,16 +1,31 @@
 package srv
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
-	"github.com/fishnix/tucson/internal/token"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
+const (
+	// redirectParam is the query parameter holding the page to return to after login
+	redirectParam = "rd"
+	// redirectCookie holds the page to return to while the user is at the identity provider
+	redirectCookie    = "auth_rd"
+	redirectCookieTTL = 10 * time.Minute
+	// stepUpCookie holds the session sent through the login flow for step-up authentication
+	stepUpCookie = "auth_step_up"
+)
+
 // writeHTTPResponse writes the http response and panics on write errors
 func writeHTTPResponse(w http.ResponseWriter, payload []byte) {
 	if _, err := w.Write(payload); err != nil {
@@ -25,24 +40,206 @@ func (s *Server) livenessCheck(w http.ResponseWriter, r *http.Request) {
 	writeHTTPResponse(w, []byte(`{"status":"UP"}`))
 }
 
-// readinessCheck ensures that the server is up and that we are able to process requests.
+type readinessStatus struct {
+	Status  string                     `json:"status"`
+	Origins map[string]originReadiness `json:"origins,omitempty"`
+}
+
+type originReadiness struct {
+	Status  string            `json:"status"`
+	Targets map[string]string `json:"targets"`
+}
+
+// readinessCheck ensures that the server is up and that we are able to process requests, it
+// is down if a critical origin or every origin has no available targets
 func (s *Server) readinessCheck(w http.ResponseWriter, r *http.Request) {
+	status := readinessStatus{Status: "UP", Origins: map[string]originReadiness{}}
+	proxies := s.proxies()
+	up, criticalDown := 0, false
+
+	for _, p := range proxies {
+		origin := originReadiness{Status: "DOWN", Targets: map[string]string{}}
+
+		for _, t := range p.targets {
+			origin.Targets[t.name] = "DOWN"
+
+			if t.available() {
+				origin.Status = "UP"
+				origin.Targets[t.name] = "UP"
+			}
+		}
+
+		switch {
+		case origin.Status == "UP":
+			up++
+		case p.origin.Critical:
+			criticalDown = true
+		}
+
+		status.Origins[p.origin.name] = origin
+	}
+
+	if criticalDown || (len(proxies) > 0 && up == 0) {
+		status.Status = "DOWN"
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		panic(err)
+	}
+
+	code := http.StatusOK
+	if status.Status != "UP" {
+		code = http.StatusServiceUnavailable
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	writeHTTPResponse(w, []byte(`{"status":"UP"}`))
+	w.WriteHeader(code)
+	writeHTTPResponse(w, body)
 }
 
-func (s *Server) proxyOriginHandler(o *Origin) http.HandlerFunc {
+// proxyOriginHandler proxies requests to the origin, rewriting the path with the rules of the
+// matcher (if any) and the origin
+func (s *Server) proxyOriginHandler(o *Origin, m *Matcher) http.HandlerFunc {
+	var matcherTimeouts *TimeoutConfig
+	if m != nil {
+		matcherTimeouts = m.Timeouts
+	}
+
+	timeouts := o.timeouts()
+	timeouts = timeouts.merge(matcherTimeouts)
+
+	rw, err := newPathRewriter(o, m)
+	if err != nil {
+		s.logger.Error("invalid rewrite rule, requests will fail", zap.String("origin", o.name), zap.Any("matcher", m), zap.Error(err))
+
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+
+	bodyLimit := maxRequestBody(o, m)
+
+	mirror, err := s.newMirror(o, m)
+	if err != nil {
+		s.logger.Error("invalid mirror, requests won't be mirrored", zap.String("origin", o.name), zap.Any("matcher", m), zap.Error(err))
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.logger.Debug("inside proxy origin handler func!",
 			zap.String("req.url", r.URL.String()),
 			zap.String("http.method", r.Method),
 		)
-		prox := s.newProxy(o, s.logger)
-		prox.proxyRequest(w, r)
+
+		if rw != nil {
+			rewritten, err := withRewrittenPath(r, rw.rewrite(r))
+			if err != nil {
+				s.logger.Debug("invalid rewritten path", zap.String("req.url", r.URL.String()), zap.Error(err))
+				w.WriteHeader(http.StatusBadRequest)
+
+				return
+			}
+
+			r = rewritten
+		}
+
+		if err := limitBody(r, bodyLimit); err != nil {
+			o.proxy.errorHandler(w, r, err)
+			return
+		}
+
+		// streamed grpc calls send their request body for as long as the call lasts
+		if !isGRPCRequest(r) {
+			limitBodyTime(r, timeouts.Body)
+		}
+
+		// streamed grpc calls can't wait for the whole request body
+		if o.Spool != nil && !isGRPCRequest(r) {
+			store, cleanup, err := s.spool(r, o.Spool)
+			defer cleanup()
+
+			if err != nil {
+				o.proxy.rejectSpoolError(w, r, err)
+				return
+			}
+
+			if store != "" {
+				s.metrics.requestsSpooled.WithLabelValues(o.name, store).Inc()
+			}
+		}
+
+		var proxy http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			o.proxy.proxyRequest(w, r.WithContext(withTimeouts(r.Context(), timeouts)))
+		}
+
+		if o.cache != nil {
+			origin := proxy
+			proxy = func(w http.ResponseWriter, r *http.Request) {
+				o.cache.serve(w, r, origin)
+			}
+		}
+
+		// responses are compressed after the cache so it stores them the same for every client
+		if o.compression != nil {
+			cached := proxy
+			proxy = func(w http.ResponseWriter, r *http.Request) {
+				o.compression.serve(w, r, cached)
+			}
+		}
+
+		if mirror != nil {
+			mirror.serve(w, r, proxy)
+			return
+		}
+
+		proxy(w, r)
 	}
 }
 
+// handleLogin starts the oidc login flow, remembering where to send the user afterwards
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	if rd := q.Get(redirectParam); isLocalRedirect(rd) {
+		addCookie(w, redirectCookie, rd, redirectCookieTTL)
+	}
+
+	// step-up authentication parameters are passed on to the identity provider
+	opts := []oauth2.AuthCodeOption{}
+
+	if maxAge := q.Get("max_age"); maxAge != "" {
+		if _, err := strconv.Atoi(maxAge); err == nil {
+			opts = append(opts, oauth2.SetAuthURLParam("max_age", maxAge))
+		}
+	}
+
+	if acr := q.Get("acr_values"); acr != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", acr))
+	}
+
+	http.Redirect(w, r, s.oauth2Config.AuthCodeURL("foobar", opts...), http.StatusFound)
+}
+
+// handleOriginLogin sends users of an origin to the login flow on demand, returning them to
+// the page they came from
+func (s *Server) handleOriginLogin(w http.ResponseWriter, r *http.Request) {
+	rd := r.URL.Query().Get(redirectParam)
+	if rd == "" {
+		if ref, err := url.Parse(r.Referer()); err == nil && strings.EqualFold(ref.Host, r.Host) {
+			rd = ref.RequestURI()
+		}
+	}
+
+	if !isLocalRedirect(rd) {
+		rd = "/"
+	}
+
+	q := url.Values{}
+	q.Set(redirectParam, rd)
+
+	http.Redirect(w, r, "/auth/login?"+q.Encode(), http.StatusFound)
+}
+
 func (s *Server) handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	s.logger.Debug("handling OIDC callback, exchanging code for token")
 
@@ -76,6 +273,23 @@ func (s *Server) handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 
 	s.logger.Debug("token verified, got oidc token, parsing claims", zap.Any("token", idToken))
 
+	authClaims := struct {
+		AuthTime int64    `json:"auth_time"`
+		Acr      string   `json:"acr"`
+		Amr      []string `json:"amr"`
+	}{}
+
+	if err := idToken.Claims(&authClaims); err != nil {
+		s.logger.Error("error parsing authentication claims from id token", zap.Error(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// not all providers send auth_time, fall back to when the id token was issued
+	if authClaims.AuthTime == 0 {
+		authClaims.AuthTime = idToken.IssuedAt.Unix()
+	}
+
 	claims := struct {
 		Email      string `json:"email"`
 		Name       string `json:"name"`
@@ -98,38 +312,61 @@ func (s *Server) handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 
 	s.logger.Debug("parsed claims from token", zap.Any("claims", claims))
 
-	// generate the node token for requesting secrets from the scaler
-	rawToken, err := token.New(
-		token.WithKey(s.signingKey),
-		token.WithSubject(claims.Email),
-		token.WithNotBefore(time.Now()),
-		token.WithExpire(time.Now().Add(60*time.Minute)),
-		token.WithPrivate(
-			struct {
-				Name       string `json:"name"`
-				UniqueName string `json:"unique_name"`
-			}{claims.Name, claims.UniqueName},
-		),
-	)
+	sessionID, err := uuid.NewRandom()
 	if err != nil {
+		s.logger.Error("failed to generate session id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	sess := &session{
+		ID:         sessionID.String(),
+		Subject:    claims.Email,
+		Email:      claims.Email,
+		Name:       claims.Name,
+		UniqueName: claims.UniqueName,
+		AuthTime:   authClaims.AuthTime,
+		Acr:        authClaims.Acr,
+		Amr:        authClaims.Amr,
+		Start:      now,
+		LastSeen:   now,
+	}
+
+	if err := s.issueSession(w, sess); err != nil {
 		s.logger.Error("failed to generate token", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
+	rd := "/"
+	if c, err := r.Cookie(redirectCookie); err == nil && isLocalRedirect(c.Value) {
+		rd = c.Value
+		addCookie(w, redirectCookie, "", -time.Hour)
 	}
 
-	addCookie(w, "jwt", rawToken, 60*time.Minute)
+	http.Redirect(w, r, rd, http.StatusFound)
+}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+// isLocalRedirect returns true if the redirect target is a path on this host
+func isLocalRedirect(rd string) bool {
+	return strings.HasPrefix(rd, "/") && !strings.HasPrefix(rd, "//") && !strings.HasPrefix(rd, "/\\")
 }
 
 // addCookie will apply a new cookie to the response of a http request
 // with the key/value specified.
 func addCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	addPathCookie(w, name, value, "/", ttl)
+}
+
+// addPathCookie is addCookie for a cookie that is only sent to the path and below
+func addPathCookie(w http.ResponseWriter, name, value, path string, ttl time.Duration) {
 	expire := time.Now().Add(ttl)
 	cookie := http.Cookie{
 		Name:    name,
 		Value:   value,
 		Expires: expire,
-		Path:    "/",
+		Path:    path,
 	}
 	http.SetCookie(w, &cookie)
 }
@@ -0,0 +1,215 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+
+	// healthCheckDrainLimit is how much of the health check response body is read so the
+	// connection can be reused
+	healthCheckDrainLimit = 4 * 1024
+)
+
+// HealthCheckConfig configures active health checks of the targets of an origin
+type HealthCheckConfig struct {
+	Path           string        `mapstructure:"path"`
+	Interval       time.Duration `mapstructure:"interval"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	ExpectedStatus int           `mapstructure:"expected_status"`
+	Rise           int           `mapstructure:"rise"`
+	Fall           int           `mapstructure:"fall"`
+}
+
+// withDefaults returns a copy of the config with unset values replaced by the defaults
+func (c *HealthCheckConfig) withDefaults() HealthCheckConfig {
+	cfg := *c
+
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHealthCheckInterval
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultHealthCheckTimeout
+	}
+
+	if cfg.Rise <= 0 {
+		cfg.Rise = defaultHealthCheckRise
+	}
+
+	if cfg.Fall <= 0 {
+		cfg.Fall = defaultHealthCheckFall
+	}
+
+	return cfg
+}
+
+// expected returns true if the status code means the target is healthy, without an
+// expected status any 2xx or 3xx is healthy
+func (c *HealthCheckConfig) expected(code int) bool {
+	if c.ExpectedStatus != 0 {
+		return code == c.ExpectedStatus
+	}
+
+	return code >= http.StatusOK && code < http.StatusBadRequest
+}
+
+// proxies returns the proxies of all origins, including the default origin
+func (s *Server) proxies() []*proxy {
+	proxies := []*proxy{}
+	seen := map[*proxy]bool{}
+
+	for _, o := range append([]*Origin{s.defaultOrigin}, originList(s.origins)...) {
+		if o == nil || o.proxy == nil || seen[o.proxy] {
+			continue
+		}
+
+		seen[o.proxy] = true
+		proxies = append(proxies, o.proxy)
+	}
+
+	return proxies
+}
+
+func originList(origins map[string]*Origin) []*Origin {
+	list := make([]*Origin, 0, len(origins))
+	for _, o := range origins {
+		list = append(list, o)
+	}
+
+	return list
+}
+
+// runHealthChecks starts a health checker for every target of the origins with health checks,
+// they stop when the context is canceled
+func (s *Server) runHealthChecks(ctx context.Context, wg *sync.WaitGroup) {
+	for _, p := range s.proxies() {
+		if p.origin.HealthCheck == nil {
+			continue
+		}
+
+		cfg := p.origin.HealthCheck.withDefaults()
+
+		for _, t := range p.targets {
+			p.setTargetHealth(t, t.healthy())
+
+			wg.Add(1)
+
+			go func(p *proxy, t *target) {
+				defer wg.Done()
+				p.healthCheck(ctx, t, cfg)
+			}(p, t)
+		}
+	}
+}
+
+// healthCheck checks the target every interval until the context is canceled.  The target is
+// marked unhealthy after fall consecutive failures and healthy again after rise successes.
+func (p *proxy) healthCheck(ctx context.Context, t *target, cfg HealthCheckConfig) {
+	logger := p.logger.With(zap.String("target", t.name))
+	ticker := time.NewTicker(cfg.Interval)
+
+	defer ticker.Stop()
+
+	var successes, failures int
+
+	for {
+		err := p.checkTarget(ctx, t, cfg)
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil:
+			successes++
+			failures = 0
+
+			if successes == cfg.Rise && !t.healthy() {
+				logger.Info("origin target is healthy")
+				p.setTargetHealth(t, true)
+			}
+		default:
+			failures++
+			successes = 0
+
+			logger.Debug("origin target health check failed", zap.Error(err))
+
+			if failures == cfg.Fall && t.healthy() {
+				logger.Warn("origin target is unhealthy", zap.Error(err))
+				p.setTargetHealth(t, false)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkTarget makes a single health check request to the target
+func (p *proxy) checkTarget(ctx context.Context, t *target, cfg HealthCheckConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	ref, err := url.Parse(cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	u := *t.url
+	u.Path, u.RawPath = joinURLPath(t.url, ref)
+	u.RawQuery = ref.RawQuery
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Host = t.host()
+	req.Header.Set("User-Agent", "tucson-health-check")
+
+	// health checks bypass the target metrics, they aren't user requests
+	resp, err := p.healthTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	_, _ = io.CopyN(io.Discard, resp.Body, healthCheckDrainLimit)
+
+	if !cfg.expected(resp.StatusCode) {
+		return fmt.Errorf("unexpected health check status %d", resp.StatusCode) //nolint:goerr113
+	}
+
+	return nil
+}
+
+// setTargetHealth records the health of the target
+func (p *proxy) setTargetHealth(t *target, healthy bool) {
+	unhealthy, gauge := int32(1), 0.0
+	if healthy {
+		unhealthy, gauge = 0, 1
+	}
+
+	atomic.StoreInt32(&t.unhealthy, unhealthy)
+	p.metrics.targetHealthy.WithLabelValues(p.origin.name, t.name).Set(gauge)
+}
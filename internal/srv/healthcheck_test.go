@@ -0,0 +1,205 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckExpected(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		expected int
+		code     int
+		want     bool
+	}{
+		{name: "ok", code: http.StatusOK, want: true},
+		{name: "redirect", code: http.StatusFound, want: true},
+		{name: "not found", code: http.StatusNotFound, want: false},
+		{name: "server error", code: http.StatusServiceUnavailable, want: false},
+		{name: "expected status", expected: http.StatusNoContent, code: http.StatusNoContent, want: true},
+		{name: "unexpected status", expected: http.StatusNoContent, code: http.StatusOK, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &HealthCheckConfig{ExpectedStatus: tc.expected}
+			assert.Equal(t, tc.want, cfg.expected(tc.code))
+		})
+	}
+}
+
+// newHealthBackend returns a backend whose /health endpoint fails while down is set
+func newHealthBackend(t *testing.T, name string, down *int32) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && atomic.LoadInt32(down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = io.WriteString(w, name)
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func readiness(t *testing.T, ts *httptest.Server) (int, readinessStatus) {
+	t.Helper()
+
+	resp, err := http.Get(ts.URL + "/healthz/readiness")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	status := readinessStatus{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+
+	return resp.StatusCode, status
+}
+
+func TestHealthChecks(t *testing.T) {
+	var aDown, bDown int32
+
+	a := newHealthBackend(t, "a", &aDown)
+	b := newHealthBackend(t, "b", &bDown)
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {
+			Targets: []Target{{URL: a.URL}, {URL: b.URL}},
+			HealthCheck: &HealthCheckConfig{
+				Path:     "/health",
+				Interval: 10 * time.Millisecond,
+				Rise:     1,
+				Fall:     2,
+			},
+		},
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+
+	s.runHealthChecks(ctx, &wg)
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	targets := s.defaultOrigin.proxy.targets
+
+	code, status := readiness(t, ts)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "UP", status.Status)
+
+	// a failing target is taken out of rotation
+	atomic.StoreInt32(&aDown, 1)
+	require.Eventually(t, func() bool { return !targets[0].healthy() }, time.Second, 5*time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(ts.URL + "/")
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, "b", string(body))
+	}
+
+	code, status = readiness(t, ts)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "DOWN", status.Origins["default"].Targets[targets[0].name])
+
+	// without healthy targets the origin is down
+	atomic.StoreInt32(&bDown, 1)
+	require.Eventually(t, func() bool { return !targets[1].healthy() }, time.Second, 5*time.Millisecond)
+
+	resp, err := http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	code, status = readiness(t, ts)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "DOWN", status.Status)
+
+	// and back
+	atomic.StoreInt32(&aDown, 0)
+	require.Eventually(t, func() bool { return targets[0].healthy() }, time.Second, 5*time.Millisecond)
+
+	code, _ = readiness(t, ts)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadiness(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		critical   bool
+		down       []string
+		wantStatus int
+	}{
+		{
+			name:       "all up",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "one origin down",
+			down:       []string{"api"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "critical origin down",
+			critical:   true,
+			down:       []string{"api"},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "every origin down",
+			down:       []string{"api", "default"},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, ts := newTestTucson(t, map[string]*Origin{
+				"api":     {BaseUrl: "http://127.0.0.1:1", Critical: tc.critical},
+				"default": {BaseUrl: "http://127.0.0.1:2"},
+			}, nil)
+
+			down := map[string]bool{}
+
+			for _, name := range tc.down {
+				down[name] = true
+
+				for _, target := range s.origins[name].proxy.targets {
+					atomic.StoreInt32(&target.unhealthy, 1)
+				}
+			}
+
+			code, status := readiness(t, ts)
+			assert.Equal(t, tc.wantStatus, code)
+
+			for _, name := range []string{"api", "default"} {
+				want := "UP"
+				if down[name] {
+					want = "DOWN"
+				}
+
+				assert.Equal(t, want, status.Origins[name].Status, name)
+			}
+		})
+	}
+}
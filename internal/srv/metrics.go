@@ -0,0 +1,164 @@
+package srv
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "tucson"
+
+// metrics holds the tucson specific prometheus collectors
+type metrics struct {
+	csrfRejected         *prometheus.CounterVec
+	upgradedConnections  *prometheus.CounterVec
+	upgradedActive       *prometheus.GaugeVec
+	targetRequests       *prometheus.CounterVec
+	targetDuration       *prometheus.HistogramVec
+	targetActive         *prometheus.GaugeVec
+	targetHealthy        *prometheus.GaugeVec
+	circuitState         *prometheus.GaugeVec
+	circuitRejected      *prometheus.CounterVec
+	retries              *prometheus.CounterVec
+	retryBudgetExhausted *prometheus.CounterVec
+	proxyErrors          *prometheus.CounterVec
+	mirrorRequests       *prometheus.CounterVec
+	mirrorDropped        *prometheus.CounterVec
+	mirrorDuration       *prometheus.HistogramVec
+	splitRequests        *prometheus.CounterVec
+	cacheRequests        *prometheus.CounterVec
+	cacheSize            *prometheus.GaugeVec
+	compressionResponses *prometheus.CounterVec
+	requestsSpooled      *prometheus.CounterVec
+}
+
+// newMetrics creates the tucson collectors and registers them with the given registry
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		csrfRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "csrf_rejected_total",
+			Help:      "Number of state-changing requests rejected by CSRF protection.",
+		}, []string{"origin", "reason"}),
+		upgradedConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upgraded_connections_total",
+			Help:      "Number of connections upgraded to another protocol, ie. websockets.",
+		}, []string{"origin", "protocol"}),
+		upgradedActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upgraded_connections_active",
+			Help:      "Number of currently open upgraded connections.",
+		}, []string{"origin", "protocol"}),
+		targetRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "target_requests_total",
+			Help:      "Number of requests sent to each origin target by response code, error if no response was received.",
+		}, []string{"origin", "target", "code"}),
+		targetDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "target_response_header_seconds",
+			Help:      "Time until the response headers were received from each origin target.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"origin", "target"}),
+		targetActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "target_active_requests",
+			Help:      "Number of requests in flight to each origin target.",
+		}, []string{"origin", "target"}),
+		targetHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "target_healthy",
+			Help:      "Whether an origin target passes its health checks (1) or not (0).",
+		}, []string{"origin", "target"}),
+		circuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breakers, 0 closed, 1 half-open and 2 open.  The target is empty for the origin breaker.",
+		}, []string{"origin", "target"}),
+		circuitRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_rejected_total",
+			Help:      "Number of requests rejected because a circuit breaker was open.",
+		}, []string{"origin", "target"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "retries_total",
+			Help:      "Number of requests to origins that were retried by the condition that triggered the retry.",
+		}, []string{"origin", "reason"}),
+		retryBudgetExhausted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "retry_budget_exhausted_total",
+			Help:      "Number of retries skipped because the retry budget of the origin was used up.",
+		}, []string{"origin"}),
+		proxyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "proxy_errors_total",
+			Help:      "Number of requests that failed in the proxy by error class and returned status code.",
+		}, []string{"origin", "class", "code"}),
+		mirrorRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mirror_requests_total",
+			Help:      "Number of requests mirrored by whether the mirror returned the same status as the origin.",
+		}, []string{"origin", "mirror", "status_match"}),
+		mirrorDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mirror_dropped_total",
+			Help:      "Number of sampled requests that weren't mirrored, because of their body or too many mirror requests in flight.",
+		}, []string{"origin", "mirror", "reason"}),
+		mirrorDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "mirror_duration_seconds",
+			Help:      "Duration of mirrored requests to the origin (primary) and to the mirror.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"origin", "mirror", "role"}),
+		splitRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "split_requests_total",
+			Help:      "Number of requests of split matchers by the origin they were sent to and why it was picked (override, sticky or weight).",
+		}, []string{"matcher", "origin", "reason"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_requests_total",
+			Help:      "Number of requests to caching origins by cache status (hit, miss, stale, revalidated or bypass).",
+		}, []string{"origin", "status"}),
+		cacheSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_size_bytes",
+			Help:      "Size of the responses stored in the cache of each origin.",
+		}, []string{"origin"}),
+		compressionResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "compression_responses_total",
+			Help:      "Number of responses compressed for clients or decompressed from the origin, by encoding.",
+		}, []string{"origin", "encoding", "direction"}),
+		requestsSpooled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_spooled_total",
+			Help:      "Number of request bodies read before sending them to the origin, by where they were stored.",
+		}, []string{"origin", "store"}),
+	}
+
+	reg.MustRegister(
+		m.csrfRejected,
+		m.upgradedConnections,
+		m.upgradedActive,
+		m.targetRequests,
+		m.targetDuration,
+		m.targetActive,
+		m.targetHealthy,
+		m.circuitState,
+		m.circuitRejected,
+		m.retries,
+		m.retryBudgetExhausted,
+		m.proxyErrors,
+		m.mirrorRequests,
+		m.mirrorDropped,
+		m.mirrorDuration,
+		m.splitRequests,
+		m.cacheRequests,
+		m.cacheSize,
+		m.compressionResponses,
+		m.requestsSpooled,
+	)
+
+	return m
+}
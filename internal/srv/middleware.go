@@ -3,41 +3,168 @@ package srv
 import (
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/lestrrat-go/jwx/jwt"
+	"go.uber.org/zap"
 )
 
 func (s *Server) Authenticator(ja *jwtauth.JWTAuth) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
-			tokenCookie, err := r.Cookie("jwt")
-			if err != nil {
-				s.logger.Debug("token not found in cookies")
-				http.Redirect(w, r, "/auth/login", http.StatusFound)
+			tokenString := tokenFromRequest(r)
+			if tokenString == "" {
+				s.logger.Debug("token not found in cookies or headers")
+				loginRedirect(w, r)
 				return
 			}
 
-			token, err := VerifyToken(ja, tokenCookie.Value)
+			token, err := VerifyToken(ja, tokenString)
 			if err != nil {
 				s.logger.Debug("error validating token")
-				http.Redirect(w, r, "/auth/login", http.StatusFound)
+				loginRedirect(w, r)
 				return
 			}
 
 			if token == nil {
 				s.logger.Debug("token is nil")
-				http.Redirect(w, r, "/auth/login", http.StatusFound)
+				loginRedirect(w, r)
 				return
 			}
 
 			if jwt.Validate(token) != nil {
 				s.logger.Debug("token is not valid")
-				http.Redirect(w, r, "/auth/login", http.StatusFound)
+				loginRedirect(w, r)
 				return
 			}
 
 			// Token is authenticated, pass it through
+			next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(r.Context(), token, nil)))
+		}
+
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// OptionalAuthenticator validates the session cookie or bearer token if one is present and
+// passes the identity along.  Anonymous requests and requests with invalid tokens pass through
+// without an identity.
+func (s *Server) OptionalAuthenticator(ja *jwtauth.JWTAuth) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			tokenString := tokenFromRequest(r)
+			if tokenString == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, err := VerifyToken(ja, tokenString)
+			if err != nil {
+				s.logger.Debug("ignoring invalid token for optional authentication", zap.Error(err))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(r.Context(), token, nil)))
+		}
+
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// tokenFromRequest returns the session token from the Authorization header or the
+// session cookie
+func tokenFromRequest(r *http.Request) string {
+	if t := jwtauth.TokenFromHeader(r); t != "" {
+		return t
+	}
+
+	return jwtauth.TokenFromCookie(r)
+}
+
+// loginRedirect sends the user through the login flow, returning to the current page afterwards
+func loginRedirect(w http.ResponseWriter, r *http.Request) {
+	loginRedirectWith(w, r, url.Values{})
+}
+
+// loginRedirectWith sends the user through the login flow with additional login parameters
+func loginRedirectWith(w http.ResponseWriter, r *http.Request, q url.Values) {
+	// grpc clients can't follow the login flow
+	if isGRPCRequest(r) {
+		writeGRPCError(w, grpcCodeUnauthenticated, "authentication required")
+		return
+	}
+
+	q.Set(redirectParam, r.URL.RequestURI())
+
+	http.Redirect(w, r, "/auth/login?"+q.Encode(), http.StatusFound)
+}
+
+// stepUp requires the session to satisfy the authentication age and context class of the
+// matcher.  Sessions that fall short are sent back through the login flow with max_age and
+// acr_values so the identity provider re-authenticates the user.  A new session that still
+// falls short after the login flow is forbidden instead of being sent around again.
+func (s *Server) stepUp(m *Matcher) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			q := url.Values{}
+
+			if m.MaxAuthAge > 0 {
+				q.Set("max_age", strconv.Itoa(int(m.MaxAuthAge.Seconds())))
+			}
+
+			if len(m.RequiredAcr) > 0 {
+				q.Set("acr_values", strings.Join(m.RequiredAcr, " "))
+			}
+
+			token, claims, err := jwtauth.FromContext(r.Context())
+			if err != nil || token == nil {
+				s.logger.Debug("step-up required for anonymous request")
+				loginRedirectWith(w, r, q)
+				return
+			}
+
+			// the cookie is scoped to the path that required step-up, the login flow returns to it
+			// and it isn't sent along once the user navigates elsewhere
+			path := r.URL.EscapedPath()
+			if path == "" {
+				path = "/"
+			}
+
+			if reason := stepUpReason(m, claims, time.Now()); reason != "" {
+				// the cookie names the session that was sent to step up, a different session
+				// means the user logged in again without satisfying the matcher
+				if c, err := r.Cookie(stepUpCookie); err == nil && c.Value != token.JwtID() {
+					s.logger.Info("step-up authentication failed",
+						zap.String("reason", reason),
+						zap.String("subject", token.Subject()),
+						zap.String("req.url", r.URL.String()),
+					)
+					addPathCookie(w, stepUpCookie, "", path, -time.Hour)
+					stepUpForbidden(w, r)
+
+					return
+				}
+
+				s.logger.Debug("step-up authentication required",
+					zap.String("reason", reason),
+					zap.String("subject", token.Subject()),
+					zap.String("req.url", r.URL.String()),
+				)
+				addPathCookie(w, stepUpCookie, token.JwtID(), path, redirectCookieTTL)
+				loginRedirectWith(w, r, q)
+
+				return
+			}
+
+			if _, err := r.Cookie(stepUpCookie); err == nil {
+				addPathCookie(w, stepUpCookie, "", path, -time.Hour)
+			}
+
 			next.ServeHTTP(w, r)
 		}
 
@@ -45,6 +172,119 @@ func (s *Server) Authenticator(ja *jwtauth.JWTAuth) func(http.Handler) http.Hand
 	}
 }
 
+// stepUpForbidden rejects a request whose session couldn't be stepped up
+func stepUpForbidden(w http.ResponseWriter, r *http.Request) {
+	if isGRPCRequest(r) {
+		writeGRPCError(w, grpcCodePermissionDenied, "step-up authentication failed")
+		return
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+}
+
+// stepUpReason returns why the session claims don't satisfy the matcher, or an empty
+// string if they do
+func stepUpReason(m *Matcher, claims map[string]interface{}, now time.Time) string {
+	if m.MaxAuthAge > 0 {
+		authTime, ok := claims["auth_time"].(float64)
+		if !ok || now.Sub(time.Unix(int64(authTime), 0)) > m.MaxAuthAge {
+			return "max_auth_age"
+		}
+	}
+
+	if len(m.RequiredAcr) == 0 {
+		return ""
+	}
+
+	methods := []string{}
+	if acr, ok := claims["acr"].(string); ok {
+		methods = append(methods, acr)
+	}
+
+	if amr, ok := claims["amr"].([]interface{}); ok {
+		for _, v := range amr {
+			if s, ok := v.(string); ok {
+				methods = append(methods, s)
+			}
+		}
+	}
+
+	for _, required := range m.RequiredAcr {
+		for _, method := range methods {
+			if method == required {
+				return ""
+			}
+		}
+	}
+
+	return "required_acr"
+}
+
+// authPolicy returns middleware that decides per request whether authentication is enforced.
+// Protected paths always require authentication, public paths bypass it and everything else
+// follows the origin configuration.  nil is returned if authentication is never required.
+func (s *Server) authPolicy(ja *jwtauth.JWTAuth, o *Origin, m *Matcher) (func(http.Handler) http.Handler, error) {
+	var mPublic, mProtected []string
+	if m != nil {
+		mPublic, mProtected = m.PublicPaths, m.ProtectedPaths
+	}
+
+	public, err := newPathSet(o.PublicPaths, mPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := newPathSet(o.ProtectedPaths, mProtected)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := o.authMode()
+
+	// step-up matchers always require a session
+	stepUp := m != nil && m.requiresStepUp()
+	if stepUp {
+		mode = authRequired
+	}
+
+	if mode == "" && protected == nil {
+		return nil, nil
+	}
+
+	authenticator := s.Authenticator(ja)
+	optional := s.OptionalAuthenticator(ja)
+
+	return func(next http.Handler) http.Handler {
+		inner := next
+		if stepUp {
+			inner = s.stepUp(m)(next)
+		}
+
+		authed := authenticator(s.sessionCheck(o, true)(inner))
+		maybeAuthed := optional(s.sessionCheck(o, false)(next))
+
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			paths := policyPaths(r)
+
+			switch {
+			case protected.matchAny(paths):
+				authed.ServeHTTP(w, r)
+			case public.matchAll(paths):
+				s.logger.Debug("public path, skipping authentication", zap.String("req.url", r.URL.String()))
+				next.ServeHTTP(w, r)
+			case mode == authRequired:
+				authed.ServeHTTP(w, r)
+			case mode == authOptional:
+				maybeAuthed.ServeHTTP(w, r)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		}
+
+		return http.HandlerFunc(hfn)
+	}, nil
+}
+
 func VerifyToken(ja *jwtauth.JWTAuth, tokenString string) (jwt.Token, error) {
 	// Decode & verify the token
 	token, err := ja.Decode(tokenString)
@@ -0,0 +1,325 @@
+package srv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSigningKey = "secret"
+
+func newTestSessionToken(t *testing.T, s *Server, sess *session) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.issueSession(rec, sess))
+
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	return cookies[0].Value
+}
+
+func newTestSession(sub string) *session {
+	now := time.Now()
+
+	return &session{ID: sub, Subject: sub, Start: now, LastSeen: now}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		origin    *Origin
+		matcher   *Matcher
+		path      string
+		cookie    bool
+		bearer    bool
+		wantCode  int
+		wantUser  string
+		wantNoMid bool
+	}{
+		{
+			name:      "no auth",
+			origin:    &Origin{},
+			path:      "/",
+			wantNoMid: true,
+		},
+		{
+			name:     "required without token",
+			origin:   &Origin{Oidc: true},
+			path:     "/foo?bar=baz",
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "required with cookie",
+			origin:   &Origin{Auth: "required"},
+			path:     "/foo",
+			cookie:   true,
+			wantCode: http.StatusOK,
+			wantUser: "user@example.com",
+		},
+		{
+			name:     "required with bearer",
+			origin:   &Origin{Oidc: true},
+			path:     "/foo",
+			bearer:   true,
+			wantCode: http.StatusOK,
+			wantUser: "user@example.com",
+		},
+		{
+			name:     "public path",
+			origin:   &Origin{Oidc: true, PublicPaths: []string{"/robots.txt"}},
+			path:     "/robots.txt",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "matcher protected path overrides origin public path",
+			origin:   &Origin{Oidc: true, PublicPaths: []string{"/static/*"}},
+			matcher:  &Matcher{ProtectedPaths: []string{"/static/private/*"}},
+			path:     "/static/private/secret.txt",
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "public path with dot-segments",
+			origin:   &Origin{Oidc: true, PublicPaths: []string{"/public/*"}},
+			path:     "/public/../private",
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "public path with encoded dot-segments",
+			origin:   &Origin{Oidc: true, PublicPaths: []string{"/public/*"}},
+			path:     "/public/%2e%2e/private",
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "protected path with dot-segments",
+			origin:   &Origin{ProtectedPaths: []string{"/admin/*"}},
+			path:     "/static/../admin/users",
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "protected path in open origin",
+			origin:   &Origin{ProtectedPaths: []string{"/admin/*"}},
+			path:     "/admin/users",
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "unknown auth mode",
+			origin:   &Origin{Auth: "requried"},
+			path:     "/",
+			wantCode: http.StatusFound,
+		},
+		{
+			name:      "no auth mode",
+			origin:    &Origin{Auth: authNone},
+			path:      "/",
+			wantNoMid: true,
+		},
+		{
+			name:     "optional anonymous",
+			origin:   &Origin{Auth: "optional"},
+			path:     "/",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "optional with cookie",
+			origin:   &Origin{Auth: "optional"},
+			path:     "/",
+			cookie:   true,
+			wantCode: http.StatusOK,
+			wantUser: "user@example.com",
+		},
+	}
+
+	ja := jwtauth.New("HS256", []byte(testSigningKey), nil)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(WithSigningKey(testSigningKey))
+
+			mw, err := s.authPolicy(ja, tt.origin, tt.matcher)
+			require.NoError(t, err)
+
+			if tt.wantNoMid {
+				assert.Nil(t, mw)
+				return
+			}
+
+			require.NotNil(t, mw)
+
+			var gotUser string
+
+			h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hdr := http.Header{}
+				setIdentityHeaders(hdr, r)
+				gotUser = hdr.Get("X-Forwarded-User")
+
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+
+			if tt.cookie {
+				req.AddCookie(&http.Cookie{Name: "jwt", Value: newTestSessionToken(t, s, newTestSession("user@example.com"))})
+			}
+
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer "+newTestSessionToken(t, s, newTestSession("user@example.com")))
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantCode, rec.Code)
+			assert.Equal(t, tt.wantUser, gotUser)
+
+			if tt.wantCode == http.StatusFound {
+				assert.Contains(t, rec.Header().Get("Location"), "/auth/login?rd=")
+			}
+		})
+	}
+}
+
+func TestStepUpReason(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		matcher *Matcher
+		claims  map[string]interface{}
+		want    string
+	}{
+		{
+			name:    "fresh session",
+			matcher: &Matcher{MaxAuthAge: 5 * time.Minute},
+			claims:  map[string]interface{}{"auth_time": float64(now.Add(-time.Minute).Unix())},
+			want:    "",
+		},
+		{
+			name:    "stale session",
+			matcher: &Matcher{MaxAuthAge: 5 * time.Minute},
+			claims:  map[string]interface{}{"auth_time": float64(now.Add(-time.Hour).Unix())},
+			want:    "max_auth_age",
+		},
+		{
+			name:    "missing auth time",
+			matcher: &Matcher{MaxAuthAge: 5 * time.Minute},
+			claims:  map[string]interface{}{},
+			want:    "max_auth_age",
+		},
+		{
+			name:    "acr satisfied",
+			matcher: &Matcher{RequiredAcr: []string{"phr", "mfa"}},
+			claims:  map[string]interface{}{"acr": "phr"},
+			want:    "",
+		},
+		{
+			name:    "amr satisfied",
+			matcher: &Matcher{RequiredAcr: []string{"mfa"}},
+			claims:  map[string]interface{}{"acr": "1", "amr": []interface{}{"pwd", "mfa"}},
+			want:    "",
+		},
+		{
+			name:    "acr not satisfied",
+			matcher: &Matcher{RequiredAcr: []string{"mfa"}},
+			claims:  map[string]interface{}{"acr": "1", "amr": []interface{}{"pwd"}},
+			want:    "required_acr",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, stepUpReason(tt.matcher, tt.claims, now))
+		})
+	}
+}
+
+func TestStepUpLoop(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Auth: authRequired},
+	}, []*Matcher{
+		{Path: "/admin/*", Origin: "default", RequiredAcr: []string{"mfa"}},
+	})
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	weak, stepped := newTestSession("first"), newTestSession("second")
+	strong := newTestSession("third")
+	strong.Acr = "mfa"
+
+	tests := []struct {
+		name       string
+		session    *session
+		stepUp     string
+		wantCode   int
+		wantCookie string
+	}{
+		{
+			name:       "weak session is sent to step up",
+			session:    weak,
+			wantCode:   http.StatusFound,
+			wantCookie: "first",
+		},
+		{
+			name:       "same session that didn't finish the login flow",
+			session:    weak,
+			stepUp:     "first",
+			wantCode:   http.StatusFound,
+			wantCookie: "first",
+		},
+		{
+			name:     "new session that still falls short",
+			session:  stepped,
+			stepUp:   "first",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "new session that satisfies the matcher",
+			session:  strong,
+			stepUp:   "first",
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/admin/users", nil)
+			require.NoError(t, err)
+
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: newTestSessionToken(t, s, tt.session)})
+			if tt.stepUp != "" {
+				req.AddCookie(&http.Cookie{Name: stepUpCookie, Value: tt.stepUp})
+			}
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+
+			got := ""
+			for _, c := range resp.Cookies() {
+				if c.Name == stepUpCookie {
+					got = c.Value
+
+					// set and cleared for the path that required step-up only
+					assert.Equal(t, "/admin/users", c.Path)
+				}
+			}
+
+			assert.Equal(t, tt.wantCookie, got)
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMirrorMaxBody     = 64 * 1024
+	defaultMirrorTimeout     = 30 * time.Second
+	defaultMirrorMaxInFlight = 100
+
+	mirrorDroppedBody     = "body"
+	mirrorDroppedInFlight = "in_flight"
+)
+
+// MirrorConfig sends a sample of the requests to another origin as well, the responses of the
+// mirror are discarded
+type MirrorConfig struct {
+	Origin      string        `mapstructure:"origin"`
+	Percent     *float64      `mapstructure:"percent"`
+	MaxBody     int64         `mapstructure:"max_body"`
+	Timeout     time.Duration `mapstructure:"timeout"`
+	MaxInFlight int           `mapstructure:"max_in_flight"`
+}
+
+// withDefaults returns a copy of the config with unset values replaced by the defaults
+func (c *MirrorConfig) withDefaults() MirrorConfig {
+	cfg := *c
+
+	// an explicit 0 pauses the mirror
+	percent := 100.0
+	if cfg.Percent != nil {
+		percent = math.Max(0, math.Min(100, *cfg.Percent))
+	}
+
+	cfg.Percent = &percent
+
+	if cfg.MaxBody == 0 {
+		cfg.MaxBody = defaultMirrorMaxBody
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultMirrorTimeout
+	}
+
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = defaultMirrorMaxInFlight
+	}
+
+	return cfg
+}
+
+// mirror copies requests of an origin to a mirror origin
+type mirror struct {
+	cfg      MirrorConfig
+	origin   string
+	target   *Origin
+	logger   *zap.Logger
+	metrics  *metrics
+	inFlight chan struct{}
+}
+
+// newMirror returns the mirror of the matcher, or else of the origin, nil if there is none
+func (s *Server) newMirror(o *Origin, m *Matcher) (*mirror, error) {
+	c := o.Mirror
+	if m != nil && m.Mirror != nil {
+		c = m.Mirror
+	}
+
+	if c == nil || c.Origin == "" {
+		return nil, nil
+	}
+
+	target, ok := s.origins[c.Origin]
+	if !ok || target.proxy == nil {
+		return nil, fmt.Errorf("mirror origin %q not found", c.Origin) //nolint:goerr113
+	}
+
+	if target == o {
+		return nil, fmt.Errorf("origin %q can't mirror to itself", c.Origin) //nolint:goerr113
+	}
+
+	cfg := c.withDefaults()
+
+	return &mirror{
+		cfg:      cfg,
+		origin:   o.name,
+		target:   target,
+		logger:   s.logger.With(zap.String("origin", o.name), zap.String("mirror", target.name)),
+		metrics:  s.metrics,
+		inFlight: make(chan struct{}, cfg.MaxInFlight),
+	}, nil
+}
+
+// sampled returns true if the request should be mirrored
+func (mr *mirror) sampled(r *http.Request) bool {
+	if upgradeType(r.Header) != "" {
+		return false
+	}
+
+	percent := *mr.cfg.Percent
+
+	return percent >= 100 || rand.Float64()*100 < percent //nolint:gosec
+}
+
+// serve serves the request with next and sends a copy to the mirror.  The mirror runs in the
+// background on its own context, it never delays or fails the primary request.
+func (mr *mirror) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !mr.sampled(r) {
+		next(w, r)
+		return
+	}
+
+	body, ok := mr.bufferBody(r)
+	if !ok {
+		mr.metrics.mirrorDropped.WithLabelValues(mr.origin, mr.target.name, mirrorDroppedBody).Inc()
+		next(w, r)
+
+		return
+	}
+
+	select {
+	case mr.inFlight <- struct{}{}:
+	default:
+		mr.metrics.mirrorDropped.WithLabelValues(mr.origin, mr.target.name, mirrorDroppedInFlight).Inc()
+		next(w, r)
+
+		return
+	}
+
+	// the copy is made before the primary request starts so they don't share any state
+	ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, mr.cfg.Timeout)
+
+	req := r.Clone(ctx)
+	req.Body = http.NoBody
+
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	primary := make(chan int, 1)
+
+	go func() {
+		defer cancel()
+		mr.send(req, primary)
+	}()
+
+	ww, ok := w.(middleware.WrapResponseWriter)
+	if !ok {
+		ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	}
+
+	start := time.Now()
+
+	defer func() {
+		mr.metrics.mirrorDuration.WithLabelValues(mr.origin, mr.target.name, "primary").Observe(time.Since(start).Seconds())
+		primary <- responseStatus(ww.Status())
+	}()
+
+	next(ww, r)
+}
+
+// bufferBody reads the request body so it can be sent twice, bodies of unknown length or
+// larger than the limit aren't mirrored since buffering them would delay the request
+func (mr *mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true
+	}
+
+	if r.ContentLength < 0 || r.ContentLength > mr.cfg.MaxBody {
+		return nil, false
+	}
+
+	body := r.Body
+
+	buf, err := io.ReadAll(io.LimitReader(body, r.ContentLength))
+	if err != nil {
+		// the primary request gets the same error reading the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}
+
+		return nil, false
+	}
+
+	body.Close()
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+
+	return buf, true
+}
+
+// send sends the copy of the request to the mirror and compares the outcome with the
+// primary response
+func (mr *mirror) send(req *http.Request, primary <-chan int) {
+	defer func() { <-mr.inFlight }()
+
+	// the response copy panics with http.ErrAbortHandler if the mirror fails mid response,
+	// that mustn't take down the server
+	defer func() {
+		if err := recover(); err != nil && err != http.ErrAbortHandler { //nolint:errorlint,goerr113
+			mr.logger.Error("mirror request panicked", zap.Any("error", err))
+		}
+	}()
+
+	w := &discardResponseWriter{header: http.Header{}}
+	start := time.Now()
+
+	mr.target.proxy.proxyRequest(w, req)
+
+	mr.metrics.mirrorDuration.WithLabelValues(mr.origin, mr.target.name, "mirror").Observe(time.Since(start).Seconds())
+
+	status := responseStatus(w.status)
+
+	primaryStatus := <-primary
+	if status != primaryStatus {
+		mr.logger.Debug("mirror status differs", zap.Int("status", primaryStatus), zap.Int("mirror.status", status),
+			zap.String("req.url", req.URL.String()))
+	}
+
+	mr.metrics.mirrorRequests.WithLabelValues(mr.origin, mr.target.name, strconv.FormatBool(status == primaryStatus)).Inc()
+}
+
+// responseStatus returns the status of a response, a response without an explicit status is a 200
+func responseStatus(code int) int {
+	if code == 0 {
+		return http.StatusOK
+	}
+
+	return code
+}
+
+// detachedContext keeps the values of the parent context but not its cancellation, so the
+// mirror request outlives the primary request.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// discardResponseWriter records the status of the mirror response and discards the body
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+}
+
+func (w *discardResponseWriter) Flush() {}
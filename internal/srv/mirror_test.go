@@ -0,0 +1,211 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mirroredRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+// newTestMirror starts a mirror backend that reports the requests it gets
+func newTestMirror(t *testing.T, handler http.HandlerFunc) (*httptest.Server, <-chan mirroredRequest) {
+	t.Helper()
+
+	requests := make(chan mirroredRequest, 10)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- mirroredRequest{method: r.Method, path: r.URL.Path, body: string(body)}
+
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, requests
+}
+
+func TestMirror(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, "primary "+string(body))
+	}))
+	defer backend.Close()
+
+	shadow, requests := newTestMirror(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+		"shadow":  {BaseUrl: shadow.URL},
+	}, []*Matcher{
+		{Path: "/api/*", Origin: "default", StripPrefix: "/api", Mirror: &MirrorConfig{Origin: "shadow"}},
+	})
+
+	resp, err := http.Post(ts.URL+"/api/orders", "text/plain", strings.NewReader("order"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "primary order", string(body))
+
+	select {
+	case req := <-requests:
+		assert.Equal(t, mirroredRequest{method: http.MethodPost, path: "/orders", body: "order"}, req)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request wasn't mirrored")
+	}
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metrics.mirrorRequests.WithLabelValues("default", "shadow", "false")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// requests outside the matcher aren't mirrored
+	resp, err = http.Get(ts.URL + "/other")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected mirrored request %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirrorDoesNotDelayPrimary(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "primary")
+	}))
+	defer backend.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	shadow, requests := newTestMirror(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Mirror: &MirrorConfig{Origin: "shadow", MaxInFlight: 1}},
+		"shadow":  {BaseUrl: shadow.URL},
+	}, nil)
+
+	client := &http.Client{Timeout: time.Second}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	<-requests
+
+	// the second request is dropped while the first one is still in flight
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.mirrorDropped.WithLabelValues("default", "shadow", mirrorDroppedInFlight)))
+}
+
+func TestMirrorBodyLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	shadow, requests := newTestMirror(t, nil)
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Mirror: &MirrorConfig{Origin: "shadow", MaxBody: 4}},
+		"shadow":  {BaseUrl: shadow.URL},
+	}, nil)
+
+	resp, err := http.Post(ts.URL+"/", "text/plain", strings.NewReader("too large"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "too large", string(body))
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.mirrorDropped.WithLabelValues("default", "shadow", mirrorDroppedBody)))
+
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected mirrored request %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func percent(p float64) *float64 {
+	return &p
+}
+
+func TestMirrorConfig(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		origin      *MirrorConfig
+		matcher     *MirrorConfig
+		want        string
+		wantPercent float64
+		wantErr     bool
+	}{
+		{name: "none"},
+		{name: "origin", origin: &MirrorConfig{Origin: "shadow"}, want: "shadow", wantPercent: 100},
+		{name: "matcher overrides origin", origin: &MirrorConfig{Origin: "other"}, matcher: &MirrorConfig{Origin: "shadow"}, want: "shadow", wantPercent: 100},
+		{name: "percent", origin: &MirrorConfig{Origin: "shadow", Percent: percent(10)}, want: "shadow", wantPercent: 10},
+		{name: "paused", origin: &MirrorConfig{Origin: "shadow", Percent: percent(0)}, want: "shadow", wantPercent: 0},
+		{name: "more than everything", origin: &MirrorConfig{Origin: "shadow", Percent: percent(200)}, want: "shadow", wantPercent: 100},
+		{name: "unknown origin", origin: &MirrorConfig{Origin: "missing"}, wantErr: true},
+		{name: "itself", origin: &MirrorConfig{Origin: "default"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Mirror: tc.origin},
+				"shadow":  {BaseUrl: "http://localhost"},
+				"other":   {BaseUrl: "http://localhost"},
+			}, nil)
+
+			mr, err := s.newMirror(s.origins["default"], &Matcher{Mirror: tc.matcher})
+
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			if tc.want == "" {
+				assert.Nil(t, mr)
+				return
+			}
+
+			require.NotNil(t, mr)
+			assert.Equal(t, tc.want, mr.target.name)
+			assert.Equal(t, tc.wantPercent, *mr.cfg.Percent)
+
+			if tc.wantPercent == 0 {
+				assert.False(t, mr.sampled(httptest.NewRequest(http.MethodGet, "/", nil)))
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package srv
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// pathSet matches request paths against a list of patterns.  Patterns are chi router
+// patterns (ie. /hooks/{id} or /static/*) unless they contain glob characters that
+// chi doesn't support, in which case they are matched with path.Match (ie. /*.css)
+type pathSet struct {
+	mux   *chi.Mux
+	globs []string
+}
+
+// newPathSet builds a pathSet from the given patterns, it returns nil if there are no patterns
+func newPathSet(patterns ...[]string) (*pathSet, error) {
+	var p *pathSet
+
+	for _, list := range patterns {
+		for _, pattern := range list {
+			if !strings.HasPrefix(pattern, "/") {
+				return nil, fmt.Errorf("path pattern %q must start with /", pattern) //nolint:goerr113
+			}
+
+			if p == nil {
+				p = &pathSet{mux: chi.NewRouter()}
+			}
+
+			if isGlob(pattern) {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, err
+				}
+
+				p.globs = append(p.globs, pattern)
+
+				continue
+			}
+
+			if err := p.handle(pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// handle adds the chi pattern to the set, chi panics on patterns it can't parse
+func (p *pathSet) handle(pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid path pattern %q: %v", pattern, r) //nolint:goerr113
+		}
+	}()
+
+	p.mux.Handle(pattern, http.NotFoundHandler())
+
+	return nil
+}
+
+// match returns true if the path matches any of the patterns in the set
+func (p *pathSet) match(urlPath string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, g := range p.globs {
+		if ok, _ := path.Match(g, urlPath); ok {
+			return true
+		}
+	}
+
+	if len(p.mux.Routes()) == 0 {
+		return false
+	}
+
+	return p.mux.Match(chi.NewRouteContext(), http.MethodGet, urlPath)
+}
+
+// matchAny returns true if any of the paths matches the set
+func (p *pathSet) matchAny(paths []string) bool {
+	for _, urlPath := range paths {
+		if p.match(urlPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAll returns true if all of the paths match the set
+func (p *pathSet) matchAll(paths []string) bool {
+	for _, urlPath := range paths {
+		if !p.match(urlPath) {
+			return false
+		}
+	}
+
+	return p != nil
+}
+
+// policyPaths returns the cleaned decoded and escaped paths of the request.  Path policies
+// are checked against both, so dot-segments (ie. /public/../admin) or encoded characters
+// can't make a path look public when the origin resolves it to another one.
+func policyPaths(r *http.Request) []string {
+	return []string{cleanPath(r.URL.Path), cleanPath(r.URL.EscapedPath())}
+}
+
+// cleanPath resolves dot-segments and duplicate slashes, keeping a trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// isGlob returns true if the pattern can't be handled by the chi router.  chi only
+// allows a wildcard as the last character of a pattern.
+func isGlob(pattern string) bool {
+	if strings.ContainsAny(pattern, "?[") {
+		return true
+	}
+
+	i := strings.Index(pattern, "*")
+
+	return i >= 0 && i != len(pattern)-1
+}
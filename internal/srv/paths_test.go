@@ -0,0 +1,82 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{
+			name:     "empty set",
+			patterns: nil,
+			path:     "/robots.txt",
+			want:     false,
+		},
+		{
+			name:     "exact chi pattern",
+			patterns: []string{"/robots.txt"},
+			path:     "/robots.txt",
+			want:     true,
+		},
+		{
+			name:     "chi wildcard",
+			patterns: []string{"/static/*"},
+			path:     "/static/js/app.js",
+			want:     true,
+		},
+		{
+			name:     "chi url param",
+			patterns: []string{"/hooks/{id}"},
+			path:     "/hooks/github",
+			want:     true,
+		},
+		{
+			name:     "chi url param extra segment",
+			patterns: []string{"/hooks/{id}"},
+			path:     "/hooks/github/extra",
+			want:     false,
+		},
+		{
+			name:     "glob",
+			patterns: []string{"/assets/*.css"},
+			path:     "/assets/site.css",
+			want:     true,
+		},
+		{
+			name:     "glob no match",
+			patterns: []string{"/assets/*.css"},
+			path:     "/assets/site.js",
+			want:     false,
+		},
+		{
+			name:     "mixed",
+			patterns: []string{"/healthz", "/*.ico"},
+			path:     "/favicon.ico",
+			want:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := newPathSet(tt.patterns)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.want, ps.match(tt.path))
+		})
+	}
+}
+
+func TestPathSetInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"/assets/[a-", "robots.txt", "*.css", "/hooks/{id:[}"} {
+		_, err := newPathSet([]string{pattern})
+		assert.Error(t, err, pattern)
+	}
+}
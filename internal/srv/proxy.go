@@ -2,62 +2,226 @@ package srv
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"io"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/jwtauth/v5"
 	"go.uber.org/zap"
 )
 
+const (
+	// defaultFlushInterval is how often streamed responses are flushed to the client,
+	// server-sent events and responses of unknown length are flushed immediately
+	defaultFlushInterval = 100 * time.Millisecond
+
+	// copyBufferSize is the size of the pooled buffers used to copy response bodies
+	copyBufferSize = 32 * 1024
+)
+
 var (
+	errNoTargetAvailable = errors.New("no origin target available")
+
 	sanitizeHeaders = []string{"www-authenticate", "server"}
+
+	// identityHeaders are set from the session token and are never passed through from clients
+	identityHeaders = []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Name", "X-Forwarded-Preferred-Username"}
 )
 
 type proxy struct {
-	origin *Origin
-	logger *zap.Logger
+	origin    *Origin
+	logger    *zap.Logger
+	metrics   *metrics
+	upgrades  *upgradeTracker
+	pages     *ErrorPages
+	targets   []*target
+	balancer  balancer
+	breaker   *breaker
+	transport http.RoundTripper
+	// healthTransport is the origin transport without the target metrics
+	healthTransport http.RoundTripper
+	rp              *httputil.ReverseProxy
 }
 
+// newProxy creates the proxy for an origin, it is created once and shared by all requests
+// so that connections to the origin are reused
 func (s *Server) newProxy(origin *Origin, logger *zap.Logger) *proxy {
-	return &proxy{
-		origin: origin,
-		logger: logger,
+	p := &proxy{
+		origin:   origin,
+		logger:   logger,
+		metrics:  s.metrics,
+		upgrades: s.upgrades,
+		pages:    s.errorPages,
+	}
+
+	for _, t := range origin.targets() {
+		target, err := newTarget(t)
+		if err != nil {
+			logger.Error("failed to parse origin target url, skipping target", zap.String("url", t.URL), zap.Error(err))
+			continue
+		}
+
+		p.targets = append(p.targets, target)
+	}
+
+	if len(p.targets) == 0 {
+		logger.Error("origin has no valid targets, requests to the origin will fail")
+	}
+
+	if origin.CircuitBreaker != nil {
+		cfg := origin.CircuitBreaker.withDefaults()
+
+		p.breaker = newBreaker(cfg, p.breakerChanged(""))
+		for _, t := range p.targets {
+			t.breaker = newBreaker(cfg, p.breakerChanged(t.name))
+		}
+	}
+
+	b, err := newBalancer(origin.LoadBalancer, p.targets)
+	if err != nil {
+		logger.Error("invalid load balancer, using round robin", zap.Error(err))
+		b = &roundRobin{targets: p.targets}
+	}
+
+	p.balancer = b
+	tr, err := origin.newTransport(logger, s.egressProxy)
+	if err != nil {
+		logger.Error("invalid origin transport, requests to the origin will fail", zap.Error(err))
+		tr = failingTransport{err: err}
 	}
+
+	p.healthTransport = tr
+	p.transport = &targetTransport{
+		next:    &timeoutTransport{next: p.healthTransport, timeouts: origin.timeouts()},
+		origin:  origin,
+		breaker: p.breaker,
+		metrics: s.metrics,
+	}
+
+	if origin.Retry != nil {
+		p.transport = newRetryTransport(p.transport, p, origin.Retry.withDefaults())
+	}
+
+	flushInterval := defaultFlushInterval
+	if origin.FlushInterval != 0 {
+		flushInterval = origin.FlushInterval
+	}
+
+	// grpc streams messages, they can't wait for a periodic flush
+	if origin.protocol() == protocolGRPC {
+		flushInterval = -1
+	}
+
+	p.rp = &httputil.ReverseProxy{
+		Director:       p.director,
+		Transport:      p.transport,
+		FlushInterval:  flushInterval,
+		BufferPool:     newBufferPool(copyBufferSize),
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.errorHandler,
+		ErrorLog:       zap.NewStdLog(logger),
+	}
+
+	return p
 }
 
 // proxyRequest proxies requests to a given backend
 func (p *proxy) proxyRequest(w http.ResponseWriter, r *http.Request) {
-	requestID, _ := uuid.NewUUID()
-	ctx := context.WithValue(r.Context(), "requestID", requestID.String())
+	ctx := r.Context()
 
-	logger := p.logger.With(
-		zap.String("req.url", r.URL.String()),
-		zap.String("http.method", r.Method),
-		zap.String("request.id", requestID.String()),
-	)
+	// track whether the response has started, so a late error doesn't try to write a status
+	if _, ok := w.(middleware.WrapResponseWriter); !ok {
+		w = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	}
 
-	u, err := url.Parse(p.origin.BaseUrl + r.URL.String())
-	if err != nil {
-		logger.Error("failed to parse backend url", zap.Error(err))
+	if len(p.targets) == 0 {
+		p.errorHandler(w, r, errInvalidOrigin)
+		return
 	}
 
-	logger.Debug("proxying request", zap.String("backend.url", u.String()))
+	// the target is reserved before the origin, a rejection must not take the probe of a
+	// half-open origin circuit
+	t := p.balancer.next(r.WithContext(ctx))
+	if t == nil {
+		if ok, wait := p.breaker.allow(); !ok {
+			p.rejectOpenCircuit(w, r.WithContext(ctx), "", wait)
+			return
+		}
 
-	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), r.Body)
-	if err != nil {
-		logger.Error("failed to generate backend request", zap.Error(err))
+		p.breaker.release()
+		p.errorHandler(w, r.WithContext(ctx), errNoTargetAvailable)
+
+		return
+	}
+
+	if ok, wait := t.breaker.allow(); !ok {
+		p.rejectOpenCircuit(w, r.WithContext(ctx), t.name, wait)
+		return
+	}
+
+	if ok, wait := p.breaker.allow(); !ok {
+		t.breaker.release()
+		p.rejectOpenCircuit(w, r.WithContext(ctx), "", wait)
+
+		return
+	}
+
+	ctx = withInboundURL(withTarget(ctx, t), r.URL)
+
+	if protocol := upgradeType(r.Header); protocol != "" {
+		p.proxyUpgrade(w, r.WithContext(ctx), protocol)
+		return
+	}
+
+	timeouts, ok := timeoutsFromContext(ctx)
+	if !ok {
+		timeouts = p.origin.timeouts()
 	}
 
-	// clone headers from request
-	// TODO sanitize headers for backend
-	req.Header = r.Header.Clone()
+	if timeouts.Total > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeouts.Total)
+		defer cancel()
+	}
+
+	p.rp.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// director rewrites the inbound request into the request to the backend
+func (p *proxy) director(req *http.Request) {
+	logger := p.requestLogger(req.Context(), req)
+	t := targetFromContext(req.Context())
 
-	// override headers
+	setTargetURL(req.URL, t.url)
+
+	// hop-by-hop headers only apply to the connection to tucson
+	removeHopHeaders(req.Header)
+
+	// the forwarding headers describe the inbound request, so set them before the host changes
+	p.setForwardedHeaders(req)
+
+	req.Host = t.host()
+
+	logger.Debug("proxying request", zap.String("backend.url", req.URL.String()))
+
+	setIdentityHeaders(req.Header, req)
+
+	// override headers, the Host header is special since go sends req.Host
 	for k, v := range p.origin.SetHeaders {
+		if strings.EqualFold(k, "host") {
+			req.Host = v
+			continue
+		}
+
 		req.Header.Set(k, v)
 	}
 
@@ -70,68 +234,294 @@ func (p *proxy) proxyRequest(w http.ResponseWriter, r *http.Request) {
 		logger.Debug("setting basic auth")
 		req.SetBasicAuth(p.origin.BasicAuth.Username, p.origin.BasicAuth.Password)
 	}
+}
+
+// setTargetURL points the request url at the target, joining the paths and queries
+func setTargetURL(u, target *url.URL) {
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path, u.RawPath = joinURLPath(target, u)
+
+	if target.RawQuery != "" && u.RawQuery != "" {
+		u.RawQuery = target.RawQuery + "&" + u.RawQuery
+	} else if target.RawQuery != "" {
+		u.RawQuery = target.RawQuery
+	}
+}
 
-	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	req.Header.Set("X-Forwarded-Proto", r.Proto)
+// modifyResponse sanitizes the backend response before it is returned to the client
+func (p *proxy) modifyResponse(resp *http.Response) error {
+	logger := p.requestLogger(resp.Request.Context(), resp.Request)
 
-	tr := &http.Transport{}
-	if p.origin.Insecure {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	for key := range resp.Header {
+		for _, k := range sanitizeHeaders {
+			if strings.EqualFold(k, key) {
+				logger.Debug("sanitizing header", zap.String("key", key), zap.Strings("value", resp.Header.Values(key)))
+				resp.Header.Del(key)
+			}
+		}
 	}
 
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-		Timeout:   180 * time.Second,
-		Transport: tr,
+	// trailers can only be sent with a chunked (or http/2) response
+	if len(resp.Trailer) > 0 {
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		logger.Warn("failed to proxy request to backend", zap.Error(err))
+	logger.Debug("returning response code", zap.Int("code", resp.StatusCode))
+
+	return nil
+}
 
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte("backend unavailable"))
+// errorHandler is called when the backend request fails before a response is returned, it
+// classifies the error and writes the matching error page
+func (p *proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	logger := p.requestLogger(r.Context(), r)
+	status, class := classifyError(r, err)
 
+	p.metrics.proxyErrors.WithLabelValues(p.origin.name, class, strconv.Itoa(status)).Inc()
+
+	switch class {
+	case errorClassClientClosed:
+		logger.Debug("client canceled request", zap.Error(err))
+	case errorClassCircuitOpen:
+		logger.Debug("circuit breaker is open, rejecting request")
+	case errorClassInvalidOrigin:
+		logger.Error("origin url is invalid, unable to proxy request")
+	case errorClassSpool:
+		logger.Error("failed to spool request body", zap.Error(err))
+	case errorClassBadRequest:
+		logger.Debug("failed to read request body", zap.Error(err))
+	case errorClassBodyTimeout:
+		logger.Debug("client took too long to send the request body")
+	default:
+		logger.Warn("failed to proxy request to backend", zap.String("error.class", class), zap.Int("code", status), zap.Error(err))
+	}
+
+	if headerWritten(w) {
+		logger.Debug("response already started, not writing error response", zap.String("error.class", class))
+		return
+	}
+
+	if isGRPCRequest(r) {
+		writeGRPCError(w, grpcCode(status), errorMessages[class])
 		return
 	}
-	defer resp.Body.Close()
 
-	p.cloneHeaders(ctx, w, resp)
+	// nobody is left to read the body, the status is only for the access log
+	if status == statusClientClosedRequest {
+		w.WriteHeader(status)
+		return
+	}
 
-	logger.Debug("returning response code", zap.Int("code", resp.StatusCode))
+	// the rest of the body may never come, so the connection can't be used for another request
+	if class == errorClassBodyTimeout {
+		w.Header().Set("Connection", "close")
+	}
 
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	p.pages.write(w, r, errorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Class:      class,
+		Message:    errorMessages[class],
+		RequestID:  requestID(r.Context()),
+		Origin:     p.origin.name,
+	})
 }
 
-func (p *proxy) cloneHeaders(ctx context.Context, w http.ResponseWriter, resp *http.Response) {
-	requestID, ok := ctx.Value("requestID").(string)
-	if !ok {
-		requestID = ""
+// rejectOpenCircuit fails a request fast while the circuit of the origin or target is open
+func (p *proxy) rejectOpenCircuit(w http.ResponseWriter, r *http.Request, target string, wait time.Duration) {
+	p.metrics.circuitRejected.WithLabelValues(p.origin.name, target).Inc()
+
+	w.Header().Set("Retry-After", retryAfter(wait))
+	p.errorHandler(w, r, errCircuitOpen)
+}
+
+// breakerChanged returns the callback logging and exporting circuit state changes, the
+// target is empty for the circuit of the whole origin
+func (p *proxy) breakerChanged(target string) func(from, to breakerState) {
+	p.metrics.circuitState.WithLabelValues(p.origin.name, target).Set(float64(breakerClosed))
+
+	return func(from, to breakerState) {
+		logger := p.logger.With(zap.String("target", target), zap.Stringer("from", from), zap.Stringer("to", to))
+
+		if to == breakerOpen {
+			logger.Warn("circuit breaker opened")
+		} else {
+			logger.Info("circuit breaker state changed")
+		}
+
+		p.metrics.circuitState.WithLabelValues(p.origin.name, target).Set(float64(to))
+	}
+}
+
+// targetTransport records the per target metrics and circuit breaker outcomes of requests
+// to the origin
+type targetTransport struct {
+	next    http.RoundTripper
+	origin  *Origin
+	breaker *breaker
+	metrics *metrics
+}
+
+func (t *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name := ""
+
+	target := targetFromContext(req.Context())
+	if target != nil {
+		name = target.name
+	}
+
+	done := func() {}
+	if target != nil {
+		done = t.active(target)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	// the client going away says nothing about the health of the origin, the reservations
+	// are given back instead
+	if req.Context().Err() == context.Canceled {
+		t.breaker.release()
+		if target != nil {
+			target.breaker.release()
+		}
+	} else {
+		success := !isBreakerFailure(resp, err)
+
+		t.breaker.record(success)
+		if target != nil {
+			target.breaker.record(success)
+		}
+	}
+
+	// the request is in flight until its response body is closed
+	if err != nil {
+		done()
+	} else {
+		resp.Body = newActiveBody(resp.Body, done)
+	}
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+
+	t.metrics.targetRequests.WithLabelValues(t.origin.name, name, code).Inc()
+	t.metrics.targetDuration.WithLabelValues(t.origin.name, name).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (t *targetTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+// active counts a request to the target as in flight, for least_conn and the active gauge,
+// until the returned func is called
+func (t *targetTransport) active(target *target) func() {
+	atomic.AddInt64(&target.active, 1)
+	t.metrics.targetActive.WithLabelValues(t.origin.name, target.name).Inc()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&target.active, -1)
+			t.metrics.targetActive.WithLabelValues(t.origin.name, target.name).Dec()
+		})
+	}
+}
+
+// activeBody calls done once the response body is closed
+type activeBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *activeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+
+	return err
+}
+
+// activeConn is the activeBody of a response that switched protocols, whose body is the
+// connection to the origin
+type activeConn struct {
+	*activeBody
+	w io.Writer
+}
+
+func (c *activeConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func newActiveBody(body io.ReadCloser, done func()) io.ReadCloser {
+	b := &activeBody{ReadCloser: body, done: done}
+
+	if w, ok := body.(io.ReadWriteCloser); ok {
+		return &activeConn{activeBody: b, w: w}
 	}
 
-	logger := p.logger.With(
-		zap.String("request.id", requestID),
+	return b
+}
+
+func (p *proxy) requestLogger(ctx context.Context, r *http.Request) *zap.Logger {
+	return p.logger.With(
+		zap.String("req.url", r.URL.String()),
+		zap.String("http.method", r.Method),
+		zap.String("request.id", requestID(ctx)),
 	)
+}
 
-	for key, values := range resp.Header {
-		for _, v := range values {
-			var skip bool
-			for _, k := range sanitizeHeaders {
-				if strings.ToLower(k) == strings.ToLower(key) {
-					skip = true
-				}
-			}
+// bufferPool is a httputil.BufferPool backed by a sync.Pool
+type bufferPool struct {
+	pool sync.Pool
+}
 
-			if skip {
-				logger.Debug("sanitizing header", zap.String("key", key), zap.String("value", v))
-				continue
-			}
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		},
+	}
+}
+
+func (b *bufferPool) Get() []byte {
+	return *b.pool.Get().(*[]byte)
+}
+
+func (b *bufferPool) Put(buf []byte) {
+	b.pool.Put(&buf)
+}
+
+// setIdentityHeaders replaces any identity headers sent by the client with the identity
+// of the authenticated user, if there is one
+func setIdentityHeaders(h http.Header, r *http.Request) {
+	for _, k := range identityHeaders {
+		h.Del(k)
+	}
+
+	token, claims, err := jwtauth.FromContext(r.Context())
+	if err != nil || token == nil {
+		return
+	}
+
+	h.Set("X-Forwarded-User", token.Subject())
 
-			logger.Debug("cloning header", zap.String("key", key), zap.String("value", v))
-			w.Header().Set(key, v)
+	for k, header := range map[string]string{
+		"email":       "X-Forwarded-Email",
+		"name":        "X-Forwarded-Name",
+		"unique_name": "X-Forwarded-Preferred-Username",
+	} {
+		if v, ok := claims[k].(string); ok && v != "" {
+			h.Set(header, v)
 		}
 	}
 }
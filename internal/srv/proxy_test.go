@@ -0,0 +1,191 @@
+package srv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newTestTucson starts tucson in front of the given origins, the origin named "default"
+// is used as the default origin
+func newTestTucson(t *testing.T, origins map[string]*Origin, matchers []*Matcher, opts ...Option) (*Server, *httptest.Server) {
+	t.Helper()
+
+	s := New(append([]Option{
+		WithSigningKey(testSigningKey),
+		WithOrigins(origins),
+		WithDefaultOrigin(origins["default"]),
+		WithMatchers(matchers),
+	}, opts...)...)
+
+	ts := httptest.NewServer(s.setup())
+	t.Cleanup(ts.Close)
+
+	return s, ts
+}
+
+func TestProxyReusesConnections(t *testing.T) {
+	var conns int32
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+	}, nil)
+
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(ts.URL + "/foo")
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+func TestProxyH2CIdleConnections(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		transport *TransportConfig
+		wantConns int32
+	}{
+		{
+			name:      "reused",
+			wantConns: 1,
+		},
+		{
+			name:      "closed after the idle timeout",
+			transport: &TransportConfig{IdleConnTimeout: 20 * time.Millisecond},
+			wantConns: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var conns int32
+
+			backend := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, r.Proto)
+			}), &http2.Server{}))
+			backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&conns, 1)
+				}
+			}
+			backend.Start()
+			defer backend.Close()
+
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Protocol: protocolH2C, Transport: tc.transport},
+			}, nil)
+
+			for i := 0; i < 2; i++ {
+				resp, err := http.Get(ts.URL + "/foo")
+				require.NoError(t, err)
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				resp.Body.Close()
+
+				assert.Equal(t, "HTTP/2.0", string(body))
+
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			assert.Equal(t, tc.wantConns, atomic.LoadInt32(&conns))
+		})
+	}
+}
+
+func TestProxyStreamsEvents(t *testing.T) {
+	release := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+
+		// the second event is only sent once the client saw the first
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+	}, nil)
+
+	resp, err := http.Get(ts.URL + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	buf := make([]byte, len("data: first\n\n"))
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n\n", string(buf))
+
+	close(release)
+
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: second\n\n", string(rest))
+}
+
+func TestProxyTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = io.WriteString(w, "payload")
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+	}, nil)
+
+	resp, err := http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestProxyInvalidOriginURL(t *testing.T) {
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: "http://[::1"},
+	}, nil)
+
+	resp, err := http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
@@ -0,0 +1,409 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 25 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+	defaultRetryMaxBody    = 64 * 1024
+	defaultRetryBudget     = 0.2
+	defaultRetryMinBudget  = 3
+
+	// retryBudgetWindow is the window the retry budget is measured over
+	retryBudgetWindow = 10 * time.Second
+
+	retryOnConnectError = "connect_error"
+	retryOnError        = "error"
+)
+
+// defaultRetryOn are the conditions retried by default
+var defaultRetryOn = []string{retryOnConnectError, "502", "503", "504"}
+
+type inboundURLContextKey struct{}
+
+// RetryConfig configures retries of failed requests to an origin
+type RetryConfig struct {
+	Attempts      int           `mapstructure:"attempts"`
+	On            []string      `mapstructure:"on"`
+	Backoff       time.Duration `mapstructure:"backoff"`
+	MaxBackoff    time.Duration `mapstructure:"max_backoff"`
+	Budget        float64       `mapstructure:"budget"`
+	MaxBody       int64         `mapstructure:"max_body"`
+	NonIdempotent bool          `mapstructure:"non_idempotent"`
+	SameTarget    bool          `mapstructure:"same_target"`
+}
+
+// withDefaults returns a copy of the config with unset values replaced by the defaults
+func (c *RetryConfig) withDefaults() RetryConfig {
+	cfg := *c
+
+	if cfg.Attempts == 0 {
+		cfg.Attempts = defaultRetryAttempts
+	}
+
+	if len(cfg.On) == 0 {
+		cfg.On = defaultRetryOn
+	}
+
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultRetryBackoff
+	}
+
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultRetryMaxBackoff
+	}
+
+	if cfg.Budget == 0 {
+		cfg.Budget = defaultRetryBudget
+	}
+
+	if cfg.MaxBody == 0 {
+		cfg.MaxBody = defaultRetryMaxBody
+	}
+
+	return cfg
+}
+
+// withInboundURL returns a copy of the context with the url of the inbound request, retries
+// on another target build the url to the target from it
+func withInboundURL(ctx context.Context, u *url.URL) context.Context {
+	return context.WithValue(ctx, inboundURLContextKey{}, u)
+}
+
+func inboundURLFromContext(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(inboundURLContextKey{}).(*url.URL)
+	return u
+}
+
+// retryTransport retries failed requests to the origin, on another target if there is one
+type retryTransport struct {
+	next   http.RoundTripper
+	proxy  *proxy
+	cfg    RetryConfig
+	on     map[string]bool
+	budget *retryBudget
+}
+
+func newRetryTransport(next http.RoundTripper, p *proxy, cfg RetryConfig) *retryTransport {
+	on := map[string]bool{}
+	for _, c := range cfg.On {
+		on[strings.ToLower(strings.TrimSpace(c))] = true
+	}
+
+	return &retryTransport{
+		next:   next,
+		proxy:  p,
+		cfg:    cfg,
+		on:     on,
+		budget: &retryBudget{ratio: cfg.Budget, min: defaultRetryMinBudget},
+	}
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.budget.request()
+
+	if rt.cfg.Attempts <= 1 || !rt.retryableMethod(req.Method) {
+		return rt.next.RoundTrip(req)
+	}
+
+	replayable, err := rt.bufferBody(req)
+	if err != nil {
+		rt.release(req)
+		return nil, err
+	}
+
+	if !replayable {
+		return rt.next.RoundTrip(req)
+	}
+
+	logger := rt.proxy.requestLogger(req.Context(), req)
+	tried := map[*target]bool{}
+
+	for attempt := 1; ; attempt++ {
+		if t := targetFromContext(req.Context()); t != nil {
+			tried[t] = true
+		}
+
+		resp, err := rt.next.RoundTrip(req)
+
+		reason := rt.retryReason(resp, err)
+		if reason == "" || attempt >= rt.cfg.Attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if !rt.budget.retry() {
+			logger.Debug("retry budget exhausted", zap.String("reason", reason))
+			rt.proxy.metrics.retryBudgetExhausted.WithLabelValues(rt.proxy.origin.name).Inc()
+
+			return resp, err
+		}
+
+		next, ok := rt.nextAttempt(req, tried)
+		if !ok {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.CopyN(io.Discard, resp.Body, healthCheckDrainLimit)
+			resp.Body.Close()
+		}
+
+		logger.Debug("retrying request", zap.Int("attempt", attempt+1), zap.String("reason", reason), zap.Error(err))
+		rt.proxy.metrics.retries.WithLabelValues(rt.proxy.origin.name, reason).Inc()
+
+		if err := sleepContext(req.Context(), rt.backoff(attempt)); err != nil {
+			if t := targetFromContext(next.Context()); t != nil && t != targetFromContext(req.Context()) {
+				t.breaker.release()
+			}
+
+			return nil, err
+		}
+
+		req = next
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (rt *retryTransport) CloseIdleConnections() {
+	closeIdleConnections(rt.next)
+}
+
+// release gives back the circuit breaker reservations of a request that is never sent
+func (rt *retryTransport) release(req *http.Request) {
+	rt.proxy.breaker.release()
+
+	if t := targetFromContext(req.Context()); t != nil {
+		t.breaker.release()
+	}
+}
+
+// retryableMethod returns true if requests with the method can be retried
+func (rt *retryTransport) retryableMethod(method string) bool {
+	if rt.cfg.NonIdempotent {
+		return true
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// bufferBody buffers the request body so it can be sent again, it returns false if the body
+// is too large to buffer and the request can't be retried
+func (rt *retryTransport) bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+
+	if req.GetBody != nil {
+		return true, nil
+	}
+
+	if req.ContentLength > rt.cfg.MaxBody {
+		return false, nil
+	}
+
+	body := req.Body
+
+	buf, err := io.ReadAll(io.LimitReader(body, rt.cfg.MaxBody+1))
+	if err != nil {
+		body.Close()
+		return false, err
+	}
+
+	if int64(len(buf)) > rt.cfg.MaxBody {
+		// stream the rest of the body without retries
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}
+
+		return false, nil
+	}
+
+	body.Close()
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+
+	return true, nil
+}
+
+// retryReason returns the retry condition matching the outcome, or empty if it shouldn't
+// be retried
+func (rt *retryTransport) retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		switch {
+		case rt.on[retryOnConnectError] && isConnectError(err):
+			return retryOnConnectError
+		case rt.on[retryOnError]:
+			return retryOnError
+		}
+
+		return ""
+	}
+
+	if code := strconv.Itoa(resp.StatusCode); rt.on[code] {
+		return code
+	}
+
+	return ""
+}
+
+// nextAttempt returns the request for the next attempt, on a target that hasn't been tried
+// yet if there is one
+func (rt *retryTransport) nextAttempt(req *http.Request, tried map[*target]bool) (*http.Request, bool) {
+	next := req.Clone(req.Context())
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, false
+		}
+
+		next.Body = body
+	}
+
+	current := targetFromContext(req.Context())
+	inbound := inboundURLFromContext(req.Context())
+
+	if rt.cfg.SameTarget || current == nil || inbound == nil {
+		return next, true
+	}
+
+	t := rt.proxy.untriedTarget(req, tried)
+	if t == nil || t == current {
+		return next, true
+	}
+
+	if ok, _ := t.breaker.allow(); !ok {
+		return next, true
+	}
+
+	u := *inbound
+	setTargetURL(&u, t.url)
+
+	next = next.WithContext(withTarget(req.Context(), t))
+	next.URL = &u
+
+	// keep a host overridden with set_headers
+	if next.Host == current.host() {
+		next.Host = t.host()
+	}
+
+	return next, true
+}
+
+// untriedTarget picks a target that hasn't been tried yet, or any available target if all
+// of them have been tried
+func (p *proxy) untriedTarget(r *http.Request, tried map[*target]bool) *target {
+	var t *target
+
+	for i := 0; i < len(p.targets); i++ {
+		if t = p.balancer.next(r); t == nil || !tried[t] {
+			return t
+		}
+	}
+
+	return t
+}
+
+// backoff returns the exponential backoff with jitter before the next attempt
+func (rt *retryTransport) backoff(attempt int) time.Duration {
+	d := rt.cfg.Backoff << (attempt - 1)
+	if d <= 0 || d > rt.cfg.MaxBackoff {
+		d = rt.cfg.MaxBackoff
+	}
+
+	// equal jitter, half the backoff is random
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) //nolint:gosec
+}
+
+// isConnectError returns true if the request failed before a connection to the origin was
+// established, so the origin never saw it
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryBudget limits retries to a ratio of the requests within a window, so retries can't
+// multiply the load on an origin that is already failing
+type retryBudget struct {
+	ratio float64
+	min   int
+	now   func() time.Time
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	retries  int
+}
+
+func (b *retryBudget) advance() {
+	now := time.Now()
+	if b.now != nil {
+		now = b.now()
+	}
+
+	if now.Sub(b.start) > retryBudgetWindow {
+		b.start, b.requests, b.retries = now, 0, 0
+	}
+}
+
+// request records a request
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance()
+	b.requests++
+}
+
+// retry returns true and records the retry if the budget allows it
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance()
+
+	if b.ratio > 0 && b.retries >= b.min && float64(b.retries) >= b.ratio*float64(b.requests) {
+		return false
+	}
+
+	b.retries++
+
+	return true
+}
@@ -0,0 +1,241 @@
+package srv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFlakyBackend returns a backend that fails the first requests with a 503 and records the
+// request bodies
+func newFlakyBackend(t *testing.T, failures int) (*httptest.Server, func() []string) {
+	t.Helper()
+
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		n := len(bodies)
+		mu.Unlock()
+
+		if n <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]string{}, bodies...)
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		retry      *RetryConfig
+		method     string
+		body       string
+		failures   int
+		wantCode   int
+		wantBodies []string
+	}{
+		{
+			name:       "no retry config",
+			method:     http.MethodGet,
+			failures:   1,
+			wantCode:   http.StatusServiceUnavailable,
+			wantBodies: []string{""},
+		},
+		{
+			name:       "retries get",
+			retry:      &RetryConfig{Backoff: time.Millisecond},
+			method:     http.MethodGet,
+			failures:   2,
+			wantCode:   http.StatusOK,
+			wantBodies: []string{"", "", ""},
+		},
+		{
+			name:       "gives up after attempts",
+			retry:      &RetryConfig{Attempts: 2, Backoff: time.Millisecond},
+			method:     http.MethodGet,
+			failures:   2,
+			wantCode:   http.StatusServiceUnavailable,
+			wantBodies: []string{"", ""},
+		},
+		{
+			name:       "post isn't retried",
+			retry:      &RetryConfig{Backoff: time.Millisecond},
+			method:     http.MethodPost,
+			body:       "hello",
+			failures:   1,
+			wantCode:   http.StatusServiceUnavailable,
+			wantBodies: []string{"hello"},
+		},
+		{
+			name:       "put replays the body",
+			retry:      &RetryConfig{Backoff: time.Millisecond},
+			method:     http.MethodPut,
+			body:       "hello",
+			failures:   1,
+			wantCode:   http.StatusOK,
+			wantBodies: []string{"hello", "hello"},
+		},
+		{
+			name:       "non idempotent post",
+			retry:      &RetryConfig{Backoff: time.Millisecond, NonIdempotent: true},
+			method:     http.MethodPost,
+			body:       "hello",
+			failures:   1,
+			wantCode:   http.StatusOK,
+			wantBodies: []string{"hello", "hello"},
+		},
+		{
+			name:       "body too large",
+			retry:      &RetryConfig{Backoff: time.Millisecond, MaxBody: 4},
+			method:     http.MethodPut,
+			body:       "hello",
+			failures:   1,
+			wantCode:   http.StatusServiceUnavailable,
+			wantBodies: []string{"hello"},
+		},
+		{
+			name:       "status not retried",
+			retry:      &RetryConfig{Backoff: time.Millisecond, On: []string{"502"}},
+			method:     http.MethodGet,
+			failures:   1,
+			wantCode:   http.StatusServiceUnavailable,
+			wantBodies: []string{""},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend, bodies := newFlakyBackend(t, tc.failures)
+
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Retry: tc.retry},
+			}, nil)
+
+			req, err := http.NewRequest(tc.method, ts.URL+"/", strings.NewReader(tc.body))
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.wantCode, resp.StatusCode)
+			assert.Equal(t, tc.wantBodies, bodies())
+		})
+	}
+}
+
+func TestProxyRetryOtherTarget(t *testing.T) {
+	backend, bodies := newFlakyBackend(t, 0)
+
+	// a closed listener gives a connect error
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {
+			Targets: []Target{{URL: down}, {URL: backend.URL}},
+			// round robin sends every request to the closed target first, so the budget is disabled
+			Retry: &RetryConfig{Attempts: 2, Backoff: time.Millisecond, Budget: -1},
+		},
+	}, nil)
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(ts.URL + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.Len(t, bodies(), 4)
+}
+
+func TestProxyRetryOtherTargetActive(t *testing.T) {
+	var (
+		p      *proxy
+		active int64
+	)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt64(&active, atomic.LoadInt64(&p.targets[1].active))
+	}))
+	defer backend.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {
+			Targets: []Target{{URL: down}, {URL: backend.URL}},
+			Retry:   &RetryConfig{Attempts: 2, Backoff: time.Millisecond, Budget: -1},
+		},
+	}, nil)
+
+	p = s.defaultOrigin.proxy
+
+	resp, err := http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the retry counts as in flight on the target it was sent to
+	assert.Equal(t, int64(1), atomic.LoadInt64(&active))
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&p.targets[0].active) == 0 && atomic.LoadInt64(&p.targets[1].active) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := &retryBudget{ratio: 0.1, min: 2, now: func() time.Time { return now }}
+
+	for i := 0; i < 30; i++ {
+		b.request()
+	}
+
+	// 10% of 30 requests
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.retry())
+	}
+
+	assert.False(t, b.retry())
+
+	// the minimum applies without requests
+	now = now.Add(time.Minute)
+
+	assert.True(t, b.retry())
+	assert.True(t, b.retry())
+	assert.False(t, b.retry())
+}
@@ -0,0 +1,198 @@
+package srv
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// placeholderRegexp matches {param} placeholders, ${1} style regexp references are left alone
+var placeholderRegexp = regexp.MustCompile(`\$?\{(\w+|\*)\}`)
+
+// RewriteRule replaces the part of the request path matching the regular expression
+type RewriteRule struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+}
+
+// pathRules are the path rewrites of a matcher or an origin, they are applied in the
+// order strip prefix, rewrites, add prefix
+type pathRules struct {
+	stripPrefix string
+	rewrites    []*regexp.Regexp
+	replaces    []string
+	addPrefix   string
+}
+
+// pathRewriter rewrites the request path before it is joined with the origin url
+type pathRewriter []*pathRules
+
+// newPathRewriter compiles the rewrite rules of the matcher followed by those of the origin,
+// it returns nil if there is nothing to rewrite
+func newPathRewriter(o *Origin, m *Matcher) (pathRewriter, error) {
+	var rw pathRewriter
+
+	if m != nil {
+		rules, err := newPathRules(m.StripPrefix, m.Rewrite, m.AddPrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		if rules != nil {
+			rw = append(rw, rules)
+		}
+	}
+
+	rules, err := newPathRules(o.StripPrefix, o.Rewrite, o.AddPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if rules != nil {
+		rw = append(rw, rules)
+	}
+
+	return rw, nil
+}
+
+func newPathRules(strip string, rewrites []RewriteRule, add string) (*pathRules, error) {
+	if strip == "" && add == "" && len(rewrites) == 0 {
+		return nil, nil
+	}
+
+	rules := &pathRules{
+		stripPrefix: strings.TrimSuffix(strip, "/"),
+		addPrefix:   add,
+	}
+
+	for _, rule := range rewrites {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, err
+		}
+
+		rules.rewrites = append(rules.rewrites, re)
+		rules.replaces = append(rules.replaces, rule.Replace)
+	}
+
+	return rules, nil
+}
+
+// rewrite returns the rewritten escaped path of the request
+func (rw pathRewriter) rewrite(r *http.Request) string {
+	p := r.URL.EscapedPath()
+
+	for _, rules := range rw {
+		p = rules.apply(r, p)
+	}
+
+	return p
+}
+
+func (rules *pathRules) apply(r *http.Request, p string) string {
+	if prefix := rules.stripPrefix; prefix != "" {
+		prefix = expandPlaceholders(r, prefix, false)
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			p = strings.TrimPrefix(p, prefix)
+		}
+	}
+
+	for i, re := range rules.rewrites {
+		p = re.ReplaceAllString(p, expandPlaceholders(r, rules.replaces[i], true))
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	if prefix := rules.addPrefix; prefix != "" {
+		p = singleJoiningSlash(expandPlaceholders(r, prefix, false), p)
+	}
+
+	return p
+}
+
+// expandPlaceholders replaces {param} placeholders with the chi url parameters of the
+// request, {*} is the wildcard of the route pattern.  In regexp replacement templates the $
+// of the parameters is escaped, a client can't add references to the template.
+func expandPlaceholders(r *http.Request, s string, template bool) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+
+	return placeholderRegexp.ReplaceAllStringFunc(s, func(p string) string {
+		if strings.HasPrefix(p, "$") {
+			return p
+		}
+
+		v := chi.URLParam(r, p[1:len(p)-1])
+
+		// chi matches on the escaped path if the request has one
+		if r.URL.RawPath == "" {
+			v = (&url.URL{Path: v}).EscapedPath()
+		}
+
+		if template {
+			v = strings.ReplaceAll(v, "$", "$$")
+		}
+
+		return v
+	})
+}
+
+// withRewrittenPath returns a shallow copy of the request with the rewritten path
+func withRewrittenPath(r *http.Request, escaped string) (*http.Request, error) {
+	p, err := url.PathUnescape(escaped)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *r.URL
+	u.Path = p
+	u.RawPath = escaped
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = &u
+
+	return r2, nil
+}
+
+// joinURLPath joins the origin url path with the request path, keeping the escaping of both
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+
+	return a + b
+}
@@ -0,0 +1,157 @@
+package srv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyPathRewrite(t *testing.T) {
+	var got string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RequestURI
+	}))
+	defer backend.Close()
+
+	var testCases = []struct {
+		name    string
+		base    string
+		origin  Origin
+		matcher *Matcher
+		path    string
+		want    string
+	}{
+		{
+			name: "no rewrite",
+			path: "/grafana/d/abc?orgId=1",
+			want: "/grafana/d/abc?orgId=1",
+		},
+		{
+			name:    "strip matcher prefix",
+			matcher: &Matcher{Path: "/grafana/*", StripPrefix: "/grafana"},
+			path:    "/grafana/d/abc?orgId=1",
+			want:    "/d/abc?orgId=1",
+		},
+		{
+			name:    "strip to root",
+			matcher: &Matcher{Path: "/grafana*", StripPrefix: "/grafana/"},
+			path:    "/grafana",
+			want:    "/",
+		},
+		{
+			name:    "strip only whole segments",
+			matcher: &Matcher{Path: "/grafana*", StripPrefix: "/grafana"},
+			path:    "/grafanas",
+			want:    "/grafanas",
+		},
+		{
+			name:   "legacy origin prefix has no effect",
+			origin: Origin{Prefix: "/api/"},
+			path:   "/users",
+			want:   "/users",
+		},
+		{
+			name:    "strip and add",
+			origin:  Origin{AddPrefix: "/v2"},
+			matcher: &Matcher{Path: "/api/*", StripPrefix: "/api"},
+			path:    "/api/users",
+			want:    "/v2/users",
+		},
+		{
+			name: "regex rewrite",
+			origin: Origin{Rewrite: []RewriteRule{
+				{Match: `^/old/(.*)$`, Replace: "/new/$1"},
+			}},
+			path: "/old/page",
+			want: "/new/page",
+		},
+		{
+			name: "url params",
+			matcher: &Matcher{Path: "/users/{id}/*", Rewrite: []RewriteRule{
+				{Match: `^.*$`, Replace: "/accounts/{id}/{*}"},
+			}},
+			path: "/users/42/profile/edit",
+			want: "/accounts/42/profile/edit",
+		},
+		{
+			name: "url params aren't regexp references",
+			matcher: &Matcher{Path: "/users/{id}/*", Rewrite: []RewriteRule{
+				{Match: `^/users/(\w+)/.*$`, Replace: "/accounts/$1/{*}"},
+			}},
+			path: "/users/42/$1${0}",
+			want: "/accounts/42/$1$%7B0%7D",
+		},
+		{
+			name: "base url path",
+			base: "/root/",
+			path: "/a",
+			want: "/root/a",
+		},
+		{
+			name:    "keeps escaping",
+			base:    "/root%2Fdir",
+			matcher: &Matcher{Path: "/files/*", StripPrefix: "/files"},
+			path:    "/files/a%2Fb",
+			want:    "/root%2Fdir/a%2Fb",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := tc.origin
+			origin.BaseUrl = backend.URL + tc.base
+
+			origins := map[string]*Origin{"default": &origin}
+
+			var matchers []*Matcher
+			if tc.matcher != nil {
+				tc.matcher.Origin = "default"
+				matchers = append(matchers, tc.matcher)
+			}
+
+			_, ts := newTestTucson(t, origins, matchers)
+
+			got = ""
+
+			resp, err := http.Get(ts.URL + tc.path)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestJoinURLPath(t *testing.T) {
+	var testCases = []struct {
+		a, b        string
+		wantPath    string
+		wantRawPath string
+	}{
+		{"http://o", "/x", "/x", ""},
+		{"http://o/", "/x", "/x", ""},
+		{"http://o/base", "/x", "/base/x", ""},
+		{"http://o/base/", "/x/", "/base/x/", ""},
+		{"http://o/a%2Fb/", "/x", "/a/b/x", "/a%2Fb/x"},
+		{"http://o/base", "/x%2Fy", "/base/x/y", "/base/x%2Fy"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.a+tc.b, func(t *testing.T) {
+			a, err := url.Parse(tc.a)
+			require.NoError(t, err)
+
+			b, err := url.Parse(tc.b)
+			require.NoError(t, err)
+
+			path, rawpath := joinURLPath(a, b)
+			assert.Equal(t, tc.wantPath, path)
+			assert.Equal(t, tc.wantRawPath, rawpath)
+		})
+	}
+}
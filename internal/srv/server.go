@@ -3,6 +3,8 @@ package srv
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -15,36 +17,120 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
+	httpmetrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	mm "github.com/slok/go-http-metrics/middleware"
 	"github.com/slok/go-http-metrics/middleware/std"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/oauth2"
 )
 
 // Server implements the HTTP and scaling server
 type Server struct {
-	defaultOrigin *Origin
-	matchers      []*Matcher
-	origins       map[string]*Origin
-	debug         bool
-	enableOIDC    bool
-	listen        string
-	logger        *zap.Logger
-	oidcProvider  *oidc.Provider
-	oauth2Config  oauth2.Config
-	signingKey    string
+	defaultOrigin     *Origin
+	matchers          []*Matcher
+	origins           map[string]*Origin
+	debug             bool
+	egressProxy       *EgressProxyConfig
+	enableOIDC        bool
+	errorPages        *ErrorPages
+	h2c               bool
+	idleTimeout       time.Duration
+	listen            string
+	logger            *zap.Logger
+	metrics           *metrics
+	registry          *prometheus.Registry
+	oidcProvider      *oidc.Provider
+	oauth2Config      oauth2.Config
+	readHeaderTimeout time.Duration
+	session           SessionConfig
+	sessions          *sessionStore
+	signingKey        string
+	splits            map[string]*split
+	splitsMu          sync.Mutex
+	trustedProxies    []*net.IPNet
+	upgrades          *upgradeTracker
 }
 
 // Origin defines a backend
 type Origin struct {
-	BaseUrl    string            `mapstructure:"url"`
-	Insecure   bool              `mapstructure:"insecure"`
-	SetHeaders map[string]string `mapstructure:"set_headers"`
-	AddHeaders map[string]string `mapstructure:"add_headers"`
-	Prefix     string            `mapstructure:"prefix"`
-	Oidc       bool              `mapstructure:"oidc"`
-	BasicAuth  *BasicAuth        `mapstructure:"basicauth"`
+	BaseUrl        string                `mapstructure:"url"`
+	Targets        []Target              `mapstructure:"targets"`
+	LoadBalancer   *LoadBalancerConfig   `mapstructure:"load_balancer"`
+	HealthCheck    *HealthCheckConfig    `mapstructure:"health_check"`
+	Critical       bool                  `mapstructure:"critical"`
+	CircuitBreaker *CircuitBreakerConfig `mapstructure:"circuit_breaker"`
+	Retry          *RetryConfig          `mapstructure:"retry"`
+	Timeouts       *TimeoutConfig        `mapstructure:"timeouts"`
+	Insecure       bool                  `mapstructure:"insecure"`
+	TLS            *TLSConfig            `mapstructure:"tls"`
+	SetHeaders     map[string]string     `mapstructure:"set_headers"`
+	AddHeaders     map[string]string     `mapstructure:"add_headers"`
+	Prefix         string                `mapstructure:"prefix"`
+	StripPrefix    string                `mapstructure:"strip_prefix"`
+	AddPrefix      string                `mapstructure:"add_prefix"`
+	Rewrite        []RewriteRule         `mapstructure:"rewrite"`
+	Oidc           bool                  `mapstructure:"oidc"`
+	Auth           string                `mapstructure:"auth"`
+	LoginPath      string                `mapstructure:"login_path"`
+	BasicAuth      *BasicAuth            `mapstructure:"basicauth"`
+	CSRF           *CSRF                 `mapstructure:"csrf"`
+	PublicPaths    []string              `mapstructure:"public_paths"`
+	ProtectedPaths []string              `mapstructure:"protected_paths"`
+	Session        *SessionConfig        `mapstructure:"session"`
+	Transport      *TransportConfig      `mapstructure:"transport"`
+	FlushInterval  time.Duration         `mapstructure:"flush_interval"`
+	Protocol       string                `mapstructure:"protocol"`
+	Forwarded      bool                  `mapstructure:"forwarded"`
+	EgressProxy    *EgressProxyConfig    `mapstructure:"egress_proxy"`
+	Mirror         *MirrorConfig         `mapstructure:"mirror"`
+	Cache          *CacheConfig          `mapstructure:"cache"`
+	Compression    *CompressionConfig    `mapstructure:"compression"`
+	MaxRequestBody int64                 `mapstructure:"max_request_body"`
+	Spool          *SpoolConfig          `mapstructure:"spool"`
+
+	name        string
+	proxy       *proxy
+	cache       *cache
+	compression *compression
+}
+
+const (
+	// authRequired redirects unauthenticated requests to the login flow
+	authRequired = "required"
+	// authOptional forwards the identity if present and lets anonymous requests through
+	authOptional = "optional"
+	// authNone doesn't authenticate requests, same as no auth mode
+	authNone = "none"
+)
+
+// authMode returns the authentication mode for the origin, the legacy oidc flag is
+// equivalent to required.  Unknown modes require authentication rather than leaving the
+// origin open.
+func (o *Origin) authMode() string {
+	if o.Oidc {
+		return authRequired
+	}
+
+	switch o.Auth {
+	case "", authNone:
+		return ""
+	case authOptional:
+		return authOptional
+	}
+
+	return authRequired
+}
+
+// checkAuth returns an error if the auth mode of the origin is unknown
+func (o *Origin) checkAuth() error {
+	switch o.Auth {
+	case "", authNone, authRequired, authOptional:
+		return nil
+	}
+
+	return fmt.Errorf("unknown auth mode %q", o.Auth) //nolint:goerr113
 }
 
 type BasicAuth struct {
@@ -54,29 +140,60 @@ type BasicAuth struct {
 
 // Matcher links a request to an origin
 type Matcher struct {
-	Path   string `mapstructure:"path"`
-	Origin string `mapstructure:"origin"`
+	Path           string         `mapstructure:"path"`
+	Origin         string         `mapstructure:"origin"`
+	PublicPaths    []string       `mapstructure:"public_paths"`
+	ProtectedPaths []string       `mapstructure:"protected_paths"`
+	MaxAuthAge     time.Duration  `mapstructure:"max_auth_age"`
+	RequiredAcr    []string       `mapstructure:"required_acr"`
+	StripPrefix    string         `mapstructure:"strip_prefix"`
+	AddPrefix      string         `mapstructure:"add_prefix"`
+	Rewrite        []RewriteRule  `mapstructure:"rewrite"`
+	Timeouts       *TimeoutConfig `mapstructure:"timeouts"`
+	Mirror         *MirrorConfig  `mapstructure:"mirror"`
+	Split          *SplitConfig   `mapstructure:"split"`
+	MaxRequestBody int64          `mapstructure:"max_request_body"`
+}
+
+// requiresStepUp returns true if the matcher has stricter authentication requirements
+func (m *Matcher) requiresStepUp() bool {
+	return m.MaxAuthAge > 0 || len(m.RequiredAcr) > 0
 }
 
 type Option func(s *Server)
 
 var (
-	readTimeout     = 10 * time.Second
-	writeTimeout    = 20 * time.Second
 	shutdownTimeout = 5 * time.Second
 
 	tokenAuth *jwtauth.JWTAuth
 )
 
 func New(opts ...Option) *Server {
+	// avoid registering on the global prom registry
+	reg := prometheus.NewRegistry()
+
 	s := &Server{
-		logger: zap.NewNop(),
+		logger:   zap.NewNop(),
+		metrics:  newMetrics(reg),
+		registry: reg,
+		splits:   map[string]*split{},
+		upgrades: newUpgradeTracker(),
+
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		idleTimeout:       defaultIdleTimeout,
+
+		session: SessionConfig{
+			IdleTimeout:     defaultSessionIdleTimeout,
+			AbsoluteTimeout: defaultSessionAbsoluteTimeout,
+		},
 	}
 
 	for _, o := range opts {
 		o(s)
 	}
 
+	s.sessions = newSessionStore(s.session.MaxPerUser)
+
 	return s
 }
 
@@ -122,6 +239,55 @@ func WithMatchers(m []*Matcher) Option {
 	}
 }
 
+// WithH2C enables cleartext http/2 (h2c) connections from clients, ie. grpc clients without tls
+func WithH2C(h bool) Option {
+	return func(s *Server) {
+		s.h2c = h
+	}
+}
+
+// WithReadHeaderTimeout sets how long clients have to send the request headers
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = d
+	}
+}
+
+// WithIdleTimeout sets how long idle keep-alive client connections are kept open
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithEgressProxy sets the default egress proxy for origins without their own
+func WithEgressProxy(c *EgressProxyConfig) Option {
+	return func(s *Server) {
+		s.egressProxy = c
+	}
+}
+
+// WithErrorPages sets the templates of the error pages returned when a request can't be proxied
+func WithErrorPages(p *ErrorPages) Option {
+	return func(s *Server) {
+		s.errorPages = p
+	}
+}
+
+// WithTrustedProxies sets the proxies whose forwarding headers are trusted
+func WithTrustedProxies(n []*net.IPNet) Option {
+	return func(s *Server) {
+		s.trustedProxies = n
+	}
+}
+
+// WithSession sets the global session lifetime configuration
+func WithSession(c SessionConfig) Option {
+	return func(s *Server) {
+		s.session = c
+	}
+}
+
 // WithSigningKey sets the JWT signing key
 func WithSigningKey(k string) Option {
 	return func(s *Server) {
@@ -147,8 +313,7 @@ func WithOauth2Config(c oauth2.Config) Option {
 func (s *Server) setup() *chi.Mux {
 	r := chi.NewRouter()
 
-	// avoid registering on the global prom registry
-	reg := prometheus.NewRegistry()
+	reg := s.registry
 	reg.MustRegister(
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
@@ -156,17 +321,20 @@ func (s *Server) setup() *chi.Mux {
 
 	// metrics middleware
 	r.Use(std.HandlerProvider("", mm.New(mm.Config{
-		Recorder: metrics.NewRecorder(metrics.Config{
+		Recorder: httpmetrics.NewRecorder(httpmetrics.Config{
 			Registry: reg,
 			Prefix:   "tucson",
 		}),
 	})))
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(s.realIP)
 	r.Use(chizap.Logger(s.logger.With(zap.String("component", "srv")),
 		chizap.WithTimeFormat(time.RFC3339),
 		chizap.WithUTC(true),
+		chizap.WithCustomFields(func(c context.Context, r *http.Request) zap.Field {
+			return zap.String("client_ip", clientIP(c))
+		}),
 	))
 	r.Use(chizap.RecoveryWithZap(s.logger.With(zap.String("component", "httpsrv")), true))
 
@@ -178,62 +346,239 @@ func (s *Server) setup() *chi.Mux {
 	r.Get("/healthz/liveness", s.livenessCheck)
 	r.Get("/healthz/readiness", s.readinessCheck)
 
-	r.Get("/auth/login", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, s.oauth2Config.AuthCodeURL("foobar"), http.StatusFound)
-	})
-
+	r.Get("/auth/login", s.handleLogin)
 	r.Get("/auth/callback", s.handleOAuth2Callback)
 
 	tokenAuth := jwtauth.New("HS256", []byte(s.signingKey), nil)
 
+	s.initOrigins()
+
+	// login paths let users of optional auth origins sign in on demand
+	for _, o := range s.origins {
+		if o.LoginPath != "" {
+			r.Get(o.LoginPath, s.handleOriginLogin)
+		}
+	}
+
 	for _, m := range s.matchers {
 		r.Group(func(r chi.Router) {
-			origin, ok := s.origins[m.Origin]
+			// a split without an origin authenticates like its first origin
+			name := m.Origin
+			if name == "" && m.Split != nil && len(m.Split.Origins) > 0 {
+				name = m.Split.Origins[0].Origin
+			}
+
+			origin, ok := s.origins[name]
 			if !ok {
-				s.logger.Warn("origin not found for matcher", zap.String("origin", m.Origin), zap.Any("matcher", m))
+				s.logger.Warn("origin not found for matcher", zap.String("origin", name), zap.Any("matcher", m))
 				return
 			}
 
-			if origin.Oidc {
-				r.Use(s.Authenticator(tokenAuth))
+			auth, err := s.authPolicy(tokenAuth, origin, m)
+			if err != nil {
+				s.logger.Error("invalid path pattern for matcher, requiring authentication", zap.Error(err), zap.Any("matcher", m))
+				auth = s.Authenticator(tokenAuth)
+			}
+
+			if m.Split != nil {
+				if err := s.checkSplitAuth(m); err != nil {
+					s.logger.Error("invalid split, requiring authentication", zap.Error(err), zap.Any("matcher", m))
+					auth = s.Authenticator(tokenAuth)
+				}
+			}
+
+			if origin.CSRF != nil && origin.CSRF.Enabled {
+				r.Use(s.csrfProtect(origin))
+			}
+
+			if auth != nil {
+				r.Use(auth)
 			}
 
 			// TODO handle more than GET
-			r.Get(m.Path, s.proxyOriginHandler(origin))
-			r.Post(m.Path, s.proxyOriginHandler(origin))
-			r.Put(m.Path, s.proxyOriginHandler(origin))
-			r.Patch(m.Path, s.proxyOriginHandler(origin))
-			r.Delete(m.Path, s.proxyOriginHandler(origin))
+			var handler http.HandlerFunc
+			if m.Split != nil {
+				handler = s.splitHandler(origin, m)
+			} else {
+				handler = s.proxyOriginHandler(origin, m)
+			}
+
+			r.Get(m.Path, handler)
+			r.Post(m.Path, handler)
+			r.Put(m.Path, handler)
+			r.Patch(m.Path, handler)
+			r.Delete(m.Path, handler)
 		})
 	}
 
 	// Default Backend Routes
 	r.Group(func(r chi.Router) {
-		if s.defaultOrigin.Oidc {
-			r.Use(s.Authenticator(tokenAuth))
+		auth, err := s.authPolicy(tokenAuth, s.defaultOrigin, nil)
+		if err != nil {
+			s.logger.Error("invalid path pattern for default origin, requiring authentication", zap.Error(err))
+			auth = s.Authenticator(tokenAuth)
+		}
+
+		if s.defaultOrigin.CSRF != nil && s.defaultOrigin.CSRF.Enabled {
+			r.Use(s.csrfProtect(s.defaultOrigin))
+		}
+
+		if auth != nil {
+			r.Use(auth)
 		}
 
-		r.NotFound(s.proxyOriginHandler(s.defaultOrigin))
+		r.NotFound(s.proxyOriginHandler(s.defaultOrigin, nil))
 	})
 
 	return r
 }
 
+// initOrigins names the origins and creates their long lived proxies
+func (s *Server) initOrigins() {
+	for name, o := range s.origins {
+		if o.Prefix != "" {
+			s.logger.Warn("the prefix option is deprecated and has no effect, use add_prefix", zap.String("origin", name))
+		}
+
+		o.name = name
+		o.proxy = s.newProxy(o, s.logger.With(zap.String("origin", name)))
+		o.cache = s.initCache(o)
+		o.compression = s.initCompression(o)
+	}
+
+	// the default origin is normally one of the named origins
+	if s.defaultOrigin.proxy == nil {
+		s.defaultOrigin.name = "default"
+		s.defaultOrigin.proxy = s.newProxy(s.defaultOrigin, s.logger.With(zap.String("origin", "default")))
+		s.defaultOrigin.cache = s.initCache(s.defaultOrigin)
+		s.defaultOrigin.compression = s.initCompression(s.defaultOrigin)
+	}
+}
+
+// initCache returns the cache of the origin, a cache that fails to load is left out
+func (s *Server) initCache(o *Origin) *cache {
+	c, err := s.newCache(o)
+	if err != nil {
+		s.logger.Error("invalid cache, responses won't be cached", zap.String("origin", o.name), zap.Error(err))
+		return nil
+	}
+
+	return c
+}
+
+// initCompression returns the compression of the origin, invalid settings disable it
+func (s *Server) initCompression(o *Origin) *compression {
+	c, err := s.newCompression(o)
+	if err != nil {
+		s.logger.Error("invalid compression, responses won't be compressed", zap.String("origin", o.name), zap.Error(err))
+		return nil
+	}
+
+	return c
+}
+
+// Validate returns an error if the origins or matchers are misconfigured in a way that would
+// weaken authentication or fail requests
+func (s *Server) Validate() error {
+	if s.defaultOrigin != nil {
+		if err := s.defaultOrigin.validate(); err != nil {
+			return fmt.Errorf("default origin: %w", err)
+		}
+	}
+
+	for name, o := range s.origins {
+		if err := o.validate(); err != nil {
+			return fmt.Errorf("origin %q: %w", name, err)
+		}
+	}
+
+	for _, m := range s.matchers {
+		if _, err := newPathSet(m.PublicPaths, m.ProtectedPaths); err != nil {
+			return fmt.Errorf("matcher %q: %w", m.Path, err)
+		}
+
+		if m.Split != nil {
+			if err := s.checkSplitAuth(m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if the origin is misconfigured
+func (o *Origin) validate() error {
+	if err := o.checkAuth(); err != nil {
+		return err
+	}
+
+	if _, err := newPathSet(o.PublicPaths, o.ProtectedPaths); err != nil {
+		return err
+	}
+
+	if err := o.checkProtocol(); err != nil {
+		return err
+	}
+
+	if err := o.checkTargets(); err != nil {
+		return err
+	}
+
+	if err := o.checkCache(); err != nil {
+		return err
+	}
+
+	if err := o.checkCompression(); err != nil {
+		return err
+	}
+
+	// the tls files are read again when the transport is built, this only checks they load
+	if err := o.checkTLS(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// closeOrigins closes idle connections to all origins
+func (s *Server) closeOrigins() {
+	for _, p := range s.proxies() {
+		closeIdleConnections(p.transport)
+	}
+}
+
 // NewServer returns a configured server
 func (s *Server) NewServer() *http.Server {
+	var handler http.Handler = s.setup()
+	if s.h2c {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	// there are no read and write timeouts, they would cut off long uploads, downloads and
+	// streams, request bodies and responses are limited by the timeouts of their origin instead
 	return &http.Server{
-		Handler:      s.setup(),
-		Addr:         s.listen,
-		ReadTimeout:  readTimeout,
-		WriteTimeout: writeTimeout,
+		Handler:           handler,
+		Addr:              s.listen,
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		IdleTimeout:       s.idleTimeout,
 	}
 }
 
 // Run starts the scaler and the http server
 func (s *Server) Run(ctx context.Context) error {
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	var wg sync.WaitGroup
 	httpsrv := s.NewServer()
 
+	checkCtx, stopChecks := context.WithCancel(context.Background())
+	defer stopChecks()
+
+	s.runHealthChecks(checkCtx, &wg)
+
 	go func() {
 		if err := httpsrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			panic(err)
@@ -247,13 +592,22 @@ func (s *Server) Run(ctx context.Context) error {
 		cancel()
 	}()
 
-	if err := httpsrv.Shutdown(ctxShutDown); err != nil {
-		return err
-	}
+	err := httpsrv.Shutdown(ctxShutDown)
+
+	// hijacked connections aren't tracked by the http server, they are closed even if the
+	// shutdown timed out
+	s.upgrades.closeAll()
 
-	// wait for scaler to shutdown
+	// wait for the health checks to stop
+	stopChecks()
 	wg.Wait()
 
+	s.closeOrigins()
+
+	if err != nil {
+		return err
+	}
+
 	s.logger.Info("server shutdown cleanly", zap.String("time", time.Now().UTC().Format(time.RFC3339)))
 
 	return nil
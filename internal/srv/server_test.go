@@ -0,0 +1,147 @@
+package srv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		origins map[string]*Origin
+		wantErr string
+	}{
+		{
+			name: "valid",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Auth: authNone},
+				"app":     {BaseUrl: "http://localhost", Auth: authRequired},
+			},
+		},
+		{
+			name: "unknown auth mode",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost"},
+				"app":     {BaseUrl: "http://localhost", Auth: "requried"},
+			},
+			wantErr: `origin "app": unknown auth mode "requried"`,
+		},
+		{
+			name: "unknown auth mode of the default origin",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Auth: "yes"},
+			},
+			wantErr: `unknown auth mode "yes"`,
+		},
+		{
+			name: "invalid path pattern",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", PublicPaths: []string{"robots.txt"}},
+			},
+			wantErr: `path pattern "robots.txt" must start with /`,
+		},
+		{
+			name: "unknown protocol",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Protocol: "http3"},
+			},
+			wantErr: `unknown protocol "http3"`,
+		},
+		{
+			name: "relative target url",
+			origins: map[string]*Origin{
+				"default": {Targets: []Target{{URL: "http://localhost"}, {URL: "localhost:8080"}}},
+			},
+			wantErr: `target url "localhost:8080" must be absolute`,
+		},
+		{
+			name: "negative target weight",
+			origins: map[string]*Origin{
+				"default": {Targets: []Target{{URL: "http://localhost", Weight: -1}}},
+			},
+			wantErr: `target "http://localhost" weight must not be negative`,
+		},
+		{
+			name: "unknown load balancing policy",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", LoadBalancer: &LoadBalancerConfig{Policy: "fastest"}},
+			},
+			wantErr: `unknown load balancing policy "fastest"`,
+		},
+		{
+			name: "invalid hash_by",
+			origins: map[string]*Origin{
+				"default": {
+					BaseUrl:      "http://localhost",
+					LoadBalancer: &LoadBalancerConfig{Policy: "consistent_hash", HashBy: "query:id"},
+				},
+			},
+			wantErr: `invalid hash_by "query:id"`,
+		},
+		{
+			name: "negative cache size",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Cache: &CacheConfig{MaxEntrySize: -1}},
+			},
+			wantErr: "cache sizes must not be negative",
+		},
+		{
+			name: "negative cache ttl",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Cache: &CacheConfig{DefaultTTL: -time.Minute}},
+			},
+			wantErr: "cache durations must not be negative",
+		},
+		{
+			name: "cache dir is a file",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Cache: &CacheConfig{Dir: "server_test.go"}},
+			},
+			wantErr: "failed to create cache directory",
+		},
+		{
+			name: "unsupported compression encoding",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Compression: &CompressionConfig{Encodings: []string{"deflate"}}},
+			},
+			wantErr: `unsupported encoding "deflate"`,
+		},
+		{
+			name: "invalid compression type",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "http://localhost", Compression: &CompressionConfig{Types: []string{"text/["}}},
+			},
+			wantErr: `invalid type pattern "text/["`,
+		},
+		{
+			name: "invalid tls version",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "https://localhost", TLS: &TLSConfig{MinVersion: "1.4"}},
+			},
+			wantErr: `unknown min_version "1.4"`,
+		},
+		{
+			name: "missing tls file",
+			origins: map[string]*Origin{
+				"default": {BaseUrl: "https://localhost", TLS: &TLSConfig{CAFile: "/nonexistent/ca.pem"}},
+			},
+			wantErr: "origin tls configuration is invalid",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(WithOrigins(tc.origins), WithDefaultOrigin(tc.origins["default"]))
+
+			err := s.Validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+}
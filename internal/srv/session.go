@@ -0,0 +1,322 @@
+package srv
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fishnix/tucson/internal/token"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/jwt"
+	"go.uber.org/zap"
+)
+
+const (
+	sessionCookie = "jwt"
+
+	// sessionRenewInterval is how often the session cookie of an active user is reissued
+	sessionRenewInterval = time.Minute
+
+	defaultSessionIdleTimeout     = 60 * time.Minute
+	defaultSessionAbsoluteTimeout = 12 * time.Hour
+)
+
+// SessionConfig configures the lifetime of sessions.  Set globally it determines the expiry of
+// the session token, set on an origin it can only shorten the lifetime for that origin.
+type SessionConfig struct {
+	IdleTimeout     time.Duration `mapstructure:"idle_timeout"`
+	AbsoluteTimeout time.Duration `mapstructure:"absolute_timeout"`
+	MaxPerUser      int           `mapstructure:"max_per_user"`
+}
+
+// session is the state carried in the session token
+type session struct {
+	ID         string
+	Subject    string
+	Email      string
+	Name       string
+	UniqueName string
+	AuthTime   int64
+	Acr        string
+	Amr        []string
+	Start      time.Time
+	LastSeen   time.Time
+}
+
+// sessionFromToken rebuilds the session from a validated token and its claims
+func sessionFromToken(t jwt.Token, claims map[string]interface{}) *session {
+	sess := &session{
+		ID:       t.JwtID(),
+		Subject:  t.Subject(),
+		LastSeen: t.IssuedAt(),
+	}
+
+	sess.Email, _ = claims["email"].(string)
+	sess.Name, _ = claims["name"].(string)
+	sess.UniqueName, _ = claims["unique_name"].(string)
+	sess.Acr, _ = claims["acr"].(string)
+
+	if v, ok := claims["auth_time"].(float64); ok {
+		sess.AuthTime = int64(v)
+	}
+
+	if v, ok := claims["session_start"].(float64); ok {
+		sess.Start = time.Unix(int64(v), 0)
+	}
+
+	if amr, ok := claims["amr"].([]interface{}); ok {
+		for _, v := range amr {
+			if m, ok := v.(string); ok {
+				sess.Amr = append(sess.Amr, m)
+			}
+		}
+	}
+
+	return sess
+}
+
+// expiry returns when the session token expires, the earlier of the idle and absolute timeouts.
+// A timeout of 0 is no limit, without any limit the token expires the default absolute timeout
+// after the session was last seen and is renewed while the session is used.
+func (c SessionConfig) expiry(sess *session) time.Time {
+	var exp time.Time
+
+	if c.AbsoluteTimeout > 0 {
+		exp = sess.Start.Add(c.AbsoluteTimeout)
+	}
+
+	if c.IdleTimeout > 0 {
+		if idle := sess.LastSeen.Add(c.IdleTimeout); exp.IsZero() || idle.Before(exp) {
+			exp = idle
+		}
+	}
+
+	if exp.IsZero() {
+		exp = sess.LastSeen.Add(defaultSessionAbsoluteTimeout)
+	}
+
+	return exp
+}
+
+// stricter returns the shorter of each timeout in the two configs.  0 is no limit in the
+// server config and unset in the origin config, so it never replaces a limit of the other.
+func (c SessionConfig) stricter(o *SessionConfig) SessionConfig {
+	if o == nil {
+		return c
+	}
+
+	shorter := func(a, b time.Duration) time.Duration {
+		if b > 0 && (a == 0 || b < a) {
+			return b
+		}
+
+		return a
+	}
+
+	c.IdleTimeout = shorter(c.IdleTimeout, o.IdleTimeout)
+	c.AbsoluteTimeout = shorter(c.AbsoluteTimeout, o.AbsoluteTimeout)
+
+	return c
+}
+
+// issueSession signs the session into a token and sets the session cookie
+func (s *Server) issueSession(w http.ResponseWriter, sess *session) error {
+	exp := s.session.expiry(sess)
+
+	rawToken, err := token.New(
+		token.WithKey(s.signingKey),
+		token.WithID(sess.ID),
+		token.WithSubject(sess.Subject),
+		token.WithIssuedAt(sess.LastSeen),
+		token.WithNotBefore(sess.Start),
+		token.WithExpire(exp),
+		token.WithPrivate(
+			struct {
+				Email      string `json:"email"`
+				Name       string `json:"name"`
+				UniqueName string `json:"unique_name"`
+			}{sess.Email, sess.Name, sess.UniqueName},
+		),
+		token.WithPrivate(
+			struct {
+				AuthTime     int64    `json:"auth_time"`
+				Acr          string   `json:"acr,omitempty"`
+				Amr          []string `json:"amr,omitempty"`
+				SessionStart int64    `json:"session_start"`
+			}{sess.AuthTime, sess.Acr, sess.Amr, sess.Start.Unix()},
+		),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.sessions.touch(sess.Subject, sess.ID, exp)
+
+	addCookie(w, sessionCookie, rawToken, time.Until(exp))
+
+	return nil
+}
+
+// sessionCheck enforces the session timeouts of the origin and evictions by the per-user session
+// limit, and renews the cookie of active sessions.  Failing sessions are sent to the login flow
+// if authentication is required or continue anonymously otherwise.
+func (s *Server) sessionCheck(o *Origin, required bool) func(http.Handler) http.Handler {
+	cfg := s.session.stricter(o.Session)
+
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			t, claims, err := jwtauth.FromContext(r.Context())
+			if err != nil || t == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			now := time.Now()
+			sess := sessionFromToken(t, claims)
+
+			reason := ""
+
+			switch {
+			case cfg.IdleTimeout > 0 && now.Sub(sess.LastSeen) > cfg.IdleTimeout:
+				reason = "idle_timeout"
+			case cfg.AbsoluteTimeout > 0 && now.Sub(sess.Start) > cfg.AbsoluteTimeout:
+				reason = "absolute_timeout"
+			case s.sessions.evicted(sess.ID):
+				reason = "evicted"
+			}
+
+			if reason != "" {
+				s.logger.Debug("session is no longer valid",
+					zap.String("origin", o.name),
+					zap.String("reason", reason),
+					zap.String("subject", sess.Subject),
+				)
+
+				if required {
+					loginRedirect(w, r)
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(r.Context(), nil, nil)))
+
+				return
+			}
+
+			// only cookie sessions slide, bearer tokens keep their expiry
+			if jwtauth.TokenFromHeader(r) == "" && now.Sub(sess.LastSeen) >= sessionRenewInterval {
+				sess.LastSeen = now
+				if err := s.issueSession(w, sess); err != nil {
+					s.logger.Error("failed to renew session", zap.Error(err))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// sessionStore tracks the active sessions of each subject to enforce a limit on concurrent
+// sessions.  It is in memory only, sessions issued before a restart aren't counted.
+type sessionStore struct {
+	mu       sync.Mutex
+	max      int
+	subjects map[string]map[string]sessionEntry
+	revoked  map[string]time.Time
+}
+
+type sessionEntry struct {
+	created time.Time
+	expires time.Time
+}
+
+func newSessionStore(max int) *sessionStore {
+	return &sessionStore{
+		max:      max,
+		subjects: map[string]map[string]sessionEntry{},
+		revoked:  map[string]time.Time{},
+	}
+}
+
+// touch records a new or renewed session and evicts the oldest sessions of the subject
+// above the limit
+func (ss *sessionStore) touch(subject, id string, expires time.Time) {
+	if ss.max <= 0 || id == "" {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	now := time.Now()
+	ss.prune(now)
+
+	sessions, ok := ss.subjects[subject]
+	if !ok {
+		sessions = map[string]sessionEntry{}
+		ss.subjects[subject] = sessions
+	}
+
+	entry, ok := sessions[id]
+	if !ok {
+		entry.created = now
+	}
+
+	entry.expires = expires
+	sessions[id] = entry
+
+	if len(sessions) <= ss.max {
+		return
+	}
+
+	ids := make([]string, 0, len(sessions))
+	for k := range sessions {
+		ids = append(ids, k)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return sessions[ids[i]].created.Before(sessions[ids[j]].created)
+	})
+
+	for _, k := range ids[:len(ids)-ss.max] {
+		ss.revoked[k] = sessions[k].expires
+		delete(sessions, k)
+	}
+}
+
+// evicted returns true if the session was evicted by a newer session of the same subject
+func (ss *sessionStore) evicted(id string) bool {
+	if ss.max <= 0 {
+		return false
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	_, ok := ss.revoked[id]
+
+	return ok
+}
+
+// prune forgets sessions whose tokens have expired
+func (ss *sessionStore) prune(now time.Time) {
+	for subject, sessions := range ss.subjects {
+		for id, e := range sessions {
+			if now.After(e.expires) {
+				delete(sessions, id)
+			}
+		}
+
+		if len(sessions) == 0 {
+			delete(ss.subjects, subject)
+		}
+	}
+
+	for id, exp := range ss.revoked {
+		if now.After(exp) {
+			delete(ss.revoked, id)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package srv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionConfigExpiry(t *testing.T) {
+	start := time.Date(2022, 5, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		cfg      SessionConfig
+		lastSeen time.Time
+		want     time.Time
+	}{
+		{
+			name:     "idle before absolute",
+			cfg:      SessionConfig{IdleTimeout: 15 * time.Minute, AbsoluteTimeout: 12 * time.Hour},
+			lastSeen: start.Add(time.Hour),
+			want:     start.Add(time.Hour + 15*time.Minute),
+		},
+		{
+			name:     "capped by absolute",
+			cfg:      SessionConfig{IdleTimeout: 15 * time.Minute, AbsoluteTimeout: 12 * time.Hour},
+			lastSeen: start.Add(12*time.Hour - 5*time.Minute),
+			want:     start.Add(12 * time.Hour),
+		},
+		{
+			name:     "no idle timeout",
+			cfg:      SessionConfig{AbsoluteTimeout: time.Hour},
+			lastSeen: start.Add(30 * time.Minute),
+			want:     start.Add(time.Hour),
+		},
+		{
+			name:     "no absolute timeout",
+			cfg:      SessionConfig{IdleTimeout: 15 * time.Minute},
+			lastSeen: start.Add(24 * time.Hour),
+			want:     start.Add(24*time.Hour + 15*time.Minute),
+		},
+		{
+			name:     "no timeouts",
+			lastSeen: start.Add(24 * time.Hour),
+			want:     start.Add(24*time.Hour + defaultSessionAbsoluteTimeout),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cfg.expiry(&session{Start: start, LastSeen: tt.lastSeen})
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSessionConfigStricter(t *testing.T) {
+	cfg := SessionConfig{IdleTimeout: time.Hour}
+
+	// the origin can't lift a limit, and adds its own where the server has none
+	assert.Equal(t, cfg, cfg.stricter(&SessionConfig{}))
+	assert.Equal(t, SessionConfig{IdleTimeout: 15 * time.Minute, AbsoluteTimeout: 8 * time.Hour},
+		cfg.stricter(&SessionConfig{IdleTimeout: 15 * time.Minute, AbsoluteTimeout: 8 * time.Hour}))
+	assert.Equal(t, cfg, cfg.stricter(&SessionConfig{IdleTimeout: 2 * time.Hour}))
+}
+
+func TestSessionCheck(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		origin     *Origin
+		sess       *session
+		bearer     bool
+		wantCode   int
+		wantRenew  bool
+		wantAnonym bool
+	}{
+		{
+			name:     "fresh session",
+			origin:   &Origin{Oidc: true},
+			sess:     &session{ID: "1", Subject: "user", Start: now, LastSeen: now},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:      "active session is renewed",
+			origin:    &Origin{Oidc: true},
+			sess:      &session{ID: "1", Subject: "user", Start: now.Add(-time.Hour), LastSeen: now.Add(-5 * time.Minute)},
+			wantCode:  http.StatusOK,
+			wantRenew: true,
+		},
+		{
+			name:     "bearer session is not renewed",
+			origin:   &Origin{Oidc: true},
+			sess:     &session{ID: "1", Subject: "user", Start: now.Add(-time.Hour), LastSeen: now.Add(-5 * time.Minute)},
+			bearer:   true,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "origin idle timeout",
+			origin:   &Origin{Oidc: true, Session: &SessionConfig{IdleTimeout: 15 * time.Minute}},
+			sess:     &session{ID: "1", Subject: "user", Start: now.Add(-time.Hour), LastSeen: now.Add(-20 * time.Minute)},
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "origin absolute timeout",
+			origin:   &Origin{Oidc: true, Session: &SessionConfig{AbsoluteTimeout: 2 * time.Hour}},
+			sess:     &session{ID: "1", Subject: "user", Start: now.Add(-3 * time.Hour), LastSeen: now},
+			wantCode: http.StatusFound,
+		},
+		{
+			name:       "optional origin continues anonymously",
+			origin:     &Origin{Auth: "optional", Session: &SessionConfig{IdleTimeout: 15 * time.Minute}},
+			sess:       &session{ID: "1", Subject: "user", Start: now.Add(-time.Hour), LastSeen: now.Add(-20 * time.Minute)},
+			wantCode:   http.StatusOK,
+			wantAnonym: true,
+		},
+	}
+
+	ja := jwtauth.New("HS256", []byte(testSigningKey), nil)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(WithSigningKey(testSigningKey))
+
+			// sign a long lived token so only the origin settings are in play
+			signer := New(WithSigningKey(testSigningKey), WithSession(SessionConfig{AbsoluteTimeout: 24 * time.Hour}))
+			raw := newTestSessionToken(t, signer, tt.sess)
+
+			var anonymous bool
+
+			mw, err := s.authPolicy(ja, tt.origin, nil)
+			require.NoError(t, err)
+
+			h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tok, _, _ := jwtauth.FromContext(r.Context())
+				anonymous = tok == nil
+
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer "+raw)
+			} else {
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: raw})
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantCode, rec.Code)
+			assert.Equal(t, tt.wantAnonym, anonymous)
+			assert.Equal(t, tt.wantRenew, len(rec.Result().Cookies()) > 0)
+		})
+	}
+}
+
+func TestSessionStoreEvictsOldest(t *testing.T) {
+	ss := newSessionStore(2)
+	exp := time.Now().Add(time.Hour)
+
+	ss.touch("user", "a", exp)
+	time.Sleep(time.Millisecond)
+	ss.touch("user", "b", exp)
+	time.Sleep(time.Millisecond)
+	ss.touch("other", "x", exp)
+	ss.touch("user", "c", exp)
+
+	assert.True(t, ss.evicted("a"))
+	assert.False(t, ss.evicted("b"))
+	assert.False(t, ss.evicted("c"))
+	assert.False(t, ss.evicted("x"))
+
+	// renewing a session doesn't change its age
+	ss.touch("user", "b", exp.Add(time.Hour))
+	assert.False(t, ss.evicted("b"))
+}
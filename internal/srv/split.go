@@ -0,0 +1,328 @@
+package srv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSplitCookieTTL = 24 * time.Hour
+
+	splitCookiePrefix = "tucson_split_"
+
+	splitReasonOverride = "override"
+	splitReasonSticky   = "sticky"
+	splitReasonWeight   = "weight"
+)
+
+// SplitConfig spreads the requests of a matcher over several origins by weight, ie. for canary
+// releases
+type SplitConfig struct {
+	Origins   []SplitOrigin `mapstructure:"origins"`
+	Cookie    string        `mapstructure:"cookie"`
+	CookieTTL time.Duration `mapstructure:"cookie_ttl"`
+}
+
+// SplitOrigin is an origin of a split with its weight and the requests that always go to it
+type SplitOrigin struct {
+	Origin    string          `mapstructure:"origin"`
+	Weight    int             `mapstructure:"weight"`
+	Overrides []SplitOverride `mapstructure:"overrides"`
+}
+
+// SplitOverride matches a request header, cookie or session claim.  Without a value any
+// non-empty value matches, claims that are lists match if they contain the value.
+type SplitOverride struct {
+	Header string `mapstructure:"header"`
+	Cookie string `mapstructure:"cookie"`
+	Claim  string `mapstructure:"claim"`
+	Value  string `mapstructure:"value"`
+}
+
+// match returns true if the request matches the override
+func (ov SplitOverride) match(r *http.Request, claims map[string]interface{}) bool {
+	equal := func(v string) bool {
+		if ov.Value == "" {
+			return v != ""
+		}
+
+		return v == ov.Value
+	}
+
+	switch {
+	case ov.Header != "":
+		for _, v := range r.Header.Values(ov.Header) {
+			if equal(v) {
+				return true
+			}
+		}
+	case ov.Cookie != "":
+		if c, err := r.Cookie(ov.Cookie); err == nil {
+			return equal(c.Value)
+		}
+	case ov.Claim != "":
+		switch v := claims[ov.Claim].(type) {
+		case nil:
+		case []interface{}:
+			for _, item := range v {
+				if equal(fmt.Sprint(item)) {
+					return true
+				}
+			}
+		default:
+			return equal(fmt.Sprint(v))
+		}
+	}
+
+	return false
+}
+
+// splitVariant is an origin of a split and the handler proxying to it
+type splitVariant struct {
+	origin    string
+	overrides []SplitOverride
+	handler   http.HandlerFunc
+}
+
+// split routes the requests of a matcher to one of its variants.  The weights can be changed
+// while the server is running, everything else is fixed.
+type split struct {
+	matcher   string
+	variants  []splitVariant
+	cookie    string
+	cookieTTL time.Duration
+	logger    *zap.Logger
+	metrics   *metrics
+
+	mu      sync.RWMutex
+	weights []int
+}
+
+// splitHandler returns the handler of a matcher with a split, the variants that don't exist are
+// left out.  It falls back to the origin of the matcher if no variant is left.
+func (s *Server) splitHandler(o *Origin, m *Matcher) http.HandlerFunc {
+	sp := &split{
+		matcher:   m.Path,
+		cookie:    m.Split.Cookie,
+		cookieTTL: m.Split.CookieTTL,
+		logger:    s.logger.With(zap.String("matcher", m.Path)),
+		metrics:   s.metrics,
+	}
+
+	if sp.cookie == "" {
+		sum := sha256.Sum256([]byte(m.Path))
+		sp.cookie = splitCookiePrefix + hex.EncodeToString(sum[:4])
+	}
+
+	if sp.cookieTTL <= 0 {
+		sp.cookieTTL = defaultSplitCookieTTL
+	}
+
+	weights := map[string]int{}
+
+	for _, v := range m.Split.Origins {
+		origin, ok := s.origins[v.Origin]
+		if !ok {
+			s.logger.Error("origin not found for split, leaving it out", zap.String("origin", v.Origin), zap.String("matcher", m.Path))
+			continue
+		}
+
+		sp.variants = append(sp.variants, splitVariant{
+			origin:    v.Origin,
+			overrides: v.Overrides,
+			handler:   s.proxyOriginHandler(origin, m),
+		})
+
+		weights[v.Origin] = v.Weight
+	}
+
+	if len(sp.variants) == 0 {
+		return s.proxyOriginHandler(o, m)
+	}
+
+	sp.setWeights(weights)
+
+	s.splitsMu.Lock()
+	s.splits[m.Path] = sp
+	s.splitsMu.Unlock()
+
+	return sp.serve
+}
+
+// splitAuth holds the settings of an origin the authentication of a split matcher depends on
+type splitAuth struct {
+	Mode           string
+	PublicPaths    []string
+	ProtectedPaths []string
+	CSRF           *CSRF
+	Session        *SessionConfig
+}
+
+// checkSplitAuth returns an error if the origins of the split authenticate differently.  The
+// authentication of the matcher runs before a variant is picked, so it can only be the same
+// for all of them.
+func (s *Server) checkSplitAuth(m *Matcher) error {
+	names := []string{}
+	if m.Origin != "" {
+		names = append(names, m.Origin)
+	}
+
+	for _, v := range m.Split.Origins {
+		names = append(names, v.Origin)
+	}
+
+	var (
+		first string
+		auth  *splitAuth
+	)
+
+	for _, name := range names {
+		o, ok := s.origins[name]
+		if !ok {
+			continue
+		}
+
+		a := &splitAuth{
+			Mode:           o.authMode(),
+			PublicPaths:    o.PublicPaths,
+			ProtectedPaths: o.ProtectedPaths,
+			CSRF:           o.CSRF,
+			Session:        o.Session,
+		}
+
+		if auth == nil {
+			first, auth = name, a
+			continue
+		}
+
+		if !reflect.DeepEqual(auth, a) {
+			return fmt.Errorf("origins %q and %q of split %q authenticate differently", first, name, m.Path) //nolint:goerr113
+		}
+	}
+
+	return nil
+}
+
+// setWeights sets the weight of each variant, variants that aren't listed get no new requests
+func (sp *split) setWeights(weights map[string]int) {
+	w := make([]int, len(sp.variants))
+
+	for i, v := range sp.variants {
+		if weight := weights[v.origin]; weight > 0 {
+			w[i] = weight
+		}
+	}
+
+	sp.mu.Lock()
+	sp.weights = w
+	sp.mu.Unlock()
+}
+
+// pick returns the variant of the request and why it was picked.  Overrides come first, then
+// the sticky cookie as long as its variant still has a weight, then a weighted random choice.
+func (sp *split) pick(r *http.Request) (int, string) {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+
+	for i, v := range sp.variants {
+		for _, ov := range v.overrides {
+			if ov.match(r, claims) {
+				return i, splitReasonOverride
+			}
+		}
+	}
+
+	sp.mu.RLock()
+	weights := sp.weights
+	sp.mu.RUnlock()
+
+	if c, err := r.Cookie(sp.cookie); err == nil {
+		for i, v := range sp.variants {
+			if v.origin == c.Value && weights[i] > 0 {
+				return i, splitReasonSticky
+			}
+		}
+	}
+
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	// without weights everything goes to the first variant
+	if total == 0 {
+		return 0, splitReasonWeight
+	}
+
+	n := rand.Intn(total) //nolint:gosec
+
+	for i, w := range weights {
+		if n < w {
+			return i, splitReasonWeight
+		}
+
+		n -= w
+	}
+
+	return 0, splitReasonWeight
+}
+
+// serve proxies the request to the picked variant, requests picked by weight get a cookie that
+// keeps the user on the variant
+func (sp *split) serve(w http.ResponseWriter, r *http.Request) {
+	i, reason := sp.pick(r)
+	v := sp.variants[i]
+
+	if reason == splitReasonWeight {
+		http.SetCookie(w, &http.Cookie{
+			Name:     sp.cookie,
+			Value:    v.origin,
+			Path:     "/",
+			MaxAge:   int(sp.cookieTTL.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	sp.metrics.splitRequests.WithLabelValues(sp.matcher, v.origin, reason).Inc()
+
+	sp.logger.Debug("split picked origin", zap.String("origin", v.origin), zap.String("reason", reason))
+
+	v.handler(w, r)
+}
+
+// UpdateSplitWeights applies the split weights of the matchers to the running server, matched
+// by path.  Only the weights change, adding origins to a split requires a restart.
+func (s *Server) UpdateSplitWeights(matchers []*Matcher) {
+	s.splitsMu.Lock()
+	defer s.splitsMu.Unlock()
+
+	for _, m := range matchers {
+		if m.Split == nil {
+			continue
+		}
+
+		sp, ok := s.splits[m.Path]
+		if !ok {
+			s.logger.Warn("no split running for matcher, a restart is required", zap.String("matcher", m.Path))
+			continue
+		}
+
+		weights := map[string]int{}
+		for _, v := range m.Split.Origins {
+			weights[v.Origin] = v.Weight
+		}
+
+		sp.setWeights(weights)
+
+		s.logger.Info("updated split weights", zap.String("matcher", m.Path), zap.Any("weights", weights))
+	}
+}
@@ -0,0 +1,236 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSplitOrigins(t *testing.T) map[string]*Origin {
+	t.Helper()
+
+	origins := map[string]*Origin{}
+
+	for _, name := range []string{"stable", "canary"} {
+		name := name
+
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+
+		origins[name] = &Origin{BaseUrl: backend.URL, Auth: authOptional}
+	}
+
+	origins["default"] = origins["stable"]
+
+	return origins
+}
+
+func TestSplit(t *testing.T) {
+	split := func(stable, canary int) *SplitConfig {
+		return &SplitConfig{
+			Cookie: "variant",
+			Origins: []SplitOrigin{
+				{Origin: "stable", Weight: stable},
+				{Origin: "canary", Weight: canary, Overrides: []SplitOverride{
+					{Header: "X-Canary", Value: "1"},
+					{Cookie: "beta"},
+					{Claim: "acr", Value: "beta-testers"},
+				}},
+			},
+		}
+	}
+
+	var testCases = []struct {
+		name       string
+		split      *SplitConfig
+		header     http.Header
+		cookies    []*http.Cookie
+		acr        string
+		want       string
+		wantCookie string
+		wantReason string
+	}{
+		{
+			name:       "weight",
+			split:      split(100, 0),
+			want:       "stable",
+			wantCookie: "stable",
+			wantReason: splitReasonWeight,
+		},
+		{
+			name:       "header override",
+			split:      split(100, 0),
+			header:     http.Header{"X-Canary": []string{"1"}},
+			want:       "canary",
+			wantReason: splitReasonOverride,
+		},
+		{
+			name:       "header override other value",
+			split:      split(100, 0),
+			header:     http.Header{"X-Canary": []string{"0"}},
+			want:       "stable",
+			wantCookie: "stable",
+			wantReason: splitReasonWeight,
+		},
+		{
+			name:       "cookie override",
+			split:      split(100, 0),
+			cookies:    []*http.Cookie{{Name: "beta", Value: "yes"}},
+			want:       "canary",
+			wantReason: splitReasonOverride,
+		},
+		{
+			name:       "claim override",
+			split:      split(100, 0),
+			acr:        "beta-testers",
+			want:       "canary",
+			wantReason: splitReasonOverride,
+		},
+		{
+			name:       "sticky",
+			split:      split(100, 1),
+			cookies:    []*http.Cookie{{Name: "variant", Value: "canary"}},
+			want:       "canary",
+			wantReason: splitReasonSticky,
+		},
+		{
+			name:       "sticky to an origin without weight",
+			split:      split(100, 0),
+			cookies:    []*http.Cookie{{Name: "variant", Value: "canary"}},
+			want:       "stable",
+			wantCookie: "stable",
+			wantReason: splitReasonWeight,
+		},
+		{
+			name:       "sticky to an unknown origin",
+			split:      split(0, 100),
+			cookies:    []*http.Cookie{{Name: "variant", Value: "other"}},
+			want:       "canary",
+			wantCookie: "canary",
+			wantReason: splitReasonWeight,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, ts := newTestTucson(t, newTestSplitOrigins(t), []*Matcher{
+				{Path: "/app/*", Split: tc.split},
+			})
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/app/", nil)
+			require.NoError(t, err)
+
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+
+			for _, c := range tc.cookies {
+				req.AddCookie(c)
+			}
+
+			if tc.acr != "" {
+				sess := newTestSession("user@example.com")
+				sess.Acr = tc.acr
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: newTestSessionToken(t, s, sess)})
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, string(body))
+
+			cookie := ""
+
+			for _, c := range resp.Cookies() {
+				if c.Name == "variant" {
+					cookie = c.Value
+				}
+			}
+
+			assert.Equal(t, tc.wantCookie, cookie)
+			assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.splitRequests.WithLabelValues("/app/*", tc.want, tc.wantReason)))
+		})
+	}
+}
+
+func TestSplitWeights(t *testing.T) {
+	s, _ := newTestTucson(t, newTestSplitOrigins(t), []*Matcher{
+		{Path: "/app/*", Split: &SplitConfig{Origins: []SplitOrigin{
+			{Origin: "stable", Weight: 3},
+			{Origin: "canary", Weight: 1},
+			{Origin: "missing", Weight: 100},
+		}}},
+	})
+
+	sp := s.splits["/app/*"]
+	require.NotNil(t, sp)
+	require.Len(t, sp.variants, 2)
+
+	picks := func() map[string]int {
+		counts := map[string]int{}
+
+		for i := 0; i < 4000; i++ {
+			v, _ := sp.pick(httptest.NewRequest(http.MethodGet, "/app/", nil))
+			counts[sp.variants[v].origin]++
+		}
+
+		return counts
+	}
+
+	counts := picks()
+	assert.InDelta(t, 3000, counts["stable"], 200)
+	assert.InDelta(t, 1000, counts["canary"], 200)
+
+	// the weights change without rebuilding the routes
+	s.UpdateSplitWeights([]*Matcher{
+		{Path: "/app/*", Split: &SplitConfig{Origins: []SplitOrigin{
+			{Origin: "canary", Weight: 1},
+		}}},
+		{Path: "/unknown/*", Split: &SplitConfig{}},
+	})
+
+	assert.Equal(t, map[string]int{"canary": 4000}, picks())
+}
+
+func TestSplitAuth(t *testing.T) {
+	origins := newTestSplitOrigins(t)
+	origins["canary"].Auth = authRequired
+
+	split := &SplitConfig{Origins: []SplitOrigin{
+		{Origin: "stable", Weight: 100},
+		{Origin: "canary", Weight: 0, Overrides: []SplitOverride{{Header: "X-Canary"}}},
+	}}
+
+	s, ts := newTestTucson(t, origins, []*Matcher{
+		{Path: "/app/*", Split: split},
+	})
+
+	assert.Error(t, s.Validate())
+
+	// the matcher requires authentication rather than exposing the canary
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/app/", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Canary", "1")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	origins["canary"].Auth = authOptional
+	assert.NoError(t, s.Validate())
+}
@@ -0,0 +1,317 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+
+	// defaultBodyTimeout limits how long clients take to send the request body, so slow
+	// clients can't hold on to connections and spool files forever
+	defaultBodyTimeout = 300 * time.Second
+)
+
+var (
+	errResponseHeaderTimeout = errors.New("timeout awaiting response headers from origin")
+	errStreamIdleTimeout     = errors.New("origin response idle for too long")
+	errRequestBodyTimeout    = errors.New("timeout reading request body")
+)
+
+type timeoutsContextKey struct{}
+
+// TimeoutConfig configures the timeouts of requests to an origin, matchers can override the
+// body, response_header, idle and total timeouts
+type TimeoutConfig struct {
+	Connect        time.Duration `mapstructure:"connect"`
+	TLSHandshake   time.Duration `mapstructure:"tls_handshake"`
+	Body           time.Duration `mapstructure:"body"`
+	ResponseHeader time.Duration `mapstructure:"response_header"`
+	Idle           time.Duration `mapstructure:"idle"`
+	Total          time.Duration `mapstructure:"total"`
+}
+
+// merge returns a copy of the config with the values set in o overriding it
+func (c *TimeoutConfig) merge(o *TimeoutConfig) TimeoutConfig {
+	cfg := TimeoutConfig{}
+	if c != nil {
+		cfg = *c
+	}
+
+	if o == nil {
+		return cfg
+	}
+
+	if o.Connect != 0 {
+		cfg.Connect = o.Connect
+	}
+
+	if o.TLSHandshake != 0 {
+		cfg.TLSHandshake = o.TLSHandshake
+	}
+
+	if o.Body != 0 {
+		cfg.Body = o.Body
+	}
+
+	if o.ResponseHeader != 0 {
+		cfg.ResponseHeader = o.ResponseHeader
+	}
+
+	if o.Idle != 0 {
+		cfg.Idle = o.Idle
+	}
+
+	if o.Total != 0 {
+		cfg.Total = o.Total
+	}
+
+	return cfg
+}
+
+// timeouts returns the timeouts of the origin, the transport dial and tls handshake timeouts
+// are the legacy names of the connect and tls handshake timeouts
+func (o *Origin) timeouts() TimeoutConfig {
+	cfg := (&TimeoutConfig{Body: defaultBodyTimeout, ResponseHeader: defaultResponseHeaderTimeout}).merge(o.Timeouts)
+
+	tr := o.Transport.withDefaults()
+
+	if cfg.Connect == 0 {
+		cfg.Connect = tr.DialTimeout
+	}
+
+	if cfg.TLSHandshake == 0 {
+		cfg.TLSHandshake = tr.TLSHandshakeTimeout
+	}
+
+	return cfg
+}
+
+// withTimeouts returns a copy of the context with the timeouts of the request
+func withTimeouts(ctx context.Context, cfg TimeoutConfig) context.Context {
+	return context.WithValue(ctx, timeoutsContextKey{}, cfg)
+}
+
+func timeoutsFromContext(ctx context.Context) (TimeoutConfig, bool) {
+	cfg, ok := ctx.Value(timeoutsContextKey{}).(TimeoutConfig)
+	return cfg, ok
+}
+
+// timeoutTransport enforces the response header and idle timeouts of each request to the
+// origin, they can differ per matcher so they can't be set on the transport
+type timeoutTransport struct {
+	next     http.RoundTripper
+	timeouts TimeoutConfig
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg, ok := timeoutsFromContext(req.Context())
+	if !ok {
+		cfg = t.timeouts
+	}
+
+	if cfg.ResponseHeader <= 0 && cfg.Idle <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+
+	var (
+		timedOut    int32
+		mu          sync.Mutex
+		done        bool
+		headerTimer *time.Timer
+	)
+
+	// the response header timeout starts once the request has been written, so it doesn't cut
+	// off uploads that take longer
+	if cfg.ResponseHeader > 0 {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if done {
+					return
+				}
+
+				if headerTimer != nil {
+					headerTimer.Stop()
+				}
+
+				headerTimer = time.AfterFunc(cfg.ResponseHeader, func() {
+					atomic.StoreInt32(&timedOut, 1)
+					cancel()
+				})
+			},
+		})
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+
+	mu.Lock()
+	done = true
+	timer := headerTimer
+	mu.Unlock()
+
+	if timer != nil && !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 {
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		cancel()
+
+		return nil, errResponseHeaderTimeout
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the body of an upgraded connection is the connection itself, it is closed by the proxy
+	// and no longer bound to the request context
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		cancel()
+		return resp, nil
+	}
+
+	body := &timeoutBody{ReadCloser: resp.Body, cancel: cancel, idle: cfg.Idle}
+	if cfg.Idle > 0 {
+		body.timer = time.AfterFunc(cfg.Idle, func() {
+			atomic.StoreInt32(&body.timedOut, 1)
+			cancel()
+		})
+	}
+
+	resp.Body = body
+
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped transport
+func (t *timeoutTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+// timeoutBody cancels the request if no data is read from the origin within the idle
+// timeout, and releases the request context once it is closed
+type timeoutBody struct {
+	io.ReadCloser
+
+	cancel   context.CancelFunc
+	idle     time.Duration
+	timer    *time.Timer
+	timedOut int32
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if atomic.LoadInt32(&b.timedOut) == 1 {
+		return n, errStreamIdleTimeout
+	}
+
+	if b.timer != nil && n > 0 {
+		b.timer.Reset(b.idle)
+	}
+
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// limitBodyTime fails reads of the request body once it took longer than d to send, a
+// negative d disables the limit
+func limitBodyTime(r *http.Request, d time.Duration) {
+	if r.Body == nil || r.Body == http.NoBody || d <= 0 {
+		return
+	}
+
+	b := &deadlineBody{ReadCloser: r.Body, expired: make(chan struct{})}
+	b.timer = time.AfterFunc(d, func() { close(b.expired) })
+
+	r.Body = b
+}
+
+// deadlineBody is a request body that fails with errRequestBodyTimeout once its deadline
+// expired.  Reads of the client connection can't be interrupted without changing its deadline,
+// so they happen in the background and a read still blocked at the deadline is abandoned, it
+// returns once the client sends more or closes the connection after the error response.
+type deadlineBody struct {
+	io.ReadCloser
+
+	timer   *time.Timer
+	expired chan struct{}
+	buf     []byte
+	err     error
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	select {
+	case <-b.expired:
+		b.err = errRequestBodyTimeout
+		return 0, b.err
+	default:
+	}
+
+	// the background read gets a buffer of its own, it may still write to it after the
+	// deadline when p belongs to the caller again
+	if len(b.buf) < len(p) {
+		b.buf = make([]byte, len(p))
+	}
+
+	buf := b.buf[:len(p)]
+	done := make(chan readResult, 1)
+
+	go func() {
+		n, err := b.ReadCloser.Read(buf)
+		done <- readResult{n: n, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return copy(p, buf[:res.n]), res.err
+	case <-b.expired:
+		b.err = errRequestBodyTimeout
+		return 0, b.err
+	}
+}
+
+func (b *deadlineBody) Close() error {
+	b.timer.Stop()
+
+	// an abandoned read may still hold the body, the server closes it once the read returns
+	select {
+	case <-b.expired:
+		return nil
+	default:
+		return b.ReadCloser.Close()
+	}
+}
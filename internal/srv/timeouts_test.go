@@ -0,0 +1,283 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginTimeouts(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		origin  Origin
+		matcher *TimeoutConfig
+		want    TimeoutConfig
+	}{
+		{
+			name:   "defaults",
+			origin: Origin{},
+			want: TimeoutConfig{
+				Connect:        defaultDialTimeout,
+				TLSHandshake:   defaultTLSHandshakeTimeout,
+				Body:           defaultBodyTimeout,
+				ResponseHeader: defaultResponseHeaderTimeout,
+			},
+		},
+		{
+			name: "legacy transport timeouts",
+			origin: Origin{Transport: &TransportConfig{
+				DialTimeout:         time.Second,
+				TLSHandshakeTimeout: 2 * time.Second,
+			}},
+			want: TimeoutConfig{
+				Connect:        time.Second,
+				TLSHandshake:   2 * time.Second,
+				Body:           defaultBodyTimeout,
+				ResponseHeader: defaultResponseHeaderTimeout,
+			},
+		},
+		{
+			name: "timeouts win over transport",
+			origin: Origin{
+				Transport: &TransportConfig{DialTimeout: time.Second},
+				Timeouts:  &TimeoutConfig{Connect: 3 * time.Second, Total: time.Minute},
+			},
+			want: TimeoutConfig{
+				Connect:        3 * time.Second,
+				TLSHandshake:   defaultTLSHandshakeTimeout,
+				Body:           defaultBodyTimeout,
+				ResponseHeader: defaultResponseHeaderTimeout,
+				Total:          time.Minute,
+			},
+		},
+		{
+			name:    "matcher overrides",
+			origin:  Origin{Timeouts: &TimeoutConfig{Idle: time.Second, Total: time.Minute}},
+			matcher: &TimeoutConfig{Body: -1, ResponseHeader: time.Hour, Total: time.Hour},
+			want: TimeoutConfig{
+				Connect:        defaultDialTimeout,
+				TLSHandshake:   defaultTLSHandshakeTimeout,
+				Body:           -1,
+				ResponseHeader: time.Hour,
+				Idle:           time.Second,
+				Total:          time.Hour,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			timeouts := tc.origin.timeouts()
+			assert.Equal(t, tc.want, timeouts.merge(tc.matcher))
+		})
+	}
+}
+
+// newSlowBackend returns a backend that waits before sending the headers, then sends chunks
+// of the body every interval
+func newSlowBackend(t *testing.T, headerDelay time.Duration, chunks int, interval time.Duration) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(headerDelay):
+		case <-r.Context().Done():
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for i := 0; i < chunks; i++ {
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+
+			_, _ = io.WriteString(w, "chunk\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		headerDelay time.Duration
+		chunks      int
+		interval    time.Duration
+		timeouts    *TimeoutConfig
+		matcher     *TimeoutConfig
+		wantCode    int
+		wantChunks  int
+		wantErr     bool
+	}{
+		{
+			name:        "response header timeout",
+			headerDelay: 200 * time.Millisecond,
+			timeouts:    &TimeoutConfig{ResponseHeader: 50 * time.Millisecond},
+			wantCode:    http.StatusGatewayTimeout,
+		},
+		{
+			name:        "matcher response header override",
+			headerDelay: 100 * time.Millisecond,
+			timeouts:    &TimeoutConfig{ResponseHeader: 50 * time.Millisecond},
+			matcher:     &TimeoutConfig{ResponseHeader: time.Second},
+			wantCode:    http.StatusOK,
+		},
+		{
+			name:       "streams longer than the idle timeout",
+			chunks:     8,
+			interval:   20 * time.Millisecond,
+			timeouts:   &TimeoutConfig{Idle: 100 * time.Millisecond},
+			wantCode:   http.StatusOK,
+			wantChunks: 8,
+		},
+		{
+			name:     "idle stream",
+			chunks:   2,
+			interval: 200 * time.Millisecond,
+			timeouts: &TimeoutConfig{Idle: 50 * time.Millisecond},
+			wantCode: http.StatusOK,
+			wantErr:  true,
+		},
+		{
+			name:     "total timeout",
+			chunks:   10,
+			interval: 20 * time.Millisecond,
+			timeouts: &TimeoutConfig{Total: 100 * time.Millisecond},
+			wantCode: http.StatusOK,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newSlowBackend(t, tc.headerDelay, tc.chunks, tc.interval)
+
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: backend.URL, Timeouts: tc.timeouts},
+			}, []*Matcher{
+				{Path: "/matched", Origin: "default", Timeouts: tc.matcher},
+			})
+
+			resp, err := http.Get(ts.URL + "/matched")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tc.wantCode, resp.StatusCode)
+
+			body, err := io.ReadAll(resp.Body)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantChunks, strings.Count(string(body), "chunk"))
+		})
+	}
+}
+
+func TestSlowUploadResponseHeaderTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL, Timeouts: &TimeoutConfig{ResponseHeader: 50 * time.Millisecond}},
+	}, []*Matcher{})
+
+	// the upload takes longer than the response header timeout
+	pr, pw := io.Pipe()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			_, _ = io.WriteString(pw, "chunk")
+			time.Sleep(30 * time.Millisecond)
+		}
+
+		pw.Close()
+	}()
+
+	resp, err := http.Post(ts.URL, "text/plain", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strings.Repeat("chunk", 5), string(body))
+}
+
+func TestSlowUploadBodyTimeout(t *testing.T) {
+	var testCases = []struct {
+		name  string
+		spool *SpoolConfig
+	}{
+		{name: "streamed"},
+		{name: "spooled", spool: &SpoolConfig{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits int32
+
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {
+					BaseUrl:  newTestEchoBackend(t, &hits).URL,
+					Spool:    tc.spool,
+					Timeouts: &TimeoutConfig{Body: 50 * time.Millisecond},
+				},
+			}, []*Matcher{})
+
+			// the client stops sending halfway through the body
+			pr, pw := io.Pipe()
+			defer pw.Close()
+
+			go func() {
+				_, _ = io.WriteString(pw, "chunk")
+			}()
+
+			resp, err := http.Post(ts.URL, "text/plain", pr)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+
+			if tc.spool != nil {
+				assert.Zero(t, atomic.LoadInt32(&hits))
+			}
+		})
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	s := New(
+		WithDefaultOrigin(&Origin{BaseUrl: "http://localhost"}),
+		WithReadHeaderTimeout(5*time.Second),
+	)
+
+	httpsrv := s.NewServer()
+
+	assert.Equal(t, 5*time.Second, httpsrv.ReadHeaderTimeout)
+	assert.Equal(t, defaultIdleTimeout, httpsrv.IdleTimeout)
+
+	// streams and large downloads aren't cut off
+	assert.Zero(t, httpsrv.ReadTimeout)
+	assert.Zero(t, httpsrv.WriteTimeout)
+}
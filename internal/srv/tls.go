@@ -0,0 +1,421 @@
+package srv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tlsReloadInterval is how often the tls files of an origin are checked for changes, the
+// check happens on the next handshake
+const tlsReloadInterval = 10 * time.Second
+
+var (
+	errInvalidOriginTLS = errors.New("origin tls configuration is invalid")
+	errPinMismatch      = errors.New("tls: origin certificate does not match any pin")
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// TLSConfig configures tls connections to the targets of an origin
+type TLSConfig struct {
+	CAFile         string   `mapstructure:"ca_file"`
+	CertFile       string   `mapstructure:"cert_file"`
+	KeyFile        string   `mapstructure:"key_file"`
+	ServerName     string   `mapstructure:"server_name"`
+	MinVersion     string   `mapstructure:"min_version"`
+	CipherSuites   []string `mapstructure:"cipher_suites"`
+	PinnedCertFile string   `mapstructure:"pinned_cert_file"`
+	PinnedSPKI     []string `mapstructure:"pinned_spki"`
+}
+
+// loadTLSFiles loads the certificates, the ca bundle and pinned certificates of the origin,
+// nil if it has none
+func (o *Origin) loadTLSFiles(logger *zap.Logger) (*tlsFiles, error) {
+	if o.TLS == nil {
+		return nil, nil
+	}
+
+	cfg := *o.TLS
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && cfg.PinnedCertFile == "" {
+		return nil, nil
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("%w: cert_file and key_file must be set together", errInvalidOriginTLS)
+	}
+
+	files := &tlsFiles{cfg: cfg, logger: logger, interval: tlsReloadInterval, now: time.Now}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// newTLSConfig builds the client tls config of the origin from the material loaded from its
+// tls files (if any).  The ca bundle replaces the system roots of the standard verification,
+// so the certificate is checked against the target host or server_name.
+func (o *Origin) newTLSConfig(m *tlsMaterial) (*tls.Config, error) {
+	tlsConfig := &tls.Config{} //nolint:gosec
+	if o.Insecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if o.TLS == nil {
+		return tlsConfig, nil
+	}
+
+	cfg := *o.TLS
+	tlsConfig.ServerName = cfg.ServerName
+
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown min_version %q", errInvalidOriginTLS, cfg.MinVersion)
+		}
+
+		tlsConfig.MinVersion = v
+	}
+
+	suites, err := cipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.CipherSuites = suites
+
+	pins := map[string]bool{}
+
+	for _, pin := range cfg.PinnedSPKI {
+		pin = strings.TrimPrefix(pin, "sha256/")
+
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%w: pinned_spki %q is not a base64 sha256 hash", errInvalidOriginTLS, pin)
+		}
+
+		pins[pin] = true
+	}
+
+	if m == nil {
+		m = &tlsMaterial{}
+	}
+
+	tlsConfig.RootCAs = m.roots
+
+	if m.cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*m.cert}
+	}
+
+	if len(pins) == 0 && len(m.pinnedCerts) == 0 {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		return verifyPins(cs, pins, m.pinnedCerts)
+	}
+
+	return tlsConfig, nil
+}
+
+// checkTLS returns an error if the tls configuration of the origin is invalid or its files
+// can't be loaded
+func (o *Origin) checkTLS() error {
+	files, err := o.loadTLSFiles(zap.NewNop())
+	if err != nil {
+		return err
+	}
+
+	var m *tlsMaterial
+	if files != nil {
+		m = files.current()
+	}
+
+	_, err = o.newTLSConfig(m)
+
+	return err
+}
+
+// tlsReloadTransport rebuilds the transport of an origin when its tls files change, so new
+// connections use the new material while idle connections made with the old one are closed
+type tlsReloadTransport struct {
+	files  *tlsFiles
+	build  func(*tlsMaterial) (http.RoundTripper, error)
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	material *tlsMaterial
+	current  http.RoundTripper
+}
+
+func newTLSReloadTransport(files *tlsFiles, logger *zap.Logger, build func(*tlsMaterial) (http.RoundTripper, error)) (*tlsReloadTransport, error) {
+	m := files.current()
+
+	tr, err := build(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsReloadTransport{files: files, build: build, logger: logger, material: m, current: tr}, nil
+}
+
+func (t *tlsReloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport().RoundTrip(req)
+}
+
+// transport returns the transport for the current tls material
+func (t *tlsReloadTransport) transport() http.RoundTripper {
+	m := t.files.current()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if m == t.material {
+		return t.current
+	}
+
+	tr, err := t.build(m)
+	if err != nil {
+		t.logger.Error("failed to rebuild the origin transport, keeping the previous tls material", zap.Error(err))
+		return t.current
+	}
+
+	closeIdleConnections(t.current)
+	t.material, t.current = m, tr
+
+	return tr
+}
+
+func (t *tlsReloadTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	closeIdleConnections(t.current)
+}
+
+// cipherSuites returns the ids of the named cipher suites
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown cipher suite %q", errInvalidOriginTLS, name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// verifyPins checks the certificates of the origin against the pins, any certificate in the
+// chain can match an spki pin while a pinned certificate has to be the leaf
+func verifyPins(cs tls.ConnectionState, spki map[string]bool, certs [][]byte) error {
+	if len(spki) == 0 && len(certs) == 0 {
+		return nil
+	}
+
+	if len(cs.PeerCertificates) == 0 {
+		return errPinMismatch
+	}
+
+	for _, c := range cs.PeerCertificates {
+		sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		if spki[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+
+	for _, raw := range certs {
+		if bytes.Equal(cs.PeerCertificates[0].Raw, raw) {
+			return nil
+		}
+	}
+
+	return errPinMismatch
+}
+
+// tlsMaterial is what was loaded from the tls files of an origin
+type tlsMaterial struct {
+	roots       *x509.CertPool
+	cert        *tls.Certificate
+	pinnedCerts [][]byte
+}
+
+// tlsFiles loads the tls files of an origin and reloads them when they change
+type tlsFiles struct {
+	cfg      TLSConfig
+	logger   *zap.Logger
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes map[string]time.Time
+	material *tlsMaterial
+}
+
+// current returns the loaded material, reloading it first if the files changed
+func (f *tlsFiles) current() *tlsMaterial {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	if now.Sub(f.checked) < f.interval {
+		return f.material
+	}
+
+	f.checked = now
+
+	if !f.changed() {
+		return f.material
+	}
+
+	if err := f.loadLocked(); err != nil {
+		f.logger.Error("failed to reload origin tls files, keeping the previous ones", zap.Error(err))
+		return f.material
+	}
+
+	f.logger.Info("reloaded origin tls files")
+
+	return f.material
+}
+
+func (f *tlsFiles) paths() []string {
+	paths := []string{}
+
+	for _, p := range []string{f.cfg.CAFile, f.cfg.CertFile, f.cfg.KeyFile, f.cfg.PinnedCertFile} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths
+}
+
+// changed returns true if any of the files were modified since they were loaded
+func (f *tlsFiles) changed() bool {
+	for _, p := range f.paths() {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.ModTime().Equal(f.modTimes[p]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *tlsFiles) load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.checked = f.now()
+
+	return f.loadLocked()
+}
+
+func (f *tlsFiles) loadLocked() error {
+	m := &tlsMaterial{}
+	modTimes := map[string]time.Time{}
+
+	// the mod times are taken before reading, a change while reading is loaded next time
+	for _, p := range f.paths() {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidOriginTLS, err)
+		}
+
+		modTimes[p] = fi.ModTime()
+	}
+
+	if f.cfg.CAFile != "" {
+		bundle, err := os.ReadFile(f.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidOriginTLS, err)
+		}
+
+		m.roots = x509.NewCertPool()
+		if !m.roots.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("%w: no certificates found in %s", errInvalidOriginTLS, f.cfg.CAFile)
+		}
+	}
+
+	if f.cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.cfg.CertFile, f.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidOriginTLS, err)
+		}
+
+		m.cert = &cert
+	}
+
+	if f.cfg.PinnedCertFile != "" {
+		certs, err := readPEMCertificates(f.cfg.PinnedCertFile)
+		if err != nil {
+			return err
+		}
+
+		m.pinnedCerts = certs
+	}
+
+	f.material = m
+	f.modTimes = modTimes
+
+	return nil
+}
+
+// readPEMCertificates returns the der encoded certificates in the pem file
+func readPEMCertificates(path string) ([][]byte, error) {
+	rest, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidOriginTLS, err)
+	}
+
+	certs := [][]byte{}
+
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block.Bytes)
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: no certificates found in %s", errInvalidOriginTLS, path)
+	}
+
+	return certs, nil
+}
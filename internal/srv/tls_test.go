@@ -0,0 +1,384 @@
+package srv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testCA issues certificates for tls tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tucson test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for the host names and ip addresses, and its pem encoded
+// certificate and key
+func (ca *testCA) issue(t *testing.T, names ...string) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	return cert, certPEM, keyPEM
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	return path
+}
+
+func spkiPin(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestOriginTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCA(t)
+	other := newTestCA(t)
+
+	serverCert, serverPEM, _ := ca.issue(t, "backend.internal", "127.0.0.1")
+	namedCert, _, _ := ca.issue(t, "backend.internal")
+	_, clientPEM, clientKeyPEM := ca.issue(t, "tucson")
+	_, otherPEM, otherKeyPEM := other.issue(t, "tucson")
+	unusedCert, _, _ := ca.issue(t, "unused.internal")
+
+	caFile := writeTestFile(t, dir, "ca.pem", ca.pem)
+	otherCAFile := writeTestFile(t, dir, "other-ca.pem", other.pem)
+	clientCert := writeTestFile(t, dir, "client.pem", clientPEM)
+	clientKey := writeTestFile(t, dir, "client-key.pem", clientKeyPEM)
+	otherCert := writeTestFile(t, dir, "other.pem", otherPEM)
+	otherKey := writeTestFile(t, dir, "other-key.pem", otherKeyPEM)
+	pinnedCert := writeTestFile(t, dir, "pinned.pem", serverPEM)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	mtlsBackend := httptest.NewUnstartedServer(backend.Config.Handler)
+	mtlsBackend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	mtlsBackend.StartTLS()
+	defer mtlsBackend.Close()
+
+	// the certificate of this backend isn't valid for the ip it is reached at
+	namedBackend := httptest.NewUnstartedServer(backend.Config.Handler)
+	namedBackend.TLS = &tls.Config{Certificates: []tls.Certificate{namedCert}}
+	namedBackend.StartTLS()
+	defer namedBackend.Close()
+
+	var testCases = []struct {
+		name     string
+		url      string
+		insecure bool
+		tls      *TLSConfig
+		wantCode int
+	}{
+		{
+			name:     "unknown ca",
+			url:      backend.URL,
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "ca file",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: caFile},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "wrong ca file",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: otherCAFile},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "ca file with the wrong ip",
+			url:      namedBackend.URL,
+			tls:      &TLSConfig{CAFile: caFile},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "ca file with the server name of an ip target",
+			url:      namedBackend.URL,
+			tls:      &TLSConfig{CAFile: caFile, ServerName: "backend.internal"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "server name",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: caFile, ServerName: "backend.internal"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "wrong server name",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: caFile, ServerName: "other.internal"},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "client certificate",
+			url:      mtlsBackend.URL,
+			tls:      &TLSConfig{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "missing client certificate",
+			url:      mtlsBackend.URL,
+			tls:      &TLSConfig{CAFile: caFile},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "untrusted client certificate",
+			url:      mtlsBackend.URL,
+			tls:      &TLSConfig{CAFile: caFile, CertFile: otherCert, KeyFile: otherKey},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "spki pin",
+			url:      backend.URL,
+			insecure: true,
+			tls:      &TLSConfig{PinnedSPKI: []string{"sha256/" + spkiPin(t, serverCert)}},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "spki pin mismatch",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: caFile, PinnedSPKI: []string{spkiPin(t, unusedCert)}},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "pinned certificate",
+			url:      backend.URL,
+			insecure: true,
+			tls:      &TLSConfig{PinnedCertFile: pinnedCert},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "pinned certificate mismatch",
+			url:      backend.URL,
+			insecure: true,
+			tls:      &TLSConfig{PinnedCertFile: clientCert},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "min version",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: caFile, MinVersion: "1.3"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "invalid min version",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: caFile, MinVersion: "1.4"},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "invalid cipher suite",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: caFile, CipherSuites: []string{"TLS_NOPE"}},
+			wantCode: http.StatusBadGateway,
+		},
+		{
+			name:     "missing ca file",
+			url:      backend.URL,
+			tls:      &TLSConfig{CAFile: filepath.Join(dir, "missing.pem")},
+			wantCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, ts := newTestTucson(t, map[string]*Origin{
+				"default": {BaseUrl: tc.url, Insecure: tc.insecure, TLS: tc.tls},
+			}, nil)
+
+			resp, err := http.Get(ts.URL + "/")
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.wantCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestTLSFilesReload(t *testing.T) {
+	dir := t.TempDir()
+
+	first := newTestCA(t)
+	second := newTestCA(t)
+
+	caFile := writeTestFile(t, dir, "ca.pem", first.pem)
+
+	now := time.Now()
+	files := &tlsFiles{
+		cfg:      TLSConfig{CAFile: caFile},
+		logger:   zap.NewNop(),
+		interval: time.Minute,
+		now:      func() time.Time { return now },
+	}
+	require.NoError(t, files.load())
+
+	subjects := func() int {
+		return len(files.current().roots.Subjects()) //nolint:staticcheck
+	}
+
+	require.Equal(t, 1, subjects())
+
+	writeTestFile(t, dir, "ca.pem", append(first.pem, second.pem...))
+	require.NoError(t, os.Chtimes(caFile, now.Add(time.Second), now.Add(time.Second)))
+
+	// not checked again before the interval
+	assert.Equal(t, 1, subjects())
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, 2, subjects())
+
+	// a broken file keeps the previous material
+	writeTestFile(t, dir, "ca.pem", []byte("garbage"))
+	require.NoError(t, os.Chtimes(caFile, now.Add(2*time.Second), now.Add(2*time.Second)))
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, 2, subjects())
+}
+
+func TestTLSReloadTransport(t *testing.T) {
+	dir := t.TempDir()
+
+	first := newTestCA(t)
+	second := newTestCA(t)
+
+	serverCert, _, _ := second.issue(t, "127.0.0.1")
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := writeTestFile(t, dir, "ca.pem", first.pem)
+
+	o := &Origin{BaseUrl: backend.URL, TLS: &TLSConfig{CAFile: caFile}}
+
+	rt, err := o.newTransport(zap.NewNop(), nil)
+	require.NoError(t, err)
+
+	reload, ok := rt.(*tlsReloadTransport)
+	require.True(t, ok)
+
+	reload.files.interval = 0
+
+	client := &http.Client{Transport: rt}
+
+	_, err = client.Get(backend.URL)
+	require.Error(t, err)
+
+	// the new bundle is used by a new transport
+	writeTestFile(t, dir, "ca.pem", second.pem)
+	require.NoError(t, os.Chtimes(caFile, time.Now().Add(time.Second), time.Now().Add(time.Second)))
+
+	resp, err := client.Get(backend.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
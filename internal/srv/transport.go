@@ -0,0 +1,223 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultMaxIdleConns          = 100
+	defaultMaxIdleConnsPerHost   = 32
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultKeepAlive             = 30 * time.Second
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultExpectContinueTimeout = 1 * time.Second
+	defaultResponseHeaderTimeout = 180 * time.Second
+
+	// h2ReadIdleTimeout is how long an http/2 connection can be idle before it is health checked with a ping
+	h2ReadIdleTimeout = 30 * time.Second
+)
+
+const (
+	protocolHTTP1 = "http1"
+	protocolH2    = "h2"
+	protocolH2C   = "h2c"
+	protocolGRPC  = "grpc"
+)
+
+// protocol returns the protocol used to talk to the origin
+func (o *Origin) protocol() string {
+	switch p := strings.ToLower(o.Protocol); p {
+	case protocolH2, protocolH2C, protocolGRPC:
+		return p
+	}
+
+	return protocolHTTP1
+}
+
+// checkProtocol returns an error if the protocol isn't one tucson speaks
+func (o *Origin) checkProtocol() error {
+	switch strings.ToLower(o.Protocol) {
+	case "", protocolHTTP1, protocolH2, protocolH2C, protocolGRPC:
+		return nil
+	}
+
+	return fmt.Errorf("unknown protocol %q", o.Protocol) //nolint:goerr113
+}
+
+// h2c returns true if the origin speaks cleartext http/2, grpc without tls is always h2c
+func (o *Origin) h2c() bool {
+	switch o.protocol() {
+	case protocolH2C:
+		return true
+	case protocolGRPC:
+		targets := o.targets()
+		return len(targets) > 0 && !strings.HasPrefix(strings.ToLower(targets[0].URL), "https://")
+	}
+
+	return false
+}
+
+// TransportConfig tunes the connection pool to an origin
+type TransportConfig struct {
+	MaxIdleConns        int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `mapstructure:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`
+	KeepAlive           time.Duration `mapstructure:"keep_alive"`
+	DialTimeout         time.Duration `mapstructure:"dial_timeout"`
+	TLSHandshakeTimeout time.Duration `mapstructure:"tls_handshake_timeout"`
+}
+
+// withDefaults returns a copy of the config with unset values replaced by the defaults
+func (c *TransportConfig) withDefaults() TransportConfig {
+	cfg := TransportConfig{}
+	if c != nil {
+		cfg = *c
+	}
+
+	if cfg.MaxIdleConns == 0 {
+		cfg.MaxIdleConns = defaultMaxIdleConns
+	}
+
+	if cfg.MaxIdleConnsPerHost == 0 {
+		cfg.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	if cfg.IdleConnTimeout == 0 {
+		cfg.IdleConnTimeout = defaultIdleConnTimeout
+	}
+
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = defaultKeepAlive
+	}
+
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+
+	if cfg.TLSHandshakeTimeout == 0 {
+		cfg.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	return cfg
+}
+
+// newTransport builds the long lived transport used for all requests to the origin, egress is
+// the default egress proxy for origins without their own
+func (o *Origin) newTransport(logger *zap.Logger, egress *EgressProxyConfig) (http.RoundTripper, error) {
+	cfg := o.Transport.withDefaults()
+	timeouts := o.timeouts()
+
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Connect,
+		KeepAlive: cfg.KeepAlive,
+	}
+
+	egressProxy, err := o.egressProxy(egress)
+	if err != nil {
+		return nil, err
+	}
+
+	build := func(m *tlsMaterial) (http.RoundTripper, error) {
+		tlsConfig, err := o.newTLSConfig(m)
+		if err != nil {
+			return nil, err
+		}
+
+		tr := &http.Transport{
+			Proxy:                 egressProxy.proxyFunc(),
+			DialContext:           dialContext(dialer),
+			TLSClientConfig:       tlsConfig,
+			MaxIdleConns:          cfg.MaxIdleConns,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       cfg.MaxConnsPerHost,
+			IdleConnTimeout:       cfg.IdleConnTimeout,
+			TLSHandshakeTimeout:   timeouts.TLSHandshake,
+			ExpectContinueTimeout: defaultExpectContinueTimeout,
+		}
+
+		// cleartext http/2 needs the http2 transport, it can't be negotiated
+		if o.h2c() {
+			return newH2CTransport(tr, func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return egressProxy.dialer(dialer)(ctx, network, addr)
+			})
+		}
+
+		switch o.protocol() {
+		case protocolH2, protocolGRPC:
+			tr.ForceAttemptHTTP2 = true
+
+			// a fresh transport can't already be configured, so this never fails
+			if h2, err := http2.ConfigureTransports(tr); err == nil {
+				h2.ReadIdleTimeout = h2ReadIdleTimeout
+			}
+		}
+
+		return tr, nil
+	}
+
+	files, err := o.loadTLSFiles(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// the tls config can't change once the transport uses it, a change of the tls files
+	// builds a new transport
+	if files != nil {
+		return newTLSReloadTransport(files, logger, build)
+	}
+
+	return build(nil)
+}
+
+// newH2CTransport returns an http2 transport for cleartext origins.  It is configured from the
+// http transport so it shares its idle timeout and other settings, but dials its own
+// connections with the context of the request that needs one.
+func newH2CTransport(tr *http.Transport, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*http2.Transport, error) {
+	h2, err := http2.ConfigureTransports(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the configured pool only takes connections upgraded by the http transport, the default
+	// pool dials them
+	h2.ConnPool = nil
+	h2.AllowHTTP = true
+	h2.ReadIdleTimeout = h2ReadIdleTimeout
+	h2.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return dial(ctx, network, addr)
+	}
+
+	return h2, nil
+}
+
+// failingTransport fails every request, it stands in for the transport of a misconfigured
+// origin
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	return nil, t.err
+}
+
+// closeIdleConnections closes the idle connections of transports that pool connections
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
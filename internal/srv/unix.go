@@ -0,0 +1,79 @@
+package srv
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	unixScheme = "unix://"
+
+	// unixHostSuffix marks the url host of a unix socket target, the host is the hex encoded
+	// socket path so every socket gets its own connection pool
+	unixHostSuffix = ".unix.localhost"
+
+	// unixRequestHost is the Host header sent to unix socket targets
+	unixRequestHost = "localhost"
+)
+
+// isUnixURL returns true if the target url is a unix socket
+func isUnixURL(raw string) bool {
+	return strings.HasPrefix(strings.ToLower(raw), unixScheme)
+}
+
+// parseUnixURL parses a unix:///path/to/app.sock target url, an http path prefix can follow
+// the socket path after a colon, ie. unix:///run/app.sock:/api.  The prefix starts at the last
+// ":/" so socket paths can contain colons.
+func parseUnixURL(raw string) (*url.URL, string, error) {
+	rest := raw[len(unixScheme):]
+
+	socket, prefix := rest, ""
+	if i := strings.LastIndex(rest, ":/"); i > 0 {
+		socket, prefix = rest[:i], rest[i+1:]
+	}
+
+	if !strings.HasPrefix(socket, "/") {
+		return nil, "", fmt.Errorf("unix socket path in %q must be absolute", raw) //nolint:goerr113
+	}
+
+	u, err := url.Parse("http://" + hex.EncodeToString([]byte(socket)) + unixHostSuffix + prefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return u, socket, nil
+}
+
+// unixSocket returns the socket path of a dial address of a unix socket target
+func unixSocket(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	if !strings.HasSuffix(host, unixHostSuffix) {
+		return "", false
+	}
+
+	socket, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+	if err != nil {
+		return "", false
+	}
+
+	return string(socket), true
+}
+
+// dialContext dials the address with the dialer, or the unix socket it stands for
+func dialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socket, ok := unixSocket(addr); ok {
+			return d.DialContext(ctx, "unix", socket)
+		}
+
+		return d.DialContext(ctx, network, addr)
+	}
+}
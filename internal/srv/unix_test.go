@@ -0,0 +1,110 @@
+package srv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUnixURL(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		url        string
+		wantSocket string
+		wantPath   string
+		wantErr    bool
+	}{
+		{
+			name:       "socket",
+			url:        "unix:///run/app.sock",
+			wantSocket: "/run/app.sock",
+		},
+		{
+			name:       "path prefix",
+			url:        "unix:///run/app.sock:/api/v1",
+			wantSocket: "/run/app.sock",
+			wantPath:   "/api/v1",
+		},
+		{
+			name:    "relative socket",
+			url:     "unix://run/app.sock",
+			wantErr: true,
+		},
+		{
+			name:       "colon in socket path",
+			url:        "unix:///run/app:1.sock",
+			wantSocket: "/run/app:1.sock",
+		},
+		{
+			name:       "colon in socket path with path prefix",
+			url:        "unix:///run/app:1.sock:/api",
+			wantSocket: "/run/app:1.sock",
+			wantPath:   "/api",
+		},
+		{
+			name:       "colon without path prefix",
+			url:        "unix:///run/app.sock:api",
+			wantSocket: "/run/app.sock:api",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, socket, err := parseUnixURL(tc.url)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantSocket, socket)
+			assert.Equal(t, tc.wantPath, u.Path)
+
+			dialed, ok := unixSocket(u.Host + ":80")
+			assert.True(t, ok)
+			assert.Equal(t, tc.wantSocket, dialed)
+		})
+	}
+
+	_, ok := unixSocket("example.com:80")
+	assert.False(t, ok)
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	// unix sockets never go through the proxy of the environment
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host+" "+r.URL.Path+" "+r.Header.Get("X-Forwarded-Host"))
+	}))
+	backend.Listener = l
+	backend.Start()
+	defer backend.Close()
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: "unix://" + socket + ":/api"},
+	}, nil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(ts.URL + "/users")
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "localhost /api/users "+ts.Listener.Addr().String(), string(body))
+	}
+}
@@ -0,0 +1,256 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// hopHeaders are the hop-by-hop headers that are never forwarded, see RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upgradeType returns the protocol the request wants to switch to, or an empty string
+// if it isn't an upgrade request
+func upgradeType(h http.Header) string {
+	if !headerHasToken(h, "Connection", "upgrade") {
+		return ""
+	}
+
+	return h.Get("Upgrade")
+}
+
+// headerHasToken returns true if the comma separated header contains the token
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// removeHopHeaders removes the hop-by-hop headers and any headers named in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// proxyUpgrade proxies a protocol upgrade (ie. websockets).  The request is sent to the origin
+// through the origin transport, so the same tls settings apply, and once the origin switches
+// protocols the client connection is hijacked and spliced to the origin connection.
+func (p *proxy) proxyUpgrade(w http.ResponseWriter, r *http.Request, protocol string) {
+	logger := p.requestLogger(r.Context(), r).With(zap.String("upgrade", protocol))
+
+	outreq := r.Clone(r.Context())
+	if r.ContentLength == 0 {
+		outreq.Body = nil
+	}
+
+	// the director strips the hop-by-hop headers, put back the ones for the upgrade
+	p.director(outreq)
+
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", protocol)
+
+	if peer, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := outreq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			peer = strings.Join(prior, ", ") + ", " + peer
+		}
+
+		outreq.Header.Set("X-Forwarded-For", peer)
+	}
+
+	resp, err := p.transport.RoundTrip(outreq)
+	if err != nil {
+		p.errorHandler(w, r, err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the origin refused the upgrade, return its response as is
+		defer resp.Body.Close()
+
+		if err := p.modifyResponse(resp); err != nil {
+			p.errorHandler(w, r, err)
+			return
+		}
+
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			logger.Debug("failed copying refused upgrade response", zap.Error(err))
+		}
+
+		return
+	}
+
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		p.errorHandler(w, r, errors.New("origin switched protocols without a writable body"))
+
+		return
+	}
+	defer backConn.Close()
+
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), protocol) {
+		p.errorHandler(w, r, fmt.Errorf("origin switched to protocol %q, requested %q", resp.Header.Get("Upgrade"), protocol))
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		p.errorHandler(w, r, errors.New("response writer does not support hijacking"))
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		p.errorHandler(w, r, fmt.Errorf("failed to hijack client connection: %w", err))
+		return
+	}
+	defer conn.Close()
+
+	// the connection is closed without a response if the server is already shutting down
+	release, ok := p.upgrades.track(conn, backConn)
+	if !ok {
+		logger.Debug("server is shutting down, closing upgraded connection")
+		return
+	}
+	defer release()
+
+	resp.Body = nil
+	if err := p.modifyResponse(resp); err != nil {
+		logger.Debug("failed to sanitize upgrade response", zap.Error(err))
+	}
+
+	if err := resp.Write(brw); err != nil {
+		logger.Debug("failed writing switching protocols response", zap.Error(err))
+		return
+	}
+
+	if err := brw.Flush(); err != nil {
+		logger.Debug("failed flushing switching protocols response", zap.Error(err))
+		return
+	}
+
+	p.metrics.upgradedConnections.WithLabelValues(p.origin.name, strings.ToLower(protocol)).Inc()
+	p.metrics.upgradedActive.WithLabelValues(p.origin.name, strings.ToLower(protocol)).Inc()
+	defer p.metrics.upgradedActive.WithLabelValues(p.origin.name, strings.ToLower(protocol)).Dec()
+
+	logger.Debug("splicing upgraded connection")
+
+	errc := make(chan error, 2)
+
+	go spliceConn(errc, backConn, brw)
+	go spliceConn(errc, conn, backConn)
+
+	// once either side is done close both connections, which ends the other copy
+	if err := <-errc; err != nil && !isClosedConnError(err) {
+		logger.Debug("upgraded connection closed with error", zap.Error(err))
+	}
+}
+
+func spliceConn(errc chan<- error, dst io.Writer, src io.Reader) {
+	_, err := io.Copy(dst, src)
+	errc <- err
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF)
+}
+
+// upgradeTracker keeps track of upgraded connections so they can be closed on shutdown,
+// http.Server.Shutdown doesn't know about hijacked connections
+type upgradeTracker struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	conns  map[*trackedUpgrade]struct{}
+	closed bool
+}
+
+type trackedUpgrade struct {
+	client  io.Closer
+	backend io.Closer
+}
+
+func newUpgradeTracker() *upgradeTracker {
+	return &upgradeTracker{
+		conns: map[*trackedUpgrade]struct{}{},
+	}
+}
+
+// track registers an upgraded connection pair and returns the func to call once it is done,
+// it returns false if the tracker is already closed and the caller has to close the pair
+func (t *upgradeTracker) track(client, backend io.Closer) (func(), bool) {
+	u := &trackedUpgrade{client: client, backend: backend}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, false
+	}
+
+	t.conns[u] = struct{}{}
+	t.wg.Add(1)
+
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, u)
+		t.mu.Unlock()
+
+		t.wg.Done()
+	}, true
+}
+
+// closeAll closes all upgraded connections and waits for them to finish
+func (t *upgradeTracker) closeAll() {
+	t.mu.Lock()
+	t.closed = true
+
+	for u := range t.conns {
+		u.client.Close()
+		u.backend.Close()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+}
@@ -0,0 +1,151 @@
+package srv
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoUpgradeBackend returns an origin that switches to the "echo" protocol and echoes
+// everything it reads
+func newEchoUpgradeBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+
+		_, _ = io.Copy(conn, brw)
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+	}, nil)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: tucson\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+
+	_, err = io.WriteString(conn, "ping")
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// shutting down closes the spliced connections
+	s.upgrades.closeAll()
+
+	_, err = br.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestProxyUpgradeRefused(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+
+	_, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+	}, nil)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ws", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestProxyUpgradeDuringShutdown(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+
+	s, ts := newTestTucson(t, map[string]*Origin{
+		"default": {BaseUrl: backend.URL},
+	}, nil)
+
+	// the upgrade arrives after the upgraded connections were closed
+	s.upgrades.closeAll()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: tucson\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	require.NoError(t, err)
+
+	_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Error(t, err)
+
+	assert.Empty(t, s.upgrades.conns)
+}
+
+func TestUpgradeTrackerClosed(t *testing.T) {
+	tracker := newUpgradeTracker()
+	tracker.closeAll()
+
+	client, backend := &closeCounter{}, &closeCounter{}
+
+	release, ok := tracker.track(client, backend)
+	assert.False(t, ok)
+	assert.Nil(t, release)
+
+	// the caller closes the pair, the tracker doesn't wait for it
+	assert.Zero(t, client.closed)
+	assert.Zero(t, backend.closed)
+	assert.Empty(t, tracker.conns)
+
+	tracker.closeAll()
+}
+
+type closeCounter struct {
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
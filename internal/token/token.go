@@ -17,6 +17,8 @@ var (
 type Token struct {
 	alg     jose.SignatureAlgorithm
 	exp     time.Time
+	iat     time.Time
+	id      string
 	key     string
 	nbf     time.Time
 	subject string
@@ -71,6 +73,20 @@ func WithExpire(d time.Time) Option {
 	}
 }
 
+// WithIssuedAt sets the jwt iat
+func WithIssuedAt(d time.Time) Option {
+	return func(t *Token) {
+		t.iat = d
+	}
+}
+
+// WithID sets the jwt jti
+func WithID(id string) Option {
+	return func(t *Token) {
+		t.id = id
+	}
+}
+
 // WithSubject sets the jwt subject
 func WithSubject(s string) Option {
 	return func(t *Token) {
@@ -112,11 +128,16 @@ func (t *Token) newSigned() (string, error) {
 	}
 
 	cl := jwt.Claims{
+		ID:        t.id,
 		Subject:   t.subject,
 		NotBefore: jwt.NewNumericDate(t.nbf.UTC()),
 		Expiry:    jwt.NewNumericDate(t.exp.UTC()),
 	}
 
+	if !t.iat.IsZero() {
+		cl.IssuedAt = jwt.NewNumericDate(t.iat.UTC())
+	}
+
 	builder := jwt.Signed(sig).Claims(cl)
 	for _, p := range t.private {
 		builder = builder.Claims(p)
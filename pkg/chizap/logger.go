@@ -155,6 +155,12 @@ func Recovery(logger *zap.Logger, stack bool, opts ...Option) func(next http.Han
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if err := recover(); err != nil {
+					// the handler intentionally aborted the response, ie. a proxied
+					// response failed mid-stream.  let net/http close the connection.
+					if err == http.ErrAbortHandler {
+						panic(err)
+					}
+
 					var brokenPipe bool
 
 					// Check for a broken connection, as it is not really a